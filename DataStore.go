@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+
+	"golang.org/x/exp/slices"
 )
 
 /*
@@ -1028,17 +1030,25 @@ func FilterCheckMatchExact(item any, obj map[string]any) (bool, error) {
 			return false, fmt.Errorf("[FilterCheckMatchExact] broken reflection indirect of field %s", fieldName)
 		}
 
-		f := indirect.FieldByName(strings.Title(fieldName))
+		var value any
 
-		if !f.IsValid() {
-			return false, fmt.Errorf("[FilterCheckMatchExact] broken reflection of field %s", fieldName)
-		}
+		if indirect.Kind() == reflect.Map {
+			if f := indirect.MapIndex(reflect.ValueOf(fieldName)); f.IsValid() && f.CanInterface() {
+				value = f.Interface()
+			}
+		} else {
+			f := indirect.FieldByName(strings.Title(fieldName))
 
-		if !f.CanInterface() {
-			return false, fmt.Errorf("[FilterCheckMatchExact] broken reflection of field %s", fieldName)
-		}
+			if !f.IsValid() {
+				return false, fmt.Errorf("[FilterCheckMatchExact] broken reflection of field %s", fieldName)
+			}
 
-		value := f.Interface()
+			if !f.CanInterface() {
+				return false, fmt.Errorf("[FilterCheckMatchExact] broken reflection of field %s", fieldName)
+			}
+
+			value = f.Interface()
+		}
 
 		if expected == nil && value == nil {
 			continue
@@ -1058,6 +1068,19 @@ func FilterCheckMatchExact(item any, obj map[string]any) (bool, error) {
 		case string:
 			value = strings.TrimRight(value.(string), " ")
 		}
+		// rows loaded from json files have float64 numbers, filters usually have int
+		value = filterNormalizeNumber(value)
+		// one list of expected values match any of them, like "= ANY" in sql
+		if list, ok := filterList(expected); ok {
+			if slices.IndexFunc(list, func(e any) bool { return filterNormalizeNumber(e) == value }) < 0 {
+				match = false
+				break
+			}
+
+			continue
+		}
+
+		expected = filterNormalizeNumber(expected)
 
 		if value != expected {
 			match = false
@@ -1068,6 +1091,38 @@ func FilterCheckMatchExact(item any, obj map[string]any) (bool, error) {
 	return match, nil
 }
 
+func filterList(value any) ([]any, bool) {
+	switch v := value.(type) {
+	case []any:
+		return v, true
+	case []int:
+		list := make([]any, 0, len(v))
+
+		for _, item := range v {
+			list = append(list, item)
+		}
+
+		return list, true
+	}
+
+	return nil, false
+}
+
+func filterNormalizeNumber(value any) any {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	}
+
+	return value
+}
+
 func FilterFind(listIn []map[string]any, filter map[string]any) ([]map[string]any, error) {
 	if filter == nil {
 		return listIn, nil
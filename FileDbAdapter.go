@@ -3,15 +3,20 @@ package rufsBase
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
 	"io/ioutil"
 	"log"
+	"sync"
 )
 
+// FileDbAdapter keep the tables in memory and in json files. The mutex guard fileTables, because the requests and
+// the background jobs (ex. trashPurge) use it at same time, and the stored rows are never changed in place.
 type FileDbAdapter struct {
 	openapi    *OpenApi
 	fileTables map[string][]map[string]any
+	mutex      sync.RWMutex
 }
 
 func (fileDbAdapter *FileDbAdapter) Connect() error {
@@ -25,11 +30,16 @@ func (fileDbAdapter *FileDbAdapter) Connect() error {
 	}
 */
 func (fda *FileDbAdapter) Load(name string, defaultRows []map[string]any) (err error) {
+	fda.mutex.Lock()
+	defer fda.mutex.Unlock()
+
 	var data []byte
 	var list []map[string]any
 
 	if data, err = ioutil.ReadFile(fmt.Sprintf("%s.json", name)); err == nil {
 		err = json.Unmarshal(data, &list)
+	} else if errors.Is(err, fs.ErrNotExist) {
+		err = nil
 	}
 
 	if fda.fileTables == nil {
@@ -37,6 +47,14 @@ func (fda *FileDbAdapter) Load(name string, defaultRows []map[string]any) (err e
 	}
 
 	if len(list) == 0 && len(defaultRows) > 0 {
+		if schema, ok := fda.openapi.Components.Schemas[name]; ok && schema.Properties["id"] != nil {
+			for i, item := range defaultRows {
+				if _, ok := item["id"]; !ok {
+					item["id"] = i + 1
+				}
+			}
+		}
+
 		err = fda.store(name, defaultRows)
 		list = defaultRows
 	}
@@ -86,7 +104,41 @@ func (fda *FileDbAdapter) store(name string, list []map[string]any) error {
 	return nil
 }
 
+func (fileDbAdapter *FileDbAdapter) hasTable(name string) bool {
+	fileDbAdapter.mutex.RLock()
+	defer fileDbAdapter.mutex.RUnlock()
+
+	_, ok := fileDbAdapter.fileTables[name]
+	return ok
+}
+
+// snapshot return one function that restore the table name to the current rows, used to undo failed batches.
+// The other tables are not restored, then the writes of concurrent requests in them are kept.
+func (fileDbAdapter *FileDbAdapter) snapshot(name string) func() error {
+	fileDbAdapter.mutex.RLock()
+	defer fileDbAdapter.mutex.RUnlock()
+
+	list, ok := fileDbAdapter.fileTables[name]
+	data, _ := json.Marshal(list)
+
+	return func() error {
+		if !ok {
+			return nil
+		}
+
+		fileDbAdapter.mutex.Lock()
+		defer fileDbAdapter.mutex.Unlock()
+
+		list := []map[string]any{}
+		json.Unmarshal(data, &list)
+		return fileDbAdapter.store(name, list)
+	}
+}
+
 func (fileDbAdapter *FileDbAdapter) Insert(tableName string, obj map[string]any) (map[string]any, error) {
+	fileDbAdapter.mutex.Lock()
+	defer fileDbAdapter.mutex.Unlock()
+
 	list, ok := fileDbAdapter.fileTables[tableName]
 
 	if !ok {
@@ -120,14 +172,40 @@ func (fileDbAdapter *FileDbAdapter) Insert(tableName string, obj map[string]any)
 }
 
 func (fileDbAdapter *FileDbAdapter) Find(tableName string, fields map[string]any, orderBy []string) ([]map[string]any, error) {
+	fileDbAdapter.mutex.RLock()
+	defer fileDbAdapter.mutex.RUnlock()
+
 	if list, ok := fileDbAdapter.fileTables[tableName]; ok {
-		return FilterFind(list, fields)
+		listOut, _ := queryApply(list, &RufsQuery{Conditions: queryConditionsFromFields(fields), Sort: queryOrderBy(orderBy)})
+		return listOut, nil
 	}
 
 	return nil, fmt.Errorf("Don't find")
 }
 
+func (fileDbAdapter *FileDbAdapter) Query(tableName string, query *RufsQuery) ([]map[string]any, int, error) {
+	fileDbAdapter.mutex.RLock()
+	defer fileDbAdapter.mutex.RUnlock()
+
+	if list, ok := fileDbAdapter.fileTables[tableName]; ok {
+		listOut, total := queryApply(list, query)
+
+		if query.Fields != nil {
+			for i, item := range listOut {
+				listOut[i] = queryProjectFields(item, query.Fields)
+			}
+		}
+
+		return listOut, total, nil
+	}
+
+	return nil, 0, fmt.Errorf("[FileDbAdapter.Query] missing table %s", tableName)
+}
+
 func (fileDbAdapter *FileDbAdapter) FindOne(tableName string, key map[string]any) (map[string]any, error) {
+	fileDbAdapter.mutex.RLock()
+	defer fileDbAdapter.mutex.RUnlock()
+
 	list, ok := fileDbAdapter.fileTables[tableName]
 
 	if !ok {
@@ -140,6 +218,10 @@ func (fileDbAdapter *FileDbAdapter) FindOne(tableName string, key map[string]any
 		return nil, fmt.Errorf("[FileDbAdapter.FindOne] don't found register in %s with key %s", tableName, key)
 	}
 
+	if obj == nil {
+		return nil, nil
+	}
+
 	objMap := map[string]any{}
 	buffer, _ := json.Marshal(obj)
 	err = json.Unmarshal(buffer, &objMap)
@@ -147,6 +229,9 @@ func (fileDbAdapter *FileDbAdapter) FindOne(tableName string, key map[string]any
 }
 
 func (fileDbAdapter *FileDbAdapter) Update(tableName string, key map[string]any, obj map[string]any) (map[string]any, error) {
+	fileDbAdapter.mutex.Lock()
+	defer fileDbAdapter.mutex.Unlock()
+
 	list, ok := fileDbAdapter.fileTables[tableName]
 
 	if !ok {
@@ -159,12 +244,26 @@ func (fileDbAdapter *FileDbAdapter) Update(tableName string, key map[string]any,
 		return nil, fmt.Errorf("[FileDbAdapter.update(name = %s, key = %s)] fail : %s", tableName, key, err)
 	}
 
-	list[pos] = obj
+	// only the informed fields are changed, like the sql UPDATE, in one new row because the old one can be in use
+	newObj := make(map[string]any, len(list[pos])+len(obj))
+
+	for fieldName, value := range list[pos] {
+		newObj[fieldName] = value
+	}
+
+	for fieldName, value := range obj {
+		newObj[fieldName] = value
+	}
+
+	list = append(list[:pos:pos], append([]map[string]any{newObj}, list[pos+1:]...)...)
 	fileDbAdapter.store(tableName, list)
-	return obj, nil
+	return newObj, nil
 }
 
 func (fileDbAdapter *FileDbAdapter) DeleteOne(tableName string, key map[string]any) error {
+	fileDbAdapter.mutex.Lock()
+	defer fileDbAdapter.mutex.Unlock()
+
 	list, ok := fileDbAdapter.fileTables[tableName]
 
 	if !ok {
@@ -177,7 +276,7 @@ func (fileDbAdapter *FileDbAdapter) DeleteOne(tableName string, key map[string]a
 		return fmt.Errorf("[FileDbAdapter.DeleteOne(name = %s, key = %s)] fail : %s", tableName, key, err)
 	}
 
-	list = append(list[:pos], list[pos+1:]...)
+	list = append(list[:pos:pos], list[pos+1:]...)
 	return fileDbAdapter.store(tableName, list)
 }
 
@@ -14,6 +14,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 
 	"github.com/gorilla/websocket"
 )
@@ -22,6 +23,7 @@ type Response struct {
 	StatusCode  int
 	ContentType string
 	Body        []byte
+	Header      http.Header
 }
 
 func ResponseCreate(body []byte, status int) Response {
@@ -71,8 +73,23 @@ type IMicroServiceServer interface {
 	Shutdown()
 	OnRequest(req *http.Request) Response
 	OnWsMessageFromClient(connection *websocket.Conn, tokenString string)
+	OnWsClose(connection *websocket.Conn)
 }
 
+// wsConn is one websocket client, gorilla accept only one concurrent writer by connection.
+type wsConn struct {
+	*websocket.Conn
+	writeMutex sync.Mutex
+}
+
+func (connection *wsConn) WriteJSON(v any) error {
+	connection.writeMutex.Lock()
+	defer connection.writeMutex.Unlock()
+	return connection.Conn.WriteJSON(v)
+}
+
+// MicroServiceServer serve the http requests and the websocket clients, wsMutex guard wsServerConnections (and the
+// maps of websocket clients of RufsMicroService), that are changed by the goroutines of requests and of websockets.
 type MicroServiceServer struct {
 	appName                string
 	protocol               string
@@ -84,7 +101,8 @@ type MicroServiceServer struct {
 	ServeStaticPaths       string
 	openapiFileName        string
 	openapi                *OpenApi
-	wsServerConnections    map[string]*websocket.Conn
+	wsServerConnections    map[string]*wsConn
+	wsMutex                sync.RWMutex
 	httpServer             *http.Server
 	Imss                   IMicroServiceServer
 }
@@ -95,7 +113,7 @@ func (mss *MicroServiceServer) OnRequest(req *http.Request) Response {
 }
 
 func (mss *MicroServiceServer) Listen() error {
-	mss.wsServerConnections = make(map[string]*websocket.Conn)
+	mss.wsServerConnections = make(map[string]*wsConn)
 	serveStaticPaths := path.Join(path.Dir(reflect.TypeOf(mss).PkgPath()), "webapp")
 
 	if mss.ServeStaticPaths == "" {
@@ -153,8 +171,9 @@ func (mss *MicroServiceServer) Listen() error {
 		log.Printf("curl -X '%s' %s -d '%s' -H \"Authorization: $authorization\";", req.Method, req.RequestURI, rdr1)
 		req.Body = rdr2
 		res.Header().Set("Access-Control-Allow-Origin", "*")
-		res.Header().Set("Access-Control-Allow-Methods", "GET, PUT, OPTIONS, POST, DELETE")
+		res.Header().Set("Access-Control-Allow-Methods", "GET, PUT, OPTIONS, POST, DELETE, PATCH")
 		res.Header().Set("Access-Control-Allow-Headers", req.Header.Get("Access-Control-Request-Headers"))
+		res.Header().Set("Access-Control-Expose-Headers", "ETag, X-Total-Count, Link")
 
 		if req.Method == http.MethodOptions {
 			fmt.Fprint(res, "Ok")
@@ -163,6 +182,11 @@ func (mss *MicroServiceServer) Listen() error {
 
 		ret := mss.Imss.OnRequest(req)
 		res.Header().Set("Content-Type", ret.ContentType)
+
+		for name, values := range ret.Header {
+			res.Header()[name] = values
+		}
+
 		//log.Printf("[HandleFunc] : ret.Body = %s", string(ret.Body))
 		res.WriteHeader(ret.StatusCode)
 		res.Write(ret.Body)
@@ -197,6 +221,8 @@ func (mss *MicroServiceServer) Listen() error {
 
 			mss.Imss.OnWsMessageFromClient(connection, string(message))
 		}
+
+		mss.Imss.OnWsClose(connection)
 	})
 
 	log.Print("[MicroServiceServer.Listen]")
@@ -255,6 +281,18 @@ func (mss *MicroServiceServer) StoreOpenApi(fileName string) (err error) {
 func (mss *MicroServiceServer) OnWsMessageFromClient(connection *websocket.Conn, tokenString string) {
 }
 
+// OnWsClose forget the closed connection, to avoid notifications to clients already gone.
+func (mss *MicroServiceServer) OnWsClose(connection *websocket.Conn) {
+	mss.wsMutex.Lock()
+	defer mss.wsMutex.Unlock()
+
+	for tokenString, wsServerConnection := range mss.wsServerConnections {
+		if wsServerConnection.Conn == connection {
+			delete(mss.wsServerConnections, tokenString)
+		}
+	}
+}
+
 func (mss *MicroServiceServer) Shutdown() {
 	mss.httpServer.Shutdown(context.Background())
 }
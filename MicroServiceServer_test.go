@@ -1,15 +1,29 @@
 package rufsBase
 
 import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"log"
+	"math/big"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/websocket"
 	"golang.org/x/exp/slices"
 )
 
@@ -78,6 +92,10 @@ func TestBase(t *testing.T) {
 		log.Fatal("[TestBase] don't find user admin")
 	}
 
+	if foundUser.Password != "" {
+		log.Fatal("[TestBase] writeOnly field password must not be returned")
+	}
+
 	sc.lastMessage = NotifyMessage{}
 	foundUser.FullName = time.Now().String()
 	updatedUser := &RufsUser{}
@@ -89,6 +107,13 @@ func TestBase(t *testing.T) {
 		log.Fatalf("[TestBase] error in update user request : %d : %s", resp.StatusCode, err)
 	}
 
+	listAuditLog := []*RufsAuditLog{}
+	resp, err = RufsRestRequest(&sc.httpRest, "/rest/audit_log", http.MethodGet, map[string]any{"schemaName": "rufsUser", "primaryKey": map[string]any{"id": foundUser.Id}}, &listAuditLog, &listAuditLog)
+
+	if err != nil || resp.StatusCode != http.StatusOK || len(listAuditLog) == 0 || listAuditLog[0].Action != "update" || listAuditLog[0].Changes["fullName"] == nil {
+		log.Fatalf("[TestBase] error in audit log request : %d : %s", resp.StatusCode, err)
+	}
+
 	sc.lastMessage = NotifyMessage{}
 	newUserOut := &RufsUser{RufsUserProteced: RufsUserProteced{Name: "tmp"}}
 	newUserIn := &RufsUser{}
@@ -132,6 +157,48 @@ func TestBase(t *testing.T) {
 		log.Fatalf("[TestBase] security fail, application is serving content out of limited scope : %s", sc.httpRest.MessageWorking)
 	}
 
+	oldToken := sc.httpRest.Token
+	oldRefreshToken := sc.loginResponse.RefreshToken
+	resp, err = sc.Refresh()
+
+	if err != nil || resp.StatusCode != http.StatusOK || sc.loginResponse.RefreshToken == oldRefreshToken {
+		log.Fatalf("[TestBase] error in refresh token request : %d : %s", resp.StatusCode, err)
+	}
+
+	sc.loginResponse.RefreshToken = oldRefreshToken
+	resp, err = sc.Refresh()
+
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		log.Fatalf("[TestBase] reuse of refresh token must be refused : %d : %s", resp.StatusCode, err)
+	}
+
+	sc.httpRest.Token = oldToken
+	resp, err = RufsRestRequest(&sc.httpRest, "/rest/rufs_user", http.MethodGet, nil, &listUser, &listUser)
+
+	if err != nil || resp.StatusCode == http.StatusOK {
+		log.Fatalf("[TestBase] reuse of refresh token must revoke the session : %d : %s", resp.StatusCode, err)
+	}
+
+	resp, err = sc.Login("http://localhost:8080", "", "/rest/login", loginDataReq.Name, loginDataReq.Password)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Fatalf("[TestBase] Error in login request : %d : %s", resp.StatusCode, err)
+	}
+
+	token := sc.httpRest.Token
+	resp, err = sc.logout()
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Fatalf("[TestBase] error in logout request : %d : %s", resp.StatusCode, err)
+	}
+
+	sc.httpRest.Token = token
+	resp, err = RufsRestRequest(&sc.httpRest, "/rest/rufs_user", http.MethodGet, nil, &listUser, &listUser)
+
+	if err != nil || resp.StatusCode == http.StatusOK {
+		log.Fatalf("[TestBase] token of closed session must be refused : %d : %s", resp.StatusCode, err)
+	}
+
 	//	time.Sleep(2000 * time.Millisecond)
 	log.Printf("[TestLogin] service.Shutdown()")
 	service.Shutdown()
@@ -149,6 +216,1422 @@ func TestExternal(t *testing.T) {
 	}
 }
 
+// fileMicroService return one service without database, with the rufs tables stored in files of one temporary folder.
+func fileMicroService(t *testing.T) *RufsMicroService {
+	// the responses of CRUD must match the openapi
+	t.Setenv("RUFS_VALIDATE_RESPONSES", "fail")
+	wd, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+	t.Cleanup(func() { os.Chdir(wd) })
+	openapiRufs := &OpenApi{}
+	json.Unmarshal([]byte(rufsMicroServiceOpenApiStr), openapiRufs)
+	service := &RufsMicroService{}
+	service.Irms = service
+	service.Imss = service
+	service.openapi = &OpenApi{}
+	OpenApiCreate(service.openapi, "jwt")
+	service.openapi.FillOpenApi(FillOpenApiOptions{schemas: openapiRufs.Components.Schemas, security: map[string][]string{"jwt": {}}})
+	service.entityManager = &FileDbAdapter{fileTables: map[string][]map[string]any{}, openapi: service.openapi}
+	service.wsServerConnections = map[string]*wsConn{}
+	service.wsServerConnectionsTokens = map[string]*RufsClaims{}
+	service.wsServerConnectionsSince = map[string]time.Time{}
+	service.tokenExpiration = time.Hour
+	service.refreshTokenExpiration = time.Hour
+
+	if err := service.LoadFileTables(); err != nil {
+		t.Fatalf("[fileMicroService] LoadFileTables : %s", err)
+	}
+
+	return service
+}
+
+func fileMicroServiceRequest(service *RufsMicroService, method string, path string, token string, body string) Response {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return service.OnRequest(req)
+}
+
+// fileMicroServiceLogin return the service with file tables and the login of the administrator.
+func fileMicroServiceLogin(t *testing.T) (*RufsMicroService, *LoginResponse) {
+	service := fileMicroService(t)
+	service.apiPath = "rest"
+	loginResponse := &LoginResponse{}
+	resp := fileMicroServiceRequest(service, http.MethodPost, "/rest/login", "", `{"user": "admin", "password": "21232f297a57a5a743894a0e4a801fc3"}`)
+
+	if err := json.Unmarshal(resp.Body, loginResponse); err != nil || loginResponse.JwtHeader == "" {
+		t.Fatalf("[fileMicroServiceLogin] login of admin : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	return service, loginResponse
+}
+
+// fileMicroServiceLoginUser create one user (not administrator) of rufsGroupOwner with roles and return its login.
+func fileMicroServiceLoginUser(t *testing.T, service *RufsMicroService, token string, name string, rufsGroupOwner int, roles string) *LoginResponse {
+	password := fmt.Sprintf("%x", md5.Sum([]byte(name+"-secret")))
+	resp := fileMicroServiceRequest(service, http.MethodPost, "/rest/rufs_user", token, fmt.Sprintf(`{"name": "%s", "rufsGroupOwner": %d, "password": "%s", "roles": %s}`, name, rufsGroupOwner, password, roles))
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("[fileMicroServiceLoginUser] create of %s : %d : %s", name, resp.StatusCode, resp.Body)
+	}
+
+	loginResponse := &LoginResponse{}
+	resp = fileMicroServiceRequest(service, http.MethodPost, "/rest/login", "", fmt.Sprintf(`{"user": "%s", "password": "%s"}`, name, password))
+
+	if err := json.Unmarshal(resp.Body, loginResponse); err != nil || loginResponse.JwtHeader == "" {
+		t.Fatalf("[fileMicroServiceLoginUser] login of %s : %d : %s", name, resp.StatusCode, resp.Body)
+	}
+
+	return loginResponse
+}
+
+// TestOidc login with one mock OpenID Connect provider, with the rufs tables stored in files.
+func TestOidc(t *testing.T) {
+	privateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	codes := map[string]url.Values{}
+	var provider *httptest.Server
+	var jwksRequests int32
+
+	provider = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(res).Encode(map[string]string{"issuer": provider.URL, "authorization_endpoint": provider.URL + "/authorize", "token_endpoint": provider.URL + "/token", "jwks_uri": provider.URL + "/jwks"})
+		case "/jwks":
+			atomic.AddInt32(&jwksRequests, 1)
+			n := base64.RawURLEncoding.EncodeToString(privateKey.N.Bytes())
+			e := base64.RawURLEncoding.EncodeToString(big.NewInt(int64(privateKey.E)).Bytes())
+			json.NewEncoder(res).Encode(map[string]any{"keys": []map[string]string{{"kid": "k1", "kty": "RSA", "alg": "RS256", "n": n, "e": e}}})
+		case "/token":
+			req.ParseForm()
+			authorization, ok := codes[req.Form.Get("code")]
+			codeChallenge := sha256.Sum256([]byte(req.Form.Get("code_verifier")))
+
+			if !ok || authorization.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(codeChallenge[:]) || authorization.Get("client_id") != req.Form.Get("client_id") {
+				res.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"iss": provider.URL, "aud": "rufs", "sub": "external-1", "exp": time.Now().Add(time.Minute).Unix(), "nonce": authorization.Get("nonce"), "preferred_username": "oidc_user", "groups": []string{"operators", "unknown"}})
+			token.Header["kid"] = "k1"
+			idToken, _ := token.SignedString(privateKey)
+			json.NewEncoder(res).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+		default:
+			res.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	defer provider.Close()
+	service := fileMicroService(t)
+	service.oidc = &RufsOidc{Issuer: provider.URL, ClientId: "rufs", RedirectUri: "http://localhost:8080/oidc.html", DefaultGroupOwner: "admin", DefaultRoles: []Role{{Path: "/rufs_group", Mask: 1}}}
+
+	service.fileDbAdapter.Insert("rufsGroup", map[string]any{"name": "operators", "roles": []Role{{Path: "/rufs_group_user", Mask: 1}, {Path: "/rufs_group", Mask: 31}}})
+
+	authorize := func() url.Values {
+		resp := service.OnRequest(httptest.NewRequest(http.MethodGet, "/rest/oidc/login", nil))
+		obj := map[string]string{}
+		json.Unmarshal(resp.Body, &obj)
+		authorizationUrl, err := url.Parse(obj["url"])
+
+		if resp.StatusCode != http.StatusOK || err != nil || !strings.HasPrefix(obj["url"], provider.URL+"/authorize?") {
+			t.Fatalf("[TestOidc] error in oidc login request : %d : %s", resp.StatusCode, resp.Body)
+		}
+
+		return authorizationUrl.Query()
+	}
+
+	authorization := authorize()
+	codes["code1"] = authorization
+	resp := service.OnRequest(httptest.NewRequest(http.MethodGet, "/rest/oidc/callback?code=code1&state="+authorization.Get("state"), nil))
+	loginResponse := &LoginResponse{}
+	json.Unmarshal(resp.Body, loginResponse)
+
+	if resp.StatusCode != http.StatusOK || loginResponse.Name != "oidc_user" || loginResponse.RufsGroupOwner != 1 || len(loginResponse.Groups) != 1 || loginResponse.JwtHeader == "" {
+		t.Fatalf("[TestOidc] error in oidc callback request : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	// the role of rufsUser override the one of rufsGroup
+	if _, ok := loginResponse.Openapi.Paths["/rufs_group"]["get"]; !ok || len(loginResponse.Openapi.Paths) != 2 || len(loginResponse.Openapi.Paths["/rufs_group"]) != 1 || loginResponse.Openapi.Paths["/rufs_group_user"] == nil {
+		t.Fatalf("[TestOidc] openapi of login response must have only the operations of user roles : %v", loginResponse.Openapi.Paths)
+	}
+
+	if _, ok := loginResponse.Openapi.Components.Schemas["rufsSession"]; ok || loginResponse.Openapi.Components.Schemas["rufsGroup"] == nil {
+		t.Fatal("[TestOidc] openapi of login response must have only the schemas of user roles")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/rest/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+loginResponse.JwtHeader)
+
+	if resp := service.OnRequest(req); resp.StatusCode != http.StatusOK {
+		t.Fatalf("[TestOidc] rufs token of oidc login refused : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	resp = service.OnRequest(httptest.NewRequest(http.MethodGet, "/rest/oidc/callback?code=code1&state="+authorization.Get("state"), nil))
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("[TestOidc] reuse of state must be refused : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	authorization = authorize()
+	authorization.Set("nonce", "other")
+	codes["code2"] = authorization
+	resp = service.OnRequest(httptest.NewRequest(http.MethodGet, "/rest/oidc/callback?code=code2&state="+authorization.Get("state"), nil))
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("[TestOidc] id_token with wrong nonce must be refused : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	authorization = authorize()
+	codes["code3"] = authorization
+	resp = service.OnRequest(httptest.NewRequest(http.MethodGet, "/rest/oidc/callback?code=code3&state="+authorization.Get("state"), nil))
+	json.Unmarshal(resp.Body, loginResponse)
+
+	if list, _ := service.fileDbAdapter.Find("rufsIdentity", map[string]any{}, []string{}); resp.StatusCode != http.StatusOK || len(list) != 1 {
+		t.Fatalf("[TestOidc] second login must reuse the linked user : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	if _, err := service.oidc.exchange("code3", authorization.Get("state")); err == nil {
+		t.Fatal("[TestOidc] state must be used only once")
+	}
+	// tokens with unknown kid reload the jwks at most once per minute
+	service.oidc.keysLoadedAt = time.Now().Add(-2 * time.Minute)
+	before := atomic.LoadInt32(&jwksRequests)
+
+	for i := 0; i < 3; i++ {
+		if _, err := service.oidc.publicKey("k2"); err == nil {
+			t.Fatal("[TestOidc] unknown kid accepted")
+		}
+	}
+
+	if requests := atomic.LoadInt32(&jwksRequests) - before; requests != 1 {
+		t.Fatalf("[TestOidc] %d requests of jwks for unknown kid, expected 1", requests)
+	}
+
+	if _, err := service.oidc.publicKey("k1"); err != nil {
+		t.Fatalf("[TestOidc] known kid after reload : %s", err)
+	}
+}
+
+// TestApiKey create, list and revoke api keys, and check the roles, the expiration and the revocation of keys.
+func TestApiKey(t *testing.T) {
+	service, adminLogin := fileMicroServiceLogin(t)
+	loginResponse := fileMicroServiceLoginUser(t, service, adminLogin.JwtHeader, "erin", 1, `[{"path": "/rufs_group", "mask": 3}]`)
+
+	if resp := fileMicroServiceRequest(service, http.MethodPost, "/rest/api_keys", loginResponse.JwtHeader, `{"name": "script", "roles": [{"path": "/rufs_group", "mask": 4}]}`); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("[TestApiKey] key with roles out of the user roles must be refused : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	resp := fileMicroServiceRequest(service, http.MethodPost, "/rest/api_keys", loginResponse.JwtHeader, `{"name": "script", "roles": [{"path": "/rufs_group", "mask": 1}]}`)
+	created := struct {
+		ApiKey *RufsApiKey `json:"apiKey"`
+		Key    string      `json:"key"`
+	}{}
+
+	if err := json.Unmarshal(resp.Body, &created); err != nil || resp.StatusCode != http.StatusOK || created.Key == "" || created.ApiKey.KeyHash != "" {
+		t.Fatalf("[TestApiKey] create : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	list := []*RufsApiKey{}
+	json.Unmarshal(fileMicroServiceRequest(service, http.MethodGet, "/rest/api_keys", loginResponse.JwtHeader, "").Body, &list)
+
+	if len(list) != 1 || list[0].Id != created.ApiKey.Id || list[0].KeyHash != "" {
+		t.Fatalf("[TestApiKey] list of keys of user : %v", list)
+	}
+
+	tokenPayload, err := service.apiKeyAuthenticate(created.Key, "")
+
+	if err != nil || tokenPayload.Name != "erin" || len(tokenPayload.Roles) != 1 || tokenPayload.Roles[0].Mask != 1 {
+		t.Fatalf("[TestApiKey] authenticate : %v : %v", err, tokenPayload)
+	}
+	// the roles of the key are reduced to the current roles of the owner
+	entityManager := service.getEntityManager("rufsApiKey")
+	created.ApiKey.KeyHash = rufsSessionHash(created.Key)
+	created.ApiKey.Roles = []Role{{Path: "/rufs_group", Mask: 7}, {Path: "/rufs_user", Mask: 1}}
+	entityManager.Update("rufsApiKey", map[string]any{"id": created.ApiKey.Id}, apiKeyToMap(created.ApiKey))
+
+	if tokenPayload, err = service.apiKeyAuthenticate(created.Key, ""); err != nil || len(tokenPayload.Roles) != 1 || tokenPayload.Roles[0].Path != "/rufs_group" || tokenPayload.Roles[0].Mask != 3 {
+		t.Fatalf("[TestApiKey] roles of key must be the intersection with the roles of owner : %v : %v", err, tokenPayload)
+	}
+
+	expiresAt := time.Now().Add(-time.Minute)
+	expired := &RufsApiKey{RufsUser: loginResponse.Id, Name: "expired", Prefix: "rufs_expired", KeyHash: rufsSessionHash("rufs_expired"), Roles: []Role{{Path: "/rufs_group", Mask: 1}}, CreatedAt: time.Now(), ExpiresAt: &expiresAt}
+	entityManager.Insert("rufsApiKey", apiKeyToMap(expired))
+
+	if _, err := service.apiKeyAuthenticate("rufs_expired", ""); err == nil {
+		t.Fatal("[TestApiKey] expired key must be refused")
+	}
+
+	otherLogin := fileMicroServiceLoginUser(t, service, adminLogin.JwtHeader, "frank", 1, `[{"path": "/rufs_group", "mask": 1}]`)
+	uri := fmt.Sprintf("/rest/api_keys?id=%d", created.ApiKey.Id)
+
+	if resp := fileMicroServiceRequest(service, http.MethodDelete, uri, otherLogin.JwtHeader, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("[TestApiKey] revoke of key of other user must be refused : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	if resp := fileMicroServiceRequest(service, http.MethodDelete, uri, loginResponse.JwtHeader, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("[TestApiKey] revoke : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	if _, err := service.apiKeyAuthenticate(created.Key, ""); err == nil {
+		t.Fatal("[TestApiKey] revoked key must be refused")
+	}
+
+	list = []*RufsApiKey{}
+	json.Unmarshal(fileMicroServiceRequest(service, http.MethodGet, "/rest/api_keys", loginResponse.JwtHeader, "").Body, &list)
+
+	if len(list) != 2 || !list[slices.IndexFunc(list, func(e *RufsApiKey) bool { return e.Id == created.ApiKey.Id })].Revoked {
+		t.Fatalf("[TestApiKey] list after revoke : %v", list)
+	}
+}
+
+// TestLoginOpenApi check that the openapi of login response follow the same mask rule of the requests.
+func TestLoginOpenApi(t *testing.T) {
+	service, adminLogin := fileMicroServiceLogin(t)
+	loginResponse := fileMicroServiceLoginUser(t, service, adminLogin.JwtHeader, "frank", 1, `[{"path": "/rufs_group", "mask": 32}, {"path": "/rufs_group_user", "mask": 1}]`)
+	// only the query bit don't allow the get
+	if _, ok := loginResponse.Openapi.Paths["/rufs_group"]["get"]; ok {
+		t.Fatalf("[TestLoginOpenApi] get advertised without the get bit : %v", loginResponse.Openapi.Paths)
+	}
+
+	if resp := fileMicroServiceRequest(service, http.MethodGet, "/rest/rufs_group", loginResponse.JwtHeader, ""); resp.StatusCode == http.StatusOK {
+		t.Fatalf("[TestLoginOpenApi] get allowed without the get bit : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	if _, ok := loginResponse.Openapi.Paths["/rufs_group_user"]["get"]; !ok {
+		t.Fatalf("[TestLoginOpenApi] missing get of /rufs_group_user : %v", loginResponse.Openapi.Paths)
+	}
+	// the schemas of foreign keys without role have only the primary key
+	for _, schemaName := range []string{"rufsUser", "rufsGroup"} {
+		if schema := loginResponse.Openapi.Components.Schemas[schemaName]; schema == nil || len(schema.Properties) != 1 || schema.Properties["id"] == nil {
+			t.Fatalf("[TestLoginOpenApi] schema %s must have only the primary key : %v", schemaName, schema)
+		}
+	}
+
+	if _, ok := loginResponse.Openapi.Components.Schemas["rufsGroupOwner"]; ok {
+		t.Fatal("[TestLoginOpenApi] schema rufsGroupOwner must not be in the openapi of login response")
+	}
+	// the fields that the user can't read are not advertised
+	service.openapi.Components.Schemas["rufsUser"].Properties["path"].ReadMask = 64
+	loginResponse = fileMicroServiceLoginUser(t, service, adminLogin.JwtHeader, "gina", 1, `[{"path": "/rufs_user", "mask": 1}]`)
+	schema := loginResponse.Openapi.Components.Schemas["rufsUser"]
+
+	if schema == nil || schema.Properties["name"] == nil || schema.Properties["password"] != nil || schema.Properties["path"] != nil {
+		t.Fatalf("[TestLoginOpenApi] schema rufsUser must not have writeOnly and masked fields : %v", schema)
+	}
+
+	if schema := service.openapi.Components.Schemas["rufsUser"]; schema.Properties["password"] == nil || schema.Properties["path"] == nil {
+		t.Fatal("[TestLoginOpenApi] the schema of service must not be changed")
+	}
+	// the administrator receive the whole document
+	if schema := adminLogin.Openapi.Components.Schemas["rufsUser"]; schema == nil || schema.Properties["password"] == nil || schema.Properties["path"] == nil {
+		t.Fatal("[TestLoginOpenApi] the administrator must receive the openapi of service")
+	}
+}
+
+func TestTotp(t *testing.T) {
+	// RFC 6238 test vector for SHA1, time 59
+	if code, _ := totpCode(totpEncoding.EncodeToString([]byte("12345678901234567890")), 59/30); code != "287082" {
+		t.Fatalf("[TestTotp] wrong code of RFC 6238 : %s", code)
+	}
+
+	service := fileMicroService(t)
+	loginResponse := &LoginResponse{}
+	json.Unmarshal(fileMicroServiceRequest(service, http.MethodPost, "/rest/login", "", `{"user": "admin", "password": "21232f297a57a5a743894a0e4a801fc3"}`).Body, loginResponse)
+	resp := fileMicroServiceRequest(service, http.MethodPost, "/rest/totp/enroll", loginResponse.JwtHeader, "")
+	enroll := struct {
+		Secret        string   `json:"secret"`
+		Uri           string   `json:"uri"`
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}{}
+	json.Unmarshal(resp.Body, &enroll)
+
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(enroll.Uri, "otpauth://totp/") || len(enroll.RecoveryCodes) != 10 {
+		t.Fatalf("[TestTotp] error in enroll request : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	step := time.Now().Unix() / 30
+	code, _ := totpCode(enroll.Secret, step)
+
+	if resp := fileMicroServiceRequest(service, http.MethodPost, "/rest/totp/activate", loginResponse.JwtHeader, `{"code": "`+code+`"}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("[TestTotp] error in activate request : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	challenge := map[string]string{}
+	resp = fileMicroServiceRequest(service, http.MethodPost, "/rest/login", "", `{"user": "admin", "password": "21232f297a57a5a743894a0e4a801fc3"}`)
+	json.Unmarshal(resp.Body, &challenge)
+
+	if resp.StatusCode != http.StatusOK || challenge["totpToken"] == "" || challenge["jwtHeader"] != "" {
+		t.Fatalf("[TestTotp] login with two-factor enabled must return only the totpToken : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	if resp := fileMicroServiceRequest(service, http.MethodPost, "/rest/login_totp", "", `{"totpToken": "`+challenge["totpToken"]+`", "code": "`+code+`"}`); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("[TestTotp] reuse of code must be refused : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	code, _ = totpCode(enroll.Secret, step+1)
+	resp = fileMicroServiceRequest(service, http.MethodPost, "/rest/login_totp", "", `{"totpToken": "`+challenge["totpToken"]+`", "code": "`+code+`"}`)
+	json.Unmarshal(resp.Body, loginResponse)
+
+	if resp.StatusCode != http.StatusOK || loginResponse.JwtHeader == "" {
+		t.Fatalf("[TestTotp] error in login_totp request : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	for i := 0; i < 2; i++ {
+		resp = fileMicroServiceRequest(service, http.MethodPost, "/rest/login_totp", "", `{"totpToken": "`+challenge["totpToken"]+`", "code": "`+enroll.RecoveryCodes[0]+`"}`)
+
+		if (i == 0 && resp.StatusCode != http.StatusOK) || (i == 1 && resp.StatusCode != http.StatusUnauthorized) {
+			t.Fatalf("[TestTotp] recovery code must be accepted only once : %d : %s", resp.StatusCode, resp.Body)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/rest/rufs_user", nil)
+	req.SetBasicAuth("admin", "21232f297a57a5a743894a0e4a801fc3")
+	service.openapi.Paths["/rufs_user"]["get"].Security = []SecurityRequirementObject{{"basic": {}}}
+
+	if resp := service.OnRequest(req); resp.StatusCode == http.StatusOK {
+		t.Fatal("[TestTotp] basic authentication must be refused for users with two-factor enabled")
+	}
+}
+
+// TestTenant check that users of one rufsGroupOwner don't see or change the rows of others.
+func TestTenant(t *testing.T) {
+	service := fileMicroService(t)
+	service.apiPath = "rest"
+	loginResponse := &LoginResponse{}
+	json.Unmarshal(fileMicroServiceRequest(service, http.MethodPost, "/rest/login", "", `{"user": "admin", "password": "21232f297a57a5a743894a0e4a801fc3"}`).Body, loginResponse)
+	fileMicroServiceRequest(service, http.MethodPost, "/rest/rufs_group_owner", loginResponse.JwtHeader, `{"name": "acme"}`)
+	fileMicroServiceRequest(service, http.MethodPost, "/rest/rufs_user", loginResponse.JwtHeader, `{"name": "carol", "rufsGroupOwner": 2, "password": "6f1ed002ab5595859014ebf0951522d9", "roles": [{"path": "/rufs_user", "mask": 31}]}`)
+	json.Unmarshal(fileMicroServiceRequest(service, http.MethodPost, "/rest/login", "", `{"user": "carol", "password": "6f1ed002ab5595859014ebf0951522d9"}`).Body, loginResponse)
+	resp := fileMicroServiceRequest(service, http.MethodPost, "/rest/rufs_user", loginResponse.JwtHeader, `{"name": "dave", "password": "0c1bd2c3cf4d3bd6a7b2ab9c6b7e3a3e"}`)
+	user := map[string]any{}
+	json.Unmarshal(resp.Body, &user)
+
+	if resp.StatusCode != http.StatusOK || UtilsToInt(user["rufsGroupOwner"]) != 2 {
+		t.Fatalf("[TestTenant] create must fill the rufsGroupOwner of user : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	list := []map[string]any{}
+	json.Unmarshal(fileMicroServiceRequest(service, http.MethodGet, "/rest/rufs_user?rufsGroupOwner=1", loginResponse.JwtHeader, "").Body, &list)
+
+	for _, item := range list {
+		if UtilsToInt(item["rufsGroupOwner"]) != 2 {
+			t.Fatalf("[TestTenant] query returned user of other rufsGroupOwner : %v", item)
+		}
+	}
+
+	if resp := fileMicroServiceRequest(service, http.MethodPut, "/rest/rufs_user?id=1", loginResponse.JwtHeader, `{"name": "admin2"}`); resp.StatusCode == http.StatusOK {
+		t.Fatal("[TestTenant] update of user of other rufsGroupOwner must be refused")
+	}
+
+	if resp := fileMicroServiceRequest(service, http.MethodDelete, "/rest/rufs_user?id=1", loginResponse.JwtHeader, ""); resp.StatusCode == http.StatusOK {
+		t.Fatal("[TestTenant] delete of user of other rufsGroupOwner must be refused")
+	}
+}
+
+// TestTenantGroup check the rufsGroup of created rows, that must be one of the groups of the user.
+func TestTenantGroup(t *testing.T) {
+	service := fileMicroService(t)
+	rf := &RequestFilter{microService: service, schemaName: "rufsGroupUser", tokenPayload: &TokenPayload{RufsUserProteced: RufsUserProteced{RufsGroupOwner: 2, Groups: []int{3, 4}}}}
+
+	if err := rf.tenantCheck(map[string]any{"rufsUser": 5}); err == nil {
+		t.Fatal("[TestTenantGroup] row without rufsGroup must be refused to user of many groups")
+	}
+
+	if err := rf.tenantCheck(map[string]any{"rufsUser": 5, "rufsGroup": 6}); err == nil {
+		t.Fatal("[TestTenantGroup] row of other rufsGroup must be refused")
+	}
+
+	if err := rf.tenantCheck(map[string]any{"rufsUser": 5, "rufsGroup": 4}); err != nil {
+		t.Fatalf("[TestTenantGroup] row of group of user : %s", err)
+	}
+
+	rf.tokenPayload.Groups = []int{3}
+	obj := map[string]any{"rufsUser": 5}
+
+	if err := rf.tenantCheck(obj); err != nil || UtilsToInt(obj["rufsGroup"]) != 3 {
+		t.Fatalf("[TestTenantGroup] row without rufsGroup must receive the only group of user : %v : %v", err, obj)
+	}
+
+	rf.tokenPayload.Groups = nil
+
+	if err := rf.tenantCheck(map[string]any{"rufsUser": 5}); err == nil {
+		t.Fatal("[TestTenantGroup] row without rufsGroup must be refused to user without groups")
+	}
+}
+
+// TestRowLevelSecurityExpression check the policies of tables with and without references to rufsGroupOwner and rufsGroup.
+func TestRowLevelSecurityExpression(t *testing.T) {
+	service := fileMicroService(t)
+	owner := "nullif(current_setting('rufs.group_owner', true), '')::integer"
+	expected := map[string]string{
+		"rufsGroupOwner": "current_setting('rufs.group_owner', true) = '1' OR (id = " + owner + ")",
+		"rufsUser":       "current_setting('rufs.group_owner', true) = '1' OR (rufs_group_owner = " + owner + ")",
+		"rufsGroupUser":  "current_setting('rufs.group_owner', true) = '1' OR (rufs_group = ANY (string_to_array(nullif(current_setting('rufs.groups', true), ''), ',')::integer[]))",
+		"rufsSession":    "",
+	}
+
+	for schemaName, expression := range expected {
+		if ret := rowLevelSecurityExpression(service.openapi, schemaName, service.openapi.Components.Schemas[schemaName], false); ret != expression {
+			t.Fatalf("[TestRowLevelSecurityExpression] %s : %s", schemaName, ret)
+		}
+	}
+	// the reports use the tenant fixed to its role, without the session variables
+	report := rowLevelSecurityExpression(service.openapi, "rufsUser", service.openapi.Components.Schemas["rufsUser"], true)
+
+	if report != "rufs_group_owner = (SELECT rufs_group_owner FROM rufs.tenant_role WHERE role_name = current_user)" {
+		t.Fatalf("[TestRowLevelSecurityExpression] report : %s", report)
+	}
+
+	if ret := rowLevelSecurityExpression(service.openapi, "rufsSession", service.openapi.Components.Schemas["rufsSession"], true); ret != "" {
+		t.Fatalf("[TestRowLevelSecurityExpression] report of rufsSession : %s", ret)
+	}
+	// the columns with other name in database
+	service.openapi.Components.Schemas["rufsUser"].Properties["rufsGroupOwner"].InternalName = "company"
+
+	if ret := rowLevelSecurityExpression(service.openapi, "rufsUser", service.openapi.Components.Schemas["rufsUser"], false); !strings.Contains(ret, "(company = ") {
+		t.Fatalf("[TestRowLevelSecurityExpression] internal name : %s", ret)
+	}
+}
+
+// TestAuditLog query the audit log by record, dates and pages, with the file tables.
+func TestAuditLog(t *testing.T) {
+	service, loginResponse := fileMicroServiceLogin(t)
+	fileMicroServiceRequest(service, http.MethodPost, "/rest/rufs_group", loginResponse.JwtHeader, `{"name": "sales"}`)
+	fileMicroServiceRequest(service, http.MethodPost, "/rest/rufs_group", loginResponse.JwtHeader, `{"name": "support"}`)
+	fileMicroServiceRequest(service, http.MethodPut, "/rest/rufs_group?id=1", loginResponse.JwtHeader, `{"name": "marketing"}`)
+	fileMicroServiceRequest(service, http.MethodDelete, "/rest/rufs_group?id=1", loginResponse.JwtHeader, "")
+
+	query := func(uri string, token string) ([]*RufsAuditLog, Response) {
+		resp := fileMicroServiceRequest(service, http.MethodGet, uri, token, "")
+		list := []*RufsAuditLog{}
+		json.Unmarshal(resp.Body, &list)
+		return list, resp
+	}
+
+	list, resp := query("/rest/audit_log?schemaName=rufsGroup&primaryKey[id]=1", loginResponse.JwtHeader)
+	actions := []string{}
+
+	for _, item := range list {
+		actions = append(actions, item.Action)
+	}
+
+	if resp.StatusCode != http.StatusOK || strings.Join(actions, ",") != "delete,update,create" || resp.Header.Get("X-Total-Count") != "3" {
+		t.Fatalf("[TestAuditLog] log of record : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	if list, resp = query("/rest/audit_log?schemaName=rufsGroup&limit=1&offset=1", loginResponse.JwtHeader); len(list) != 1 || list[0].Action != "update" || resp.Header.Get("X-Total-Count") != "4" {
+		t.Fatalf("[TestAuditLog] page : %s : %v", resp.Body, resp.Header)
+	}
+
+	from := url.QueryEscape(time.Now().Add(time.Minute).Format(time.RFC3339))
+
+	if list, resp = query("/rest/audit_log?schemaName=rufsGroup&from="+from, loginResponse.JwtHeader); resp.StatusCode != http.StatusOK || len(list) != 0 {
+		t.Fatalf("[TestAuditLog] log after from : %s", resp.Body)
+	}
+
+	user := fileMicroServiceLoginUser(t, service, loginResponse.JwtHeader, "erin", 1, `[{"path": "/rufs_group", "mask": 1}]`)
+
+	if _, resp = query("/rest/audit_log", user.JwtHeader); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("[TestAuditLog] audit log of user not administrator : %d", resp.StatusCode)
+	}
+	// in database the primary key is filtered in the json column
+	params := []any{}
+
+	if sql := (&DbClientSql{}).buildConditions([]*RufsQueryCondition{{"primaryKey.id", "eq", 1}}, &params); len(sql) != 1 || sql[0] != "(primary_key ->> $1) = $2" || fmt.Sprint(params) != "[id 1]" {
+		t.Fatalf("[TestAuditLog] sql of nested field : %v : %v", sql, params)
+	}
+}
+
+// TestMigrationList check the order by version, the duplicated versions and the pairing of down files, without database.
+func TestMigrationList(t *testing.T) {
+	write := func(dir string, files map[string]string) {
+		for name, text := range files {
+			if err := os.WriteFile(dir+"/"+name, []byte(text), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	up := func(tx *sql.Tx) error { return nil }
+	service := &RufsMicroService{migrationPath: t.TempDir()}
+	write(service.migrationPath, map[string]string{"1.0.10-c.sql": "select 10", "1.0.2-b.sql": "select 2", "1.0.2-b.down.sql": "select -2"})
+	service.MigrationRegister(&RufsMigration{Version: "1.0.1", Name: "a", Up: up})
+	list, err := service.migrationList()
+	versions := []string{}
+
+	for _, migration := range list {
+		versions = append(versions, migration.Version)
+	}
+	// numeric order, not the order of names of files
+	if err != nil || strings.Join(versions, ",") != "1.0.1,1.0.2,1.0.10" {
+		t.Fatalf("[TestMigrationList] unexpected order : %v : %s", versions, err)
+	}
+
+	if list[1].Down == nil || list[2].Down != nil || list[0].Down != nil {
+		t.Fatal("[TestMigrationList] down file paired with the wrong migration")
+	}
+
+	if list[0].checksum == "" || list[0].checksum == list[1].checksum {
+		t.Fatalf("[TestMigrationList] missing checksum of Go migration : %v", list[0].checksum)
+	}
+	// the migrations of rufs tables never collide with the versions of application
+	for _, migration := range rufsMigrations {
+		if _, err := migrationVersion(migration.Version); err == nil || migration.checksum == "" {
+			t.Fatalf("[TestMigrationList] invalid rufs migration %s", migration.Version)
+		}
+	}
+
+	for name, files := range map[string]map[string]string{
+		"file and Go":     {"1.0.1-x.sql": "select 1"},
+		"two files":       {"1.0.3-x.sql": "select 3", "1.0.3-y.sql": "select 3"},
+		"down without up": {"1.0.4-x.down.sql": "select -4"},
+	} {
+		service := &RufsMicroService{migrationPath: t.TempDir()}
+		write(service.migrationPath, files)
+		service.MigrationRegister(&RufsMigration{Version: "1.0.1", Name: "a", Up: up})
+
+		if _, err := service.migrationList(); err == nil {
+			t.Fatalf("[TestMigrationList] accepted %s", name)
+		}
+	}
+}
+
+// TestSeed check the refuse of weak credentials of administrator in production, only when they would be inserted.
+func TestSeed(t *testing.T) {
+	service := fileMicroService(t)
+	t.Setenv("RUFS_ENV", "production")
+
+	if err := service.seed(); err != nil {
+		t.Fatalf("[TestSeed] existent administrator must keep its password : %s", err)
+	}
+
+	t.Setenv("RUFS_ADMIN_USER", "root")
+	t.Setenv("RUFS_ADMIN_PASSWORD", "root")
+
+	if err := service.seed(); err == nil {
+		t.Fatal("[TestSeed] insertion of weak credentials must be refused in production")
+	}
+
+	// the md5 of the short password has 32 characters, but the typed one is checked
+	t.Setenv("RUFS_ADMIN_PASSWORD", "Xq7#kz")
+
+	if err := service.seed(); err == nil {
+		t.Fatal("[TestSeed] insertion of short password must be refused in production")
+	}
+
+	t.Setenv("RUFS_ADMIN_PASSWORD", "c0rrect-h0rse-battery")
+
+	if err := service.seed(); err != nil {
+		t.Fatalf("[TestSeed] insertion of strong credentials : %s", err)
+	}
+
+	if list, _ := service.getEntityManager("rufsUser").Find("rufsUser", map[string]any{"name": "root"}, []string{}); len(list) != 1 || !passwordIsHash(fmt.Sprint(list[0]["password"])) {
+		t.Fatalf("[TestSeed] missing administrator root : %v", list)
+	}
+}
+
+// TestPassword change the password, reset it by one token of administrator and check the policy in the CRUD of rufsUser.
+func TestPassword(t *testing.T) {
+	service, loginResponse := fileMicroServiceLogin(t)
+	user := fileMicroServiceLoginUser(t, service, loginResponse.JwtHeader, "erin", 1, `[{"path": "/rufs_group", "mask": 1}]`)
+	password := fmt.Sprintf("%x", md5.Sum([]byte("erin-secret")))
+	newPassword := fmt.Sprintf("%x", md5.Sum([]byte("erin-new-secret")))
+
+	login := func(password string) int {
+		return fileMicroServiceRequest(service, http.MethodPost, "/rest/login", "", `{"user": "erin", "password": "`+password+`"}`).StatusCode
+	}
+
+	if resp := fileMicroServiceRequest(service, http.MethodPost, "/rest/change_password", user.JwtHeader, `{"password": "`+password+`", "newPassword": "123456"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("[TestPassword] weak new password must be refused : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	if resp := fileMicroServiceRequest(service, http.MethodPost, "/rest/change_password", user.JwtHeader, `{"password": "`+password+`", "newPassword": "`+newPassword+`"}`); resp.StatusCode != http.StatusOK || login(newPassword) != http.StatusOK || login(password) == http.StatusOK {
+		t.Fatalf("[TestPassword] change password : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	resp := fileMicroServiceRequest(service, http.MethodPost, "/rest/password_reset", user.JwtHeader, fmt.Sprintf(`{"rufsUser": %d}`, user.Id))
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("[TestPassword] reset by user not administrator : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	reset := map[string]any{}
+	resp = fileMicroServiceRequest(service, http.MethodPost, "/rest/password_reset", loginResponse.JwtHeader, fmt.Sprintf(`{"rufsUser": %d}`, user.Id))
+	json.Unmarshal(resp.Body, &reset)
+
+	if resp.StatusCode != http.StatusOK || reset["token"] == nil {
+		t.Fatalf("[TestPassword] reset : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	// the hash of password would skip the policy, and the refused password don't consume the token
+	hash, _ := PasswordHash("123456")
+
+	if resp := fileMicroServiceRequest(service, http.MethodPost, "/rest/password_reset_confirm", "", `{"token": "`+fmt.Sprint(reset["token"])+`", "newPassword": "`+hash+`"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("[TestPassword] hash in the confirm of reset must be refused : %d : %s", resp.StatusCode, resp.Body)
+	}
+	// only one of the concurrent confirms use the token
+	confirm := `{"token": "` + fmt.Sprint(reset["token"]) + `", "newPassword": "` + password + `"}`
+	statusCodes := make(chan int, 8)
+	var wg sync.WaitGroup
+
+	for i := 0; i < cap(statusCodes); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			statusCodes <- fileMicroServiceRequest(service, http.MethodPost, "/rest/password_reset_confirm", "", confirm).StatusCode
+		}()
+	}
+
+	wg.Wait()
+	close(statusCodes)
+	accepted := 0
+
+	for statusCode := range statusCodes {
+		if statusCode == http.StatusOK {
+			accepted++
+		} else if statusCode != http.StatusUnauthorized {
+			t.Fatalf("[TestPassword] concurrent confirm of reset : %d", statusCode)
+		}
+	}
+
+	if accepted != 1 {
+		t.Fatalf("[TestPassword] the token of reset must be used once, used %d times", accepted)
+	}
+
+	if login(password) != http.StatusOK {
+		t.Fatal("[TestPassword] login with the password of reset")
+	}
+	// the CRUD refuse hashes, that skip the policy, and check the name of partial updates
+	if resp := fileMicroServiceRequest(service, http.MethodPut, fmt.Sprintf("/rest/rufs_user?id=%d", user.Id), loginResponse.JwtHeader, `{"password": "`+hash+`"}`); !strings.Contains(string(resp.Body), "not its hash") {
+		t.Fatalf("[TestPassword] hash in the CRUD must be refused : %s", resp.Body)
+	}
+
+	if resp := fileMicroServiceRequest(service, http.MethodPatch, fmt.Sprintf("/rest/rufs_user?id=%d", user.Id), loginResponse.JwtHeader, `{"id": `+fmt.Sprint(user.Id)+`, "password": "`+fmt.Sprintf("%x", md5.Sum([]byte("erin")))+`"}`); !strings.Contains(string(resp.Body), "user name") {
+		t.Fatalf("[TestPassword] password equal to name must be refused in partial updates : %s", resp.Body)
+	}
+}
+
+// TestBasicAuth check the cache of http basic credentials, the lockout after wrong passwords and the refuse of empty passwords.
+func TestBasicAuth(t *testing.T) {
+	service, adminLogin := fileMicroServiceLogin(t)
+	operationObject := service.openapi.Paths["/rufs_group"]["get"]
+	operationObject.Security = append(operationObject.Security, SecurityRequirementObject{"basic": {}})
+	userLogin := fileMicroServiceLoginUser(t, service, adminLogin.JwtHeader, "ivan", 1, `[{"path": "/rufs_group", "mask": 1}]`)
+	password := fmt.Sprintf("%x", md5.Sum([]byte("ivan-secret")))
+
+	request := func(password string) Response {
+		req := httptest.NewRequest(http.MethodGet, "/rest/rufs_group", nil)
+		req.SetBasicAuth("ivan", password)
+		return service.OnRequest(req)
+	}
+
+	if resp := request(password); resp.StatusCode != http.StatusOK || service.basicAuthCache.get("ivan", password) == nil {
+		t.Fatalf("[TestBasicAuth] basic authentication : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	if service.basicAuthCache.get("ivan", "wrong") != nil {
+		t.Fatal("[TestBasicAuth] cache accepted other password")
+	}
+	// the lockout refuse also the credentials in cache
+	for i := 0; i < 5; i++ {
+		if resp := request("wrong"); resp.StatusCode == http.StatusOK {
+			t.Fatalf("[TestBasicAuth] wrong password accepted : %s", resp.Body)
+		}
+	}
+
+	if resp := request(password); resp.StatusCode == http.StatusOK || !strings.Contains(string(resp.Body), "locked") {
+		t.Fatalf("[TestBasicAuth] locked user accepted : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	service.loginLockout.registerSuccess("ivan")
+	// the change of password forget the credentials in cache
+	if resp := fileMicroServiceRequest(service, http.MethodPatch, "/rest/rufs_user", adminLogin.JwtHeader, fmt.Sprintf(`{"id": %d, "password": "ivan-new-secret"}`, userLogin.Id)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("[TestBasicAuth] change of password : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	if resp := request(password); resp.StatusCode == http.StatusOK {
+		t.Fatalf("[TestBasicAuth] old password accepted from cache : %s", resp.Body)
+	}
+	// users with empty stored password can't login
+	service.loginLockout.registerSuccess("ivan")
+	service.getEntityManager("rufsUser").Update("rufsUser", map[string]any{"id": userLogin.Id}, map[string]any{"password": ""})
+
+	if resp := request(""); resp.StatusCode == http.StatusOK {
+		t.Fatalf("[TestBasicAuth] empty password accepted : %s", resp.Body)
+	}
+}
+
+// TestRoles check the precedence of roles : rufsUser over the groups (joined by bitwise or) over rufsGroupOwner.
+func TestRoles(t *testing.T) {
+	service, adminLogin := fileMicroServiceLogin(t)
+	groupOwner, _ := service.getEntityManager("rufsGroupOwner").Insert("rufsGroupOwner", map[string]any{"name": "acme", "roles": []Role{{Path: "/rufs_user", Mask: 1}, {Path: "/rufs_group", Mask: 1}, {Path: "/rufs_group_user", Mask: 1}}})
+	group1, _ := service.getEntityManager("rufsGroup").Insert("rufsGroup", map[string]any{"name": "g1", "roles": []Role{{Path: "/rufs_group", Mask: 2}}})
+	group2, _ := service.getEntityManager("rufsGroup").Insert("rufsGroup", map[string]any{"name": "g2", "roles": []Role{{Path: "/rufs_group", Mask: 4}, {Path: "/rufs_group_user", Mask: 16}}})
+	userLogin := fileMicroServiceLoginUser(t, service, adminLogin.JwtHeader, "judy", UtilsToInt(groupOwner["id"]), `[{"path": "/rufs_group_user", "mask": 8}]`)
+
+	for _, group := range []map[string]any{group1, group2} {
+		service.getEntityManager("rufsGroupUser").Insert("rufsGroupUser", map[string]any{"rufsUser": userLogin.Id, "rufsGroup": group["id"]})
+	}
+
+	resp := fileMicroServiceRequest(service, http.MethodGet, fmt.Sprintf("/rest/effective_roles?rufsUser=%d", userLogin.Id), adminLogin.JwtHeader, "")
+	rolesInherited := &RolesInherited{}
+	json.Unmarshal(resp.Body, rolesInherited)
+	expected := map[string]int{"/rufs_user": 1, "/rufs_group": 6, "/rufs_group_user": 8}
+
+	if resp.StatusCode != http.StatusOK || len(rolesInherited.Roles) != len(expected) {
+		t.Fatalf("[TestRoles] effective roles : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	for _, role := range rolesInherited.Roles {
+		if expected[role.Path] != role.Mask {
+			t.Fatalf("[TestRoles] mask of %s is %d, expected %d : %s", role.Path, role.Mask, expected[role.Path], resp.Body)
+		}
+	}
+	// the login use the same roles
+	resp = fileMicroServiceRequest(service, http.MethodPost, "/rest/login", "", fmt.Sprintf(`{"user": "judy", "password": "%x"}`, md5.Sum([]byte("judy-secret"))))
+	json.Unmarshal(resp.Body, userLogin)
+
+	for path, mask := range expected {
+		if idx := slices.IndexFunc(userLogin.Roles, func(e Role) bool { return e.Path == path }); idx < 0 || userLogin.Roles[idx].Mask != mask {
+			t.Fatalf("[TestRoles] login without mask %d of %s : %s", mask, path, resp.Body)
+		}
+	}
+}
+
+func TestPatch(t *testing.T) {
+	service, loginResponse := fileMicroServiceLogin(t)
+	resp := fileMicroServiceRequest(service, http.MethodPatch, "/rest/rufs_group", loginResponse.JwtHeader, `{"name": "sales"}`)
+	group := map[string]any{}
+	json.Unmarshal(resp.Body, &group)
+
+	if resp.StatusCode != http.StatusOK || group["id"] == nil {
+		t.Fatalf("[TestPatch] patch of missing row must create it : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	resp = fileMicroServiceRequest(service, http.MethodPatch, "/rest/rufs_group", loginResponse.JwtHeader, fmt.Sprintf(`{"id": %d, "name": "marketing"}`, UtilsToInt(group["id"])))
+	list := []map[string]any{}
+	json.Unmarshal(fileMicroServiceRequest(service, http.MethodGet, "/rest/rufs_group", loginResponse.JwtHeader, "").Body, &list)
+
+	if resp.StatusCode != http.StatusOK || len(list) != 1 || list[0]["name"] != "marketing" {
+		t.Fatalf("[TestPatch] patch of existent row must update it : %d : %v", resp.StatusCode, list)
+	}
+
+	partialRequest := func(method string, contentType string, body string) Response {
+		req := httptest.NewRequest(method, fmt.Sprintf("/rest/rufs_group?id=%d", UtilsToInt(group["id"])), strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+loginResponse.JwtHeader)
+		req.Header.Set("Content-Type", contentType)
+		return service.OnRequest(req)
+	}
+
+	resp = partialRequest(http.MethodPatch, ContentTypeJsonPatch, `[{"op": "test", "path": "/name", "value": "marketing"}, {"op": "add", "path": "/roles", "value": [{"path": "/rufs_user", "mask": 1}]}]`)
+	group = map[string]any{}
+	json.Unmarshal(resp.Body, &group)
+
+	if roles, _ := group["roles"].([]any); resp.StatusCode != http.StatusOK || group["name"] != "marketing" || len(roles) != 1 {
+		t.Fatalf("[TestPatch] json patch must change only roles : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	resp = partialRequest(http.MethodPut, ContentTypeMergePatch, `{"roles": null}`)
+	group = map[string]any{}
+	json.Unmarshal(resp.Body, &group)
+
+	if resp.StatusCode != http.StatusOK || group["name"] != "marketing" || group["roles"] != nil {
+		t.Fatalf("[TestPatch] merge patch must remove only roles : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	if resp = partialRequest(http.MethodPut, ContentTypeMergePatch, `{"name": 1}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("[TestPatch] merge patch with invalid type must be refused : %d : %s", resp.StatusCode, resp.Body)
+	}
+	// without primary key the row is located by the unique keys
+	service.openapi.Components.Schemas["rufsUser"].UniqueKeys = map[string][]string{"name": {"name"}}
+	resp = fileMicroServiceRequest(service, http.MethodPatch, "/rest/rufs_user", loginResponse.JwtHeader, `{"name": "admin", "path": "rufs_group/search"}`)
+	user := map[string]any{}
+	json.Unmarshal(resp.Body, &user)
+
+	if resp.StatusCode != http.StatusOK || UtilsToInt(user["id"]) != 1 || user["path"] != "rufs_group/search" {
+		t.Fatalf("[TestPatch] patch by unique key must update the existent row : %d : %s", resp.StatusCode, resp.Body)
+	}
+	// the unique key of row of other rufsGroupOwner is missing for the user, then one new row is created in its rufsGroupOwner
+	fileMicroServiceRequest(service, http.MethodPost, "/rest/rufs_group_owner", loginResponse.JwtHeader, `{"name": "acme"}`)
+	carol := fileMicroServiceLoginUser(t, service, loginResponse.JwtHeader, "carol", 2, `[{"path": "/rufs_user", "mask": 31}]`)
+	resp = fileMicroServiceRequest(service, http.MethodPatch, "/rest/rufs_user", carol.JwtHeader, `{"name": "admin", "password": "0c1bd2c3cf4d3bd6a7b2ab9c6b7e3a3e", "path": "hacked"}`)
+	user = map[string]any{}
+	json.Unmarshal(resp.Body, &user)
+	admin, _ := service.getEntityManager("rufsUser").FindOne("rufsUser", map[string]any{"id": 1})
+
+	if resp.StatusCode != http.StatusOK || admin["path"] != "rufs_group/search" || UtilsToInt(user["id"]) == 1 || UtilsToInt(user["rufsGroupOwner"]) != 2 {
+		t.Fatalf("[TestPatch] patch by unique key must not reach rows of other rufsGroupOwner : %d : %s", resp.StatusCode, resp.Body)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	service, loginResponse := fileMicroServiceLogin(t)
+	resp := fileMicroServiceRequest(service, http.MethodPost, "/rest/batch", loginResponse.JwtHeader, `[{"id": "group", "method": "POST", "path": "/rest/rufs_group", "body": {"name": "sales"}}, {"method": "POST", "path": "/rest/rufs_group_user", "body": {"rufsUser": 1, "rufsGroup": "${group.id}"}}]`)
+	results := []*RufsBatchResult{}
+	json.Unmarshal(resp.Body, &results)
+	groupUser := map[string]any{}
+
+	if len(results) == 2 {
+		json.Unmarshal(results[1].Body, &groupUser)
+	}
+
+	if resp.StatusCode != http.StatusOK || groupUser["rufsGroup"] == nil || UtilsToInt(groupUser["rufsGroup"]) == 0 {
+		t.Fatalf("[TestBatch] batch must create the group and reference its id : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	resp = fileMicroServiceRequest(service, http.MethodPost, "/rest/batch", loginResponse.JwtHeader, `[{"method": "POST", "path": "/rest/rufs_group", "body": {"name": "marketing"}}, {"method": "PUT", "path": "/rest/rufs_group?id=999", "body": {"name": "none"}}]`)
+	list := []map[string]any{}
+	json.Unmarshal(fileMicroServiceRequest(service, http.MethodGet, "/rest/rufs_group", loginResponse.JwtHeader, "").Body, &list)
+
+	if resp.StatusCode == http.StatusOK || len(list) != 1 {
+		t.Fatalf("[TestBatch] failed batch must undo the previous operations : %d : %v", resp.StatusCode, list)
+	}
+	// each operation is authorized with the roles of the user
+	user := fileMicroServiceLoginUser(t, service, loginResponse.JwtHeader, "erin", 1, `[{"path": "/rufs_group", "mask": 1}]`)
+	resp = fileMicroServiceRequest(service, http.MethodPost, "/rest/batch", user.JwtHeader, `[{"method": "POST", "path": "/rest/rufs_group", "body": {"name": "support"}}]`)
+	json.Unmarshal(fileMicroServiceRequest(service, http.MethodGet, "/rest/rufs_group", loginResponse.JwtHeader, "").Body, &list)
+
+	if resp.StatusCode == http.StatusOK || len(list) != 1 {
+		t.Fatalf("[TestBatch] batch of user without write role must be refused : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	if resp := fileMicroServiceRequest(service, http.MethodPost, "/rest/batch", user.JwtHeader, `[{"method": "GET", "path": "/rest/rufs_user"}]`); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("[TestBatch] batch with path out of the roles of user must return 401 : %d : %s", resp.StatusCode, resp.Body)
+	}
+	// the undo of one batch restore only the tables written by it, keeping the concurrent writes in the other ones
+	batch := &rufsBatch{tokenPayload: &loginResponse.TokenPayload, transactions: map[*DbClientSql]*DbClientSql{}, restores: map[*FileDbAdapter]map[string]func() error{}}
+	batch.entityManager(service.getEntityManager("rufsGroup"), "rufsGroup")
+	service.getEntityManager("rufsGroup").Insert("rufsGroup", map[string]any{"name": "marketing"})
+	service.getEntityManager("rufsUser").Update("rufsUser", map[string]any{"id": user.Id}, map[string]any{"path": "rufs_group/search"})
+	batch.rollback()
+
+	if list, _ := service.getEntityManager("rufsGroup").Find("rufsGroup", map[string]any{"name": "marketing"}, []string{}); len(list) != 0 {
+		t.Fatalf("[TestBatch] the write of batch must be undone : %v", list)
+	}
+
+	if obj, _ := service.getEntityManager("rufsUser").FindOne("rufsUser", map[string]any{"id": user.Id}); obj == nil || obj["path"] != "rufs_group/search" {
+		t.Fatalf("[TestBatch] the concurrent write in other table must be kept : %v", obj)
+	}
+}
+
+func TestETag(t *testing.T) {
+	service, loginResponse := fileMicroServiceLogin(t)
+	fileMicroServiceRequest(service, http.MethodPost, "/rest/rufs_group", loginResponse.JwtHeader, `{"name": "sales"}`)
+	version := fileMicroServiceRequest(service, http.MethodGet, "/rest/rufs_group?id=1", loginResponse.JwtHeader, "").Header.Get("ETag")
+
+	ifMatchRequest := func(ifMatch string, body string) Response {
+		req := httptest.NewRequest(http.MethodPut, "/rest/rufs_group?id=1", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+loginResponse.JwtHeader)
+		req.Header.Set("If-Match", ifMatch)
+		return service.OnRequest(req)
+	}
+
+	resp := ifMatchRequest(version, `{"name": "marketing"}`)
+
+	if resp.StatusCode != http.StatusOK || version == "" || resp.Header.Get("ETag") == version {
+		t.Fatalf("[TestETag] update with current version must return the new version : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	if resp = ifMatchRequest(version, `{"name": "support"}`); resp.StatusCode != http.StatusPreconditionFailed || !strings.Contains(string(resp.Body), "marketing") {
+		t.Fatalf("[TestETag] update with old version must return 412 with the current row : %d : %s", resp.StatusCode, resp.Body)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	service, loginResponse := fileMicroServiceLogin(t)
+
+	for _, name := range []string{"sales", "support", "marketing", "services"} {
+		fileMicroServiceRequest(service, http.MethodPost, "/rest/rufs_group", loginResponse.JwtHeader, fmt.Sprintf(`{"name": "%s"}`, name))
+	}
+
+	query := func(uri string) ([]map[string]any, Response) {
+		resp := fileMicroServiceRequest(service, http.MethodGet, uri, loginResponse.JwtHeader, "")
+		list := []map[string]any{}
+		json.Unmarshal(resp.Body, &list)
+		return list, resp
+	}
+
+	list, resp := query("/rest/rufs_group?name[like]=s%25&sort=name&limit=1")
+
+	if len(list) != 1 || list[0]["name"] != "sales" || resp.Header.Get("X-Total-Count") != "3" {
+		t.Fatalf("[TestQuery] unexpected first page : %s : %v", resp.Body, resp.Header)
+	}
+
+	next := regexp.MustCompile(`<([^>]+)>; rel="next"`).FindStringSubmatch(resp.Header.Get("Link"))
+
+	if next == nil {
+		t.Fatalf("[TestQuery] missing link to next page : %v", resp.Header)
+	}
+
+	if list, resp = query(next[1]); len(list) != 1 || list[0]["name"] != "services" {
+		t.Fatalf("[TestQuery] unexpected next page : %s", resp.Body)
+	}
+
+	if _, resp = query("/rest/rufs_group?name[unknown]=sales"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("[TestQuery] unknown operator must return 400 : %d", resp.StatusCode)
+	}
+	// the fields that the user can't read can't be used in conditions, sort or cursor
+	service.openapi.Components.Schemas["rufsUser"].Properties["path"].ReadMask = 64
+	user := fileMicroServiceLoginUser(t, service, loginResponse.JwtHeader, "erin", 1, `[{"path": "/rufs_user", "mask": 33}]`)
+
+	for _, uri := range []string{"/rest/rufs_user?password[like]=$2a%25", "/rest/rufs_user?sort=password&limit=1", "/rest/rufs_user?path=rufs_user/search", "/rest/rufs_user?filter[path]=rufs_user/search", "/rest/rufs_user?sort=-path"} {
+		if resp := fileMicroServiceRequest(service, http.MethodGet, uri, user.JwtHeader, ""); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("[TestQuery] %s must return 400 : %d : %s : %v", uri, resp.StatusCode, resp.Body, resp.Header)
+		}
+	}
+
+	if resp := fileMicroServiceRequest(service, http.MethodGet, "/rest/rufs_user?name=admin", user.JwtHeader, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("[TestQuery] query by readable field : %d : %s", resp.StatusCode, resp.Body)
+	}
+}
+
+// TestQueryCursorNull page by cursor with one sort field with nulls, that must not lose rows.
+func TestQueryCursorNull(t *testing.T) {
+	schema := &Schema{Properties: map[string]*Schema{"id": {Type: "integer"}, "level": {Type: "integer"}}}
+	list := []map[string]any{{"id": 1, "level": 2}, {"id": 2, "level": nil}, {"id": 3, "level": 1}, {"id": 4, "level": nil}, {"id": 5, "level": 2}}
+	expected := map[string][]int{"level": {3, 1, 5, 2, 4}, "-level": {2, 4, 1, 5, 3}}
+
+	for sortField, ids := range expected {
+		query := &RufsQuery{Sort: []string{sortField, "id"}, Limit: 1}
+		pages := []int{}
+
+		for {
+			page, _ := queryApply(list, query)
+
+			if len(page) == 0 {
+				break
+			}
+
+			pages = append(pages, UtilsToInt(page[0]["id"]))
+			var err error
+
+			if query.Cursor, err = queryCursorDecode(schema, queryCursorEncode(page[0], query.Sort), query.Sort); err != nil || len(pages) > len(list) {
+				t.Fatalf("[TestQueryCursorNull] %s : %v : %v", sortField, err, pages)
+			}
+		}
+
+		if !slices.Equal(pages, ids) {
+			t.Fatalf("[TestQueryCursorNull] pages of sort %s : %v", sortField, pages)
+		}
+	}
+}
+
+func TestFields(t *testing.T) {
+	service, loginResponse := fileMicroServiceLogin(t)
+	resp := fileMicroServiceRequest(service, http.MethodGet, "/rest/rufs_user?name=admin&fields=name,roles.mask", loginResponse.JwtHeader, "")
+	list := []map[string]any{}
+	json.Unmarshal(resp.Body, &list)
+
+	if len(list) != 1 || len(list[0]) != 2 || list[0]["name"] != "admin" {
+		t.Fatalf("[TestFields] unexpected projection : %s", resp.Body)
+	}
+
+	if roles, ok := list[0]["roles"].([]any); !ok || len(roles) == 0 || len(roles[0].(map[string]any)) != 1 {
+		t.Fatalf("[TestFields] unexpected projection of nested fields : %s", resp.Body)
+	}
+
+	if resp = fileMicroServiceRequest(service, http.MethodGet, "/rest/rufs_user?fields=name,unknown", loginResponse.JwtHeader, ""); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("[TestFields] unknown field must return 400 : %d", resp.StatusCode)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	service, loginResponse := fileMicroServiceLogin(t)
+	resp := fileMicroServiceRequest(service, http.MethodGet, "/rest/rufs_user?name=admin&expand=rufsGroupOwner.rufsUser", loginResponse.JwtHeader, "")
+	list := []map[string]any{}
+	json.Unmarshal(resp.Body, &list)
+
+	if len(list) != 1 {
+		t.Fatalf("[TestExpand] unexpected response : %s", resp.Body)
+	}
+
+	rufsGroupOwner, ok := list[0]["rufsGroupOwner"].(map[string]any)
+
+	if !ok || rufsGroupOwner["name"] != "admin" {
+		t.Fatalf("[TestExpand] missing one to one reference : %s", resp.Body)
+	}
+
+	if users, ok := rufsGroupOwner["rufsUser"].([]any); !ok || len(users) == 0 || users[0].(map[string]any)["password"] != nil {
+		t.Fatalf("[TestExpand] missing readable one to many dependents : %s", resp.Body)
+	}
+
+	if resp = fileMicroServiceRequest(service, http.MethodGet, "/rest/rufs_user?expand=rufsGroupOwner.rufsUser.rufsGroupOwner.rufsUser", loginResponse.JwtHeader, ""); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("[TestExpand] expand deeper than the limit must return 400 : %d", resp.StatusCode)
+	}
+	// without role in /rufs_group_owner, the explicit expand is refused and "*" ignore it
+	userLogin := fileMicroServiceLoginUser(t, service, loginResponse.JwtHeader, "heidi", 1, `[{"path": "/rufs_user", "mask": 1}]`)
+
+	if resp = fileMicroServiceRequest(service, http.MethodGet, "/rest/rufs_user?expand=rufsGroupOwner", userLogin.JwtHeader, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("[TestExpand] expand of schema without role must return 401 : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	resp = fileMicroServiceRequest(service, http.MethodGet, "/rest/rufs_user?name=heidi&expand=*", userLogin.JwtHeader, "")
+	list = []map[string]any{}
+	json.Unmarshal(resp.Body, &list)
+
+	if resp.StatusCode != http.StatusOK || len(list) != 1 || UtilsToInt(list[0]["rufsGroupOwner"]) != 1 {
+		t.Fatalf("[TestExpand] expand * must skip the schemas without role : %d : %s", resp.StatusCode, resp.Body)
+	}
+}
+
+// TestFieldMasks check that the masks of fields survive the reload of schemas from database and restrict reads and writes.
+func TestFieldMasks(t *testing.T) {
+	// the schema of database don't have masks, then the declared ones are kept
+	schemaOld := &Schema{Properties: map[string]*Schema{"roles": {Type: "array", ReadMask: 64, WriteMask: 128}, "name": {Type: "string"}}}
+	schema := &Schema{Properties: map[string]*Schema{"roles": {Type: "array"}, "name": {Type: "string", ReadMask: 32}}}
+	schemaKeepPermissions(schemaOld, schema)
+
+	if field := schema.Properties["roles"]; field.ReadMask != 64 || field.WriteMask != 128 {
+		t.Fatalf("[TestFieldMasks] masks lost in reload : %d : %d", field.ReadMask, field.WriteMask)
+	}
+
+	if field := schema.Properties["name"]; field.ReadMask != 32 {
+		t.Fatalf("[TestFieldMasks] zero mask override the new one : %d", field.ReadMask)
+	}
+
+	service, adminLogin := fileMicroServiceLogin(t)
+	service.openapi.Components.Schemas["rufsGroup"].Properties["roles"].ReadMask = 64
+	fileMicroServiceRequest(service, http.MethodPost, "/rest/rufs_group", adminLogin.JwtHeader, `{"name": "sales", "roles": [{"path": "/rufs_user", "mask": 1}]}`)
+	reader := fileMicroServiceLoginUser(t, service, adminLogin.JwtHeader, "kevin", 1, `[{"path": "/rufs_group", "mask": 31}]`)
+	manager := fileMicroServiceLoginUser(t, service, adminLogin.JwtHeader, "laura", 1, `[{"path": "/rufs_group", "mask": 223}]`)
+
+	for token, visible := range map[string]bool{reader.JwtHeader: false, manager.JwtHeader: true} {
+		list := []map[string]any{}
+		resp := fileMicroServiceRequest(service, http.MethodGet, "/rest/rufs_group?name=sales", token, "")
+		json.Unmarshal(resp.Body, &list)
+
+		if resp.StatusCode != http.StatusOK || len(list) != 1 {
+			t.Fatalf("[TestFieldMasks] query : %d : %s", resp.StatusCode, resp.Body)
+		}
+
+		if _, ok := list[0]["roles"]; ok != visible {
+			t.Fatalf("[TestFieldMasks] read of masked field : %d : %s", resp.StatusCode, resp.Body)
+		}
+	}
+
+	body := `{"id": 1, "name": "sales", "roles": [{"path": "/rufs_group", "mask": 1}]}`
+
+	if resp := fileMicroServiceRequest(service, http.MethodPut, "/rest/rufs_group?id=1", reader.JwtHeader, body); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("[TestFieldMasks] write of masked field without the mask : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	if resp := fileMicroServiceRequest(service, http.MethodPut, "/rest/rufs_group?id=1", manager.JwtHeader, body); resp.StatusCode != http.StatusOK {
+		t.Fatalf("[TestFieldMasks] write of masked field with the mask : %d : %s", resp.StatusCode, resp.Body)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	service, loginResponse := fileMicroServiceLogin(t)
+	resp := fileMicroServiceRequest(service, http.MethodPost, "/rest/rufs_user", loginResponse.JwtHeader, `{"name": "`+strings.Repeat("x", 33)+`", "rufsGroupOwner": "one", "roles": [{"path": "/rufs_user", "mask": "all"}], "color": "blue"}`)
+	result := struct{ Errors []*RufsFieldError }{}
+	json.Unmarshal(resp.Body, &result)
+	fields := []string{}
+
+	for _, item := range result.Errors {
+		fields = append(fields, item.Field)
+	}
+
+	if resp.StatusCode != http.StatusBadRequest || strings.Join(fields, ",") != "color,name,roles[0].mask,rufsGroupOwner" {
+		t.Fatalf("[TestValidation] unexpected response : %d : %s", resp.StatusCode, resp.Body)
+	}
+	// maxLength count characters, not bytes, and null is refused in fields without nullable
+	resp = fileMicroServiceRequest(service, http.MethodPost, "/rest/rufs_user", loginResponse.JwtHeader, `{"name": "`+strings.Repeat("ç", 32)+`", "rufsGroupOwner": 1, "password": "secret", "path": null}`)
+	result.Errors = nil
+	json.Unmarshal(resp.Body, &result)
+
+	if resp.StatusCode != http.StatusBadRequest || len(result.Errors) != 1 || result.Errors[0].Field != "path" {
+		t.Fatalf("[TestValidation] unexpected response of null : %d : %s", resp.StatusCode, resp.Body)
+	}
+}
+
+func TestResponseContract(t *testing.T) {
+	service, loginResponse := fileMicroServiceLogin(t)
+	fileMicroServiceRequest(service, http.MethodPost, "/rest/rufs_group", loginResponse.JwtHeader, `{"name": "sales"}`)
+
+	for _, uri := range []string{"/rest/rufs_user", "/rest/rufs_group", "/rest/rufs_group?id=1", "/rest/rufs_group_owner"} {
+		if resp := fileMicroServiceRequest(service, http.MethodGet, uri, loginResponse.JwtHeader, ""); resp.StatusCode != http.StatusOK {
+			t.Fatalf("[TestResponseContract] %s : %d : %s", uri, resp.StatusCode, resp.Body)
+		}
+	}
+	// one field outside of the contract
+	service.openapi.Components.Schemas["rufsGroup"].Properties["name"].Type = "integer"
+
+	if resp := fileMicroServiceRequest(service, http.MethodGet, "/rest/rufs_group", loginResponse.JwtHeader, ""); resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("[TestResponseContract] mismatch must fail : %d : %s", resp.StatusCode, resp.Body)
+	}
+}
+
+// TestTrash delete with soft delete, list the trash, restore and purge after the retention.
+func TestTrash(t *testing.T) {
+	service, loginResponse := fileMicroServiceLogin(t)
+	schema := service.openapi.Components.Schemas["rufsGroup"]
+	schema.Properties["deletedAt"] = &Schema{Type: "string", Format: "date-time", Nullable: true}
+	schema.Properties["deletedBy"] = &Schema{Type: "integer", Nullable: true}
+	token := loginResponse.JwtHeader
+	fileMicroServiceRequest(service, http.MethodPost, "/rest/rufs_group", token, `{"name": "sales"}`)
+
+	if resp := fileMicroServiceRequest(service, http.MethodPost, "/rest/rufs_group", token, `{"name": "hacked", "deletedAt": "2020-01-01T00:00:00Z"}`); resp.StatusCode == http.StatusOK {
+		t.Fatalf("[TestTrash] deletedAt must be read only : %s", resp.Body)
+	}
+
+	if resp := fileMicroServiceRequest(service, http.MethodDelete, "/rest/rufs_group?id=1", token, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("[TestTrash] delete : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	list := []map[string]any{}
+	json.Unmarshal(fileMicroServiceRequest(service, http.MethodGet, "/rest/rufs_group", token, "").Body, &list)
+	obj := map[string]any{}
+	json.Unmarshal(fileMicroServiceRequest(service, http.MethodGet, "/rest/rufs_group?id=1", token, "").Body, &obj)
+
+	if len(list) != 0 || len(obj) != 0 {
+		t.Fatalf("[TestTrash] deleted row visible : %v : %v", list, obj)
+	}
+
+	userLogin := fileMicroServiceLoginUser(t, service, token, "grace", 1, `[{"path": "/rufs_group", "mask": 31}]`)
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		if resp := fileMicroServiceRequest(service, method, "/rest/trash?schemaName=rufsGroup&id=1", userLogin.JwtHeader, ""); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("[TestTrash] trash %s by not administrator : %d : %s", method, resp.StatusCode, resp.Body)
+		}
+	}
+	// the rows in trash can't be updated, only restored
+	if resp := fileMicroServiceRequest(service, http.MethodPut, "/rest/rufs_group?id=1", token, `{"id": 1, "name": "sales 2"}`); resp.StatusCode == http.StatusOK {
+		t.Fatalf("[TestTrash] put of row in trash : %s", resp.Body)
+	}
+
+	if resp := fileMicroServiceRequest(service, http.MethodPatch, "/rest/rufs_group", token, `{"id": 1, "name": "sales 2"}`); resp.StatusCode == http.StatusOK {
+		t.Fatalf("[TestTrash] patch of row in trash : %s", resp.Body)
+	}
+
+	resp := fileMicroServiceRequest(service, http.MethodGet, "/rest/trash?schemaName=rufsGroup", token, "")
+	json.Unmarshal(resp.Body, &list)
+
+	if resp.StatusCode != http.StatusOK || len(list) != 1 || list[0]["deletedAt"] == nil || UtilsToInt(list[0]["deletedBy"]) != loginResponse.Id {
+		t.Fatalf("[TestTrash] trash : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	if resp := fileMicroServiceRequest(service, http.MethodPost, "/rest/trash?schemaName=rufsGroup&id=1", token, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("[TestTrash] restore : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	json.Unmarshal(fileMicroServiceRequest(service, http.MethodGet, "/rest/rufs_group", token, "").Body, &list)
+
+	if len(list) != 1 || list[0]["deletedAt"] != nil {
+		t.Fatalf("[TestTrash] restored row : %v", list)
+	}
+	// only the rows deleted before the retention are removed
+	fileMicroServiceRequest(service, http.MethodDelete, "/rest/rufs_group?id=1", token, "")
+	service.trashPurge(time.Now())
+
+	if item, _ := service.getEntityManager("rufsGroup").FindOne("rufsGroup", map[string]any{"id": 1}); item == nil {
+		t.Fatal("[TestTrash] purge before the retention")
+	}
+
+	// the purge run in background at same time of the requests
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		service.trashPurge(time.Now().Add(trashRetention() + time.Hour))
+	}()
+
+	for i := 0; i < 10; i++ {
+		fileMicroServiceRequest(service, http.MethodPost, "/rest/rufs_group", token, fmt.Sprintf(`{"name": "group %d"}`, i))
+		fileMicroServiceRequest(service, http.MethodGet, "/rest/rufs_group", token, "")
+	}
+
+	wg.Wait()
+	// the id of the purged row can be reused by the inserts
+	if item, _ := service.getEntityManager("rufsGroup").FindOne("rufsGroup", map[string]any{"name": "sales"}); item != nil {
+		t.Fatalf("[TestTrash] purge after the retention : %v", item)
+	}
+}
+
+// fileMicroServiceWs serve the websocket of service like MicroServiceServer.Listen and return its url.
+func fileMicroServiceWs(t *testing.T, service *RufsMicroService) string {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		connection, err := upgrader.Upgrade(res, req, nil)
+
+		if err != nil {
+			return
+		}
+
+		defer connection.Close()
+
+		for {
+			if _, message, err := connection.ReadMessage(); err == nil {
+				service.OnWsMessageFromClient(connection, string(message))
+			} else {
+				break
+			}
+		}
+
+		service.OnWsClose(connection)
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// TestSession check that revoked sessions are refused at once, also when checked before, and close their websockets.
+func TestSession(t *testing.T) {
+	service, loginResponse := fileMicroServiceLogin(t)
+	user := fileMicroServiceLoginUser(t, service, loginResponse.JwtHeader, "erin", 1, `[{"path": "/rufs_group", "mask": 1}]`)
+	connection, _, err := websocket.DefaultDialer.Dial(fileMicroServiceWs(t, service), nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer connection.Close()
+	connection.WriteMessage(websocket.TextMessage, []byte(user.JwtHeader))
+
+	for i := 0; i < 100 && len(service.wsSelect("", user.Id)) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if resp := fileMicroServiceRequest(service, http.MethodGet, "/rest/rufs_group", user.JwtHeader, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("[TestSession] request of valid session : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	if resp := fileMicroServiceRequest(service, http.MethodPost, "/rest/revoke_sessions", loginResponse.JwtHeader, fmt.Sprintf(`{"rufsUser": %d}`, user.Id)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("[TestSession] revoke : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	if resp := fileMicroServiceRequest(service, http.MethodGet, "/rest/rufs_group", user.JwtHeader, ""); resp.StatusCode == http.StatusOK {
+		t.Fatalf("[TestSession] request of revoked session : %d : %s", resp.StatusCode, resp.Body)
+	}
+
+	connection.SetReadDeadline(time.Now().Add(time.Second))
+
+	if _, _, err := connection.ReadMessage(); err == nil || len(service.wsSelect("", user.Id)) != 0 {
+		t.Fatal("[TestSession] the websocket of revoked session must be closed")
+	}
+	// revoked by other instance, seen after the ttl of cache
+	service.sessionCache.ttl = 50 * time.Millisecond
+	sessions, _ := service.sessionFind(map[string]any{"rufsUser": loginResponse.Id, "revoked": false})
+
+	for _, session := range sessions {
+		session.Revoked = true
+		service.sessionUpdate(session)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if resp := fileMicroServiceRequest(service, http.MethodGet, "/rest/rufs_group", loginResponse.JwtHeader, ""); resp.StatusCode == http.StatusOK {
+		t.Fatalf("[TestSession] request of session revoked in database : %d : %s", resp.StatusCode, resp.Body)
+	}
+	// only one of the concurrent uses of the refresh token receive the new tokens
+	json.Unmarshal(fileMicroServiceRequest(service, http.MethodPost, "/rest/login", "", `{"user": "admin", "password": "21232f297a57a5a743894a0e4a801fc3"}`).Body, loginResponse)
+	refreshToken := fileMicroServiceLoginUser(t, service, loginResponse.JwtHeader, "frank", 1, `[{"path": "/rufs_group", "mask": 1}]`).RefreshToken
+	refreshed := make(chan bool, 8)
+	var wg sync.WaitGroup
+
+	for i := 0; i < cap(refreshed); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			_, err := service.sessionRefresh(refreshToken, "")
+			refreshed <- err == nil
+		}()
+	}
+
+	wg.Wait()
+	close(refreshed)
+	accepted := 0
+
+	for ok := range refreshed {
+		if ok {
+			accepted++
+		}
+	}
+
+	if accepted != 1 {
+		t.Fatalf("[TestSession] the refresh token must be used once, used %d times", accepted)
+	}
+	// the expired sessions are removed
+	expiresAt := time.Now().Add(-service.tokenExpiration - time.Minute)
+	service.getEntityManager("rufsSession").Insert("rufsSession", map[string]any{"token": "expired", "rufsUser": user.Id, "refreshToken": "", "ip": "", "createdAt": expiresAt.Add(-time.Hour), "expiresAt": expiresAt, "revoked": false})
+
+	if err := service.sessionPurge(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if sessions, _ := service.sessionFind(map[string]any{"token": "expired"}); len(sessions) != 0 {
+		t.Fatalf("[TestSession] expired session must be removed : %v", sessions)
+	}
+
+	if sessions, _ := service.sessionFind(map[string]any{"rufsUser": user.Id}); len(sessions) == 0 {
+		t.Fatal("[TestSession] the sessions not expired must be kept")
+	}
+}
+
+// TestWsConcurrency connect and disconnect websocket clients while notifications and messages of administrators are
+// sent to them, to be run also with -race.
+func TestWsConcurrency(t *testing.T) {
+	service, loginResponse := fileMicroServiceLogin(t)
+	wsUrl := fileMicroServiceWs(t, service)
+	tokens := []string{}
+
+	for i := 0; i < 8; i++ {
+		login := &LoginResponse{}
+		json.Unmarshal(fileMicroServiceRequest(service, http.MethodPost, "/rest/login", "", `{"user": "admin", "password": "21232f297a57a5a743894a0e4a801fc3"}`).Body, login)
+		tokens = append(tokens, login.JwtHeader)
+	}
+
+	rf := &RequestFilter{microService: service, schemaName: "rufsGroup", path: "/rufs_group"}
+	var wg sync.WaitGroup
+
+	for i, token := range tokens {
+		wg.Add(3)
+
+		go func(token string) {
+			defer wg.Done()
+			connection, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			defer connection.Close()
+			connection.WriteMessage(websocket.TextMessage, []byte(token))
+			time.Sleep(20 * time.Millisecond)
+		}(token)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 10; j++ {
+				(&RequestFilter{microService: rf.microService, schemaName: rf.schemaName, path: rf.path}).notify(map[string]any{"id": i*10 + j, "name": "sales"}, false)
+				time.Sleep(time.Millisecond)
+			}
+		}(i)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 10; j++ {
+				fileMicroServiceRequest(service, http.MethodPost, "/rest/active_sessions", loginResponse.JwtHeader, `{"message": "hello"}`)
+				fileMicroServiceRequest(service, http.MethodGet, "/rest/active_sessions", loginResponse.JwtHeader, "")
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+
+	wg.Wait()
+	resp := fileMicroServiceRequest(service, http.MethodDelete, "/rest/active_sessions?rufsUser=1", loginResponse.JwtHeader, "")
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("[TestWsConcurrency] disconnect : %d : %s", resp.StatusCode, resp.Body)
+	}
+}
+
 type SimulatorMicroService struct {
 	RufsMicroService
 }
@@ -174,14 +1657,16 @@ func (rms *SimulatorMicroService) LoadFileTables() error {
 	next(listNames, 0)
 	listPath := []string{"/condominium", "/condominium/{cnpj}", "/contact", "/unit", "/reading", "/invoice", "/receivable"}
 
-	if user, err := rms.fileDbAdapter.FindOne("rufsUser", map[string]any{"password": "9CC6D224E7DF4292BD510FD8279DAB35"}); err == nil && user == nil {
+	if apiKeys, err := rms.apiKeyFind(map[string]any{"keyHash": rufsSessionHash("9CC6D224E7DF4292BD510FD8279DAB35")}); err == nil && len(apiKeys) == 0 {
 		roles := []Role{}
 
 		for _, path := range listPath {
 			roles = append(roles, Role{Path: path, Mask: 0xff})
 		}
 
-		rms.fileDbAdapter.Insert("rufsUser", map[string]any{"password": "9CC6D224E7DF4292BD510FD8279DAB35", "roles": roles})
+		user, _ := rms.getEntityManager("rufsUser").Insert("rufsUser", map[string]any{"name": "simulator", "rufsGroupOwner": 1, "roles": roles})
+		apiKey := &RufsApiKey{RufsUser: UtilsToInt(user["id"]), Name: "simulator", Prefix: "9CC6D224", KeyHash: rufsSessionHash("9CC6D224E7DF4292BD510FD8279DAB35"), Roles: roles, CreatedAt: time.Now()}
+		rms.getEntityManager("rufsApiKey").Insert("rufsApiKey", apiKeyToMap(apiKey))
 	}
 
 	return nil
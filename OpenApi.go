@@ -3,6 +3,7 @@ package rufsBase
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -36,6 +37,7 @@ type ParameterObject struct {
 	In          string  `json:"in,omitempty"`
 	Description string  `json:"description,omitempty"`
 	Required    bool    `json:"required,omitempty"`
+	Style       string  `json:"style,omitempty"`
 	Schema      *Schema `json:"schema,omitempty"`
 }
 
@@ -69,6 +71,10 @@ type Schema struct {
 	Essential          bool                  `json:"x-required,omitempty"`
 	Title              string                `json:"x-title,omitempty"`
 	Hiden              bool                  `json:"x-hiden,omitempty"`
+	ReadOnly           bool                  `json:"readOnly,omitempty"`
+	WriteOnly          bool                  `json:"writeOnly,omitempty"`
+	ReadMask           int                   `json:"x-readMask,omitempty"`
+	WriteMask          int                   `json:"x-writeMask,omitempty"`
 	InternalName       string                `json:"x-internalName,omitempty"`
 	Default            string                `json:"default,omitempty"`
 	Enum               []any                 `json:"enum,omitempty"`
@@ -80,6 +86,7 @@ type Schema struct {
 	MaxLength          int                   `json:"maxLength,omitempty"`
 	Properties         map[string]*Schema    `json:"properties,omitempty"`
 	Items              *Schema               `json:"items,omitempty"`
+	Document           string                `json:"x-document,omitempty"`
 }
 
 type MediaTypeObject struct {
@@ -173,42 +180,198 @@ func OpenApiCreate(openapi *OpenApi, security string) {
 	}
 }
 
-func (source *OpenApi) copy(paths []string) *OpenApi {
-	dest := &OpenApi{}
-	/*
-		dest.openapi = source.openapi;
-		dest.info = source.info;
-		dest.servers = source.servers;
-		dest.components.securitySchemes = source.components.securitySchemes;
-		dest.security = source.security;
-		dest.tags = source.tags;
-
-		for (let [schemaName, role] of Object.entries(paths)) {
-			if (source.components.schemas[schemaName] != nil) dest.components.schemas[schemaName] = source.components.schemas[schemaName];
-			if (source.components.responses[schemaName] != nil) dest.components.responses[schemaName] = source.components.responses[schemaName];
-			if (source.components.parameters[schemaName] != nil) dest.components.parameters[schemaName] = source.components.parameters[schemaName];
-			if (source.components.requestBodies[schemaName] != nil) dest.components.requestBodies[schemaName] = source.components.requestBodies[schemaName];
-
-			const pathIn = source.paths["/"+schemaName];
-			if (pathIn == nil) continue;
-			const pathOut = dest.paths["/"+schemaName] = {};
-			// TODO : alterar UserController para não usar valores default
-			const defaultAccess = {get: true, post: false, patch: false, put: false, delete: false};
-
-			for (const [method, value] of Object.entries(defaultAccess)) {
-				if (role[method] == nil) role[method] = value;
+// copy return one document with only the operations allowed by roles, and the components referenced by them.
+// Schemas referenced by foreign keys are included to keep the document valid, but without its paths, and only with
+// the primary key when the user don't have role to read it. The properties that roles can't read (writeOnly or x-readMask
+// without the bits) are removed from the copies of the readable schemas.
+func (source *OpenApi) copy(roles []Role) *OpenApi {
+	dest := &OpenApi{Openapi: source.Openapi, Info: source.Info, Servers: source.Servers, Security: source.Security}
+	dest.Paths = map[string]PathItemObject{}
+	dest.Components.Schemas = map[string]*Schema{}
+	dest.Components.Parameters = map[string]*ParameterObject{}
+	dest.Components.RequestBodies = map[string]RequestBodyObject{}
+	dest.Components.Responses = map[string]ResponseObject{}
+	dest.Components.SecuritySchemes = source.Components.SecuritySchemes
+	readable := func(schemaName string) bool {
+		path := "/" + CamelToUnderscore(schemaName)
+
+		if _, ok := source.Paths[path]; !ok {
+			return true
+		}
+
+		idx := slices.IndexFunc(roles, func(role Role) bool { return role.Path == path })
+		return idx >= 0 && roleAllowMethod(roles[idx].Mask, "get")
+	}
+
+	tokenPayload := &TokenPayload{RufsUserProteced: RufsUserProteced{Roles: roles}}
+	// the shared schema of source is not changed
+	copyReadable := func(schemaName string, schema *Schema) *Schema {
+		path := "/" + CamelToUnderscore(schemaName)
+		ret := *schema
+		ret.Properties = map[string]*Schema{}
+		ret.Required = nil
+
+		for fieldName, property := range schema.Properties {
+			if fieldAllowed(tokenPayload, path, property, false) {
+				ret.Properties[fieldName] = property
 			}
+		}
 
-			for (let [method, value] of Object.entries(role)) {
-				if (value == true) pathOut[method] = pathIn[method];
+		for _, fieldName := range schema.Required {
+			if _, ok := ret.Properties[fieldName]; ok {
+				ret.Required = append(ret.Required, fieldName)
 			}
 		}
 
-		if (dest.components.responses.Error == nil) dest.components.responses.Error = source.components.responses.Error;
-	*/
+		return &ret
+	}
+
+	var copySchema func(schema *Schema)
+
+	copySchema = func(schema *Schema) {
+		if schema == nil {
+			return
+		}
+
+		if schema.Ref != "" {
+			schemaName := OpenApiGetSchemaName(schema.Ref)
+
+			if _, ok := dest.Components.Schemas[schemaName]; !ok {
+				if schemaRef, ok := source.Components.Schemas[schemaName]; ok && readable(schemaName) {
+					schemaReadable := copyReadable(schemaName, schemaRef)
+					dest.Components.Schemas[schemaName] = schemaReadable
+					copySchema(schemaReadable)
+				} else if ok {
+					primaryKey := &Schema{Type: schemaRef.Type, PrimaryKeys: schemaRef.PrimaryKeys, Properties: map[string]*Schema{}}
+
+					for _, fieldName := range schemaRef.PrimaryKeys {
+						if property, ok := schemaRef.Properties[fieldName]; ok {
+							primaryKey.Properties[fieldName] = property
+						}
+					}
+
+					dest.Components.Schemas[schemaName] = primaryKey
+				}
+			}
+		}
+
+		for _, property := range schema.Properties {
+			copySchema(property)
+		}
+
+		copySchema(schema.Items)
+	}
+
+	copyContent := func(content map[string]*MediaTypeObject) {
+		for _, mediaTypeObject := range content {
+			copySchema(mediaTypeObject.Schema)
+		}
+	}
+
+	for _, role := range roles {
+		pathItemObject, ok := source.Paths[role.Path]
+
+		if !ok {
+			continue
+		}
+
+		for method, operationObject := range pathItemObject {
+			if !roleAllowMethod(role.Mask, method) {
+				continue
+			}
+
+			if _, ok := dest.Paths[role.Path]; !ok {
+				dest.Paths[role.Path] = PathItemObject{}
+			}
+
+			dest.Paths[role.Path][method] = operationObject
+
+			for _, parameter := range operationObject.Parameters {
+				if parameter.Ref != "" {
+					name := OpenApiGetSchemaName(parameter.Ref)
+
+					if parameterObject, ok := source.Components.Parameters[name]; ok {
+						dest.Components.Parameters[name] = parameterObject
+						copySchema(parameterObject.Schema)
+					}
+				} else {
+					copySchema(parameter.Schema)
+				}
+			}
+
+			if operationObject.RequestBody != nil {
+				if operationObject.RequestBody.Ref != "" {
+					name := OpenApiGetSchemaName(operationObject.RequestBody.Ref)
+
+					if requestBodyObject, ok := source.Components.RequestBodies[name]; ok {
+						dest.Components.RequestBodies[name] = requestBodyObject
+						copyContent(requestBodyObject.Content)
+					}
+				} else {
+					copyContent(operationObject.RequestBody.Content)
+				}
+			}
+
+			for _, responseObject := range operationObject.Responses {
+				if responseObject.Ref != "" {
+					name := OpenApiGetSchemaName(responseObject.Ref)
+
+					if responseObjectRef, ok := source.Components.Responses[name]; ok {
+						dest.Components.Responses[name] = responseObjectRef
+						copyContent(responseObjectRef.Content)
+					}
+				} else {
+					copyContent(responseObject.Content)
+				}
+			}
+
+			for _, tag := range operationObject.Tags {
+				if idx := slices.IndexFunc(source.Tags, func(item TagObject) bool { return item.Name == tag }); idx >= 0 && slices.IndexFunc(dest.Tags, func(item TagObject) bool { return item.Name == tag }) < 0 {
+					dest.Tags = append(dest.Tags, source.Tags[idx])
+				}
+			}
+		}
+	}
+
+	if responseObject, ok := source.Components.Responses["Error"]; ok {
+		dest.Components.Responses["Error"] = responseObject
+	}
+
 	return dest
 }
 
+// schemaKeepPermissions copy to the schema read from database the permissions of fields declared in schemaOld, that
+// don't exist in database. The masks are copied only when declared (non zero).
+func schemaKeepPermissions(schemaOld *Schema, schemaNew *Schema) {
+	if schemaOld == nil || schemaNew == nil {
+		return
+	}
+
+	for fieldName, field := range schemaNew.Properties {
+		fieldOld, ok := schemaOld.Properties[fieldName]
+
+		if !ok || fieldOld == nil {
+			continue
+		}
+
+		if fieldOld.ReadOnly {
+			field.ReadOnly = true
+		}
+
+		if fieldOld.WriteOnly {
+			field.WriteOnly = true
+		}
+
+		if fieldOld.ReadMask != 0 {
+			field.ReadMask = fieldOld.ReadMask
+		}
+
+		if fieldOld.WriteMask != 0 {
+			field.WriteMask = fieldOld.WriteMask
+		}
+	}
+}
+
 /*
 func MergeSchemas(schemaOld *Schema, schemaNew *Schema, keepOld bool, schemaName string) *Schema {
 	mergeArrayString := func(oldArray []string, newArray []string) []string {
@@ -351,9 +514,22 @@ func MergeSchemas(schemaOld *Schema, schemaNew *Schema, keepOld bool, schemaName
 		if field.Hiden {
 			jsonBuilderValue.Hiden = field.Hiden
 		}
-		// if field.ReadOnly {
-		// 	jsonBuilderValue.ReadOnly = field.ReadOnly
-		// }
+		if field.ReadOnly {
+			jsonBuilderValue.ReadOnly = field.ReadOnly
+		}
+
+		if field.WriteOnly {
+			jsonBuilderValue.WriteOnly = field.WriteOnly
+		}
+
+		if field.ReadMask != 0 {
+			jsonBuilderValue.ReadMask = field.ReadMask
+		}
+
+		if field.WriteMask != 0 {
+			jsonBuilderValue.WriteMask = field.WriteMask
+		}
+
 		if field.Description != "" {
 			jsonBuilderValue.Description = field.Description
 		}
@@ -429,9 +605,22 @@ func MergeSchemas(schemaOld *Schema, schemaNew *Schema, keepOld bool, schemaName
 			// 	jsonBuilderValue.IsClonable = fieldOriginal.IsClonable
 			// }
 
-			// if fieldOriginal.ReadOnly {
-			// 	jsonBuilderValue.ReadOnly = fieldOriginal.ReadOnly
-			// }
+			if fieldOriginal.ReadOnly {
+				jsonBuilderValue.ReadOnly = fieldOriginal.ReadOnly
+			}
+			// the field permissions don't exists in database
+			if fieldOriginal.WriteOnly {
+				jsonBuilderValue.WriteOnly = fieldOriginal.WriteOnly
+			}
+
+			if fieldOriginal.ReadMask != 0 {
+				jsonBuilderValue.ReadMask = fieldOriginal.ReadMask
+			}
+
+			if fieldOriginal.WriteMask != 0 {
+				jsonBuilderValue.WriteMask = fieldOriginal.WriteMask
+			}
+
 			if fieldOriginal.Hiden == false {
 				jsonBuilderValue.Hiden = fieldOriginal.Hiden
 			}
@@ -696,7 +885,7 @@ func (openapi *OpenApi) copyValue(field *Schema, value any) (ret any, err error)
 	if dataType == "" || dataType == "string" {
 		switch value.(type) {
 		case string:
-			if len(value.(string)) > field.MaxLength {
+			if field.MaxLength > 0 && len(value.(string)) > field.MaxLength {
 				ret = value.(string)[:field.MaxLength]
 			} else {
 				ret = value
@@ -1236,6 +1425,19 @@ func (openapi *OpenApi) FillOpenApi(options FillOpenApiOptions) {
 	json.Unmarshal([]byte(`{"type": "object", "properties": {"code": {"type": "integer"}, "description": {"type": "string"}}, "required": ["code", "description"]}`), schemaError)
 
 	openapi.Components.Responses["Error"] = ResponseObject{Description: "Error response", Content: map[string]*MediaTypeObject{"application/json": {Schema: schemaError}}}
+	// add components/parameters of query of lists (see RufsQuery.go)
+	openapi.Components.Parameters["rufsQuerySort"] = &ParameterObject{Name: "sort", In: "query", Description: "fields separated by comma, with prefix '-' for descending", Schema: &Schema{Type: "string"}}
+	openapi.Components.Parameters["rufsQueryLimit"] = &ParameterObject{Name: "limit", In: "query", Description: "maximum of rows", Schema: &Schema{Type: "integer"}}
+	openapi.Components.Parameters["rufsQueryOffset"] = &ParameterObject{Name: "offset", In: "query", Description: "rows to skip", Schema: &Schema{Type: "integer"}}
+	openapi.Components.Parameters["rufsQueryCursor"] = &ParameterObject{Name: "cursor", In: "query", Description: "next page, received in the header Link", Schema: &Schema{Type: "string"}}
+	openapi.Components.Parameters["rufsQueryFields"] = &ParameterObject{Name: "fields", In: "query", Description: "fields of response separated by comma, nested fields of objects in the form <field>.<field>", Schema: &Schema{Type: "string"}}
+	openapi.Components.Parameters["rufsQueryExpand"] = &ParameterObject{Name: "expand", In: "query", Description: "references to embed separated by comma : fields with $ref, dependent schemas (or its x-document) and * for all, nested in the form <name>.<name>", Schema: &Schema{Type: "string"}}
+	openapi.Components.Parameters["rufsQueryFilter"] = &ParameterObject{Name: "filter", In: "query", Style: "deepObject", Description: "<field>=<value> or <field>[<operator>]=<value>, with operators eq, ne, lt, lte, gt, gte, in, like, ilike and isnull", Schema: &Schema{Type: "object"}}
+	parametersQuery := []ParameterObject{}
+
+	for _, name := range []string{"rufsQueryFilter", "rufsQueryFields", "rufsQueryExpand", "rufsQuerySort", "rufsQueryLimit", "rufsQueryOffset", "rufsQueryCursor"} {
+		parametersQuery = append(parametersQuery, ParameterObject{Ref: "#/components/parameters/" + name})
+	}
 
 	for schemaName, schema := range options.schemas {
 		parameterSchema := options.parameterSchemas[schemaName]
@@ -1315,6 +1517,12 @@ func (openapi *OpenApi) FillOpenApi(options FillOpenApiOptions) {
 
 			if methodsHaveParameters[i] && openapi.Components.Parameters[schemaName] != nil {
 				operationObject.Parameters = parametersRef
+
+				if methodsHaveResponseList[i] && !disableResponseList {
+					operationObject.Parameters = append(append([]ParameterObject{}, parametersRef...), parametersQuery...)
+				} else if method == "get" {
+					operationObject.Parameters = append(append([]ParameterObject{}, parametersRef...), ParameterObject{Ref: "#/components/parameters/rufsQueryFields"}, ParameterObject{Ref: "#/components/parameters/rufsQueryExpand"})
+				}
 			}
 
 			if methodsHaveRequestBody[i] {
@@ -1634,6 +1842,31 @@ func (openapi *OpenApi) getPropertiesWithRef(schemaName string, ref string) (lis
 	return list, err
 }
 
+type Dependent struct {
+	Table string
+	Field string
+}
+
+// getDependents return the fields of the schemas that reference schemaNameTarget (one to many).
+func (openapi *OpenApi) getDependents(schemaNameTarget string) []*Dependent {
+	schemaNameTarget = OpenApiGetSchemaName(schemaNameTarget)
+	list := []*Dependent{}
+
+	for schemaName, schema := range openapi.Components.Schemas {
+		for fieldName, field := range schema.Properties {
+			if field.Ref != "" && OpenApiGetSchemaName(field.Ref) == schemaNameTarget {
+				list = append(list, &Dependent{schemaName, fieldName})
+			}
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Table < list[j].Table || (list[i].Table == list[j].Table && list[i].Field < list[j].Field)
+	})
+
+	return list
+}
+
 /*
 static getDependencies(openapi, schemaName, list, localSchemas) {
 const processDependency = (schemaName, list) => {
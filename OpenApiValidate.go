@@ -0,0 +1,283 @@
+package rufsBase
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/exp/slices"
+)
+
+// RufsFieldError is one invalid field of request body, nested fields in the form <field>.<field> and <field>[<index>].
+type RufsFieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validateValue check value against the type, format, nullable, maxLength, precision, scale and enum of field.
+// Numbers in strings are accepted, like in query parameters.
+func (openapi *OpenApi) validateValue(field *Schema, value any) error {
+	if value == nil {
+		if !field.Nullable {
+			return fmt.Errorf("null is not allowed")
+		}
+
+		return nil
+	}
+
+	if len(field.Enum) > 0 {
+		found := false
+
+		for _, item := range field.Enum {
+			if fmt.Sprint(item) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("value %v is not one of %v", value, field.Enum)
+		}
+	}
+
+	dataType := field.Type
+
+	if dataType == "" && len(field.Properties) > 0 {
+		dataType = "object"
+	}
+
+	switch dataType {
+	case "integer":
+		switch v := value.(type) {
+		case int, int32, int64:
+		case float64:
+			if v != math.Trunc(v) {
+				return fmt.Errorf("value %v is not integer", value)
+			}
+		case string:
+			if _, err := strconv.Atoi(v); err != nil {
+				return fmt.Errorf("value %v is not integer", value)
+			}
+		default:
+			return fmt.Errorf("value %v is not integer", value)
+		}
+	case "number":
+		var number float64
+
+		switch v := value.(type) {
+		case int:
+			number = float64(v)
+		case int32:
+			number = float64(v)
+		case int64:
+			number = float64(v)
+		case float32:
+			number = float64(v)
+		case float64:
+			number = v
+		case string:
+			var err error
+
+			if number, err = strconv.ParseFloat(v, 64); err != nil {
+				return fmt.Errorf("value %v is not number", value)
+			}
+		default:
+			return fmt.Errorf("value %v is not number", value)
+		}
+		// numeric(precision, scale)
+		str := strings.TrimPrefix(strconv.FormatFloat(number, 'f', -1, 64), "-")
+		integerDigits, decimalDigits, _ := strings.Cut(str, ".")
+
+		if field.Scale > 0 && len(decimalDigits) > field.Scale {
+			return fmt.Errorf("value %v has more than %d decimal digits", value, field.Scale)
+		}
+
+		if field.Precision > 0 && len(strings.TrimLeft(integerDigits, "0")) > field.Precision-field.Scale {
+			return fmt.Errorf("value %v has more than %d integer digits", value, field.Precision-field.Scale)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("value %v is not boolean", value)
+		}
+	case "array":
+		list, ok := value.([]any)
+
+		if !ok {
+			return fmt.Errorf("value %v is not array", value)
+		}
+
+		if field.Items != nil {
+			for i, item := range list {
+				if err := openapi.validateValue(field.Items, item); err != nil {
+					return fmt.Errorf("item %d : %s", i, err)
+				}
+			}
+		}
+	case "object":
+		if _, ok := value.(map[string]any); !ok {
+			return fmt.Errorf("value %v is not object", value)
+		}
+	default:
+		str, ok := value.(string)
+
+		if !ok {
+			if _, ok := value.(time.Time); ok && (field.Format == "date-time" || field.Format == "date") {
+				return nil
+			}
+
+			return fmt.Errorf("value %v is not string", value)
+		}
+
+		if field.MaxLength > 0 && utf8.RuneCountInString(str) > field.MaxLength {
+			return fmt.Errorf("length of value is greater than %d", field.MaxLength)
+		}
+
+		if field.Format == "date-time" || dataType == "date-time" {
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				return fmt.Errorf("value %v is not date-time", value)
+			}
+		} else if field.Format == "date" || dataType == "date" {
+			if _, err := time.Parse("2006-01-02", str); err != nil {
+				if _, err := time.Parse(time.RFC3339, str); err != nil {
+					return fmt.Errorf("value %v is not date", value)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateResponse return the mismatches of the json body with the response schema (one object or array of objects),
+// without the required check, because of the projections of fields.
+func (openapi *OpenApi) validateResponse(schema *Schema, body []byte) []*RufsFieldError {
+	var value any
+
+	if err := json.Unmarshal(body, &value); err != nil {
+		return []*RufsFieldError{{"", fmt.Sprintf("invalid json : %s", err)}}
+	}
+
+	resolve := func(schema *Schema) *Schema {
+		if schema != nil && schema.Ref != "" {
+			if schemaRef, err := openapi.getSchemaFromRef(schema.Ref); err == nil {
+				return schemaRef
+			}
+		}
+
+		return schema
+	}
+
+	schema = resolve(schema)
+
+	if value == nil || schema == nil {
+		return nil
+	}
+
+	if schema.Type == "array" {
+		list, ok := value.([]any)
+
+		if !ok {
+			return []*RufsFieldError{{"", "value is not array"}}
+		}
+
+		errors := []*RufsFieldError{}
+
+		for i, item := range list {
+			if obj, ok := item.(map[string]any); !ok {
+				errors = append(errors, &RufsFieldError{fmt.Sprintf("[%d]", i), "value is not object"})
+			} else if items := resolve(schema.Items); items != nil {
+				errors = append(errors, openapi.validateFields(items, obj, true, fmt.Sprintf("[%d].", i))...)
+			}
+		}
+
+		return errors
+	}
+
+	obj, ok := value.(map[string]any)
+
+	if !ok {
+		return []*RufsFieldError{{"", "value is not object"}}
+	}
+
+	return openapi.validateFields(schema, obj, true, "")
+}
+
+// fieldRequired is true for the fields that must be informed, except the ones that the database fill.
+func fieldRequired(schema *Schema, fieldName string) bool {
+	field := schema.Properties[fieldName]
+
+	if field.IdentityGeneration != "" || field.Default != "" || len(field.Enum) == 1 {
+		return false
+	}
+
+	return field.Essential || slices.Contains(schema.Required, fieldName)
+}
+
+// validateObject return the invalid fields of obj, also the missing required fields when partial is false.
+func (openapi *OpenApi) validateObject(schema *Schema, obj map[string]any, partial bool) []*RufsFieldError {
+	return openapi.validateFields(schema, obj, partial, "")
+}
+
+func (openapi *OpenApi) validateFields(schema *Schema, obj map[string]any, partial bool, prefix string) []*RufsFieldError {
+	list := []*RufsFieldError{}
+	fieldNames := []string{}
+
+	for fieldName := range obj {
+		fieldNames = append(fieldNames, fieldName)
+	}
+
+	if !partial {
+		for fieldName := range schema.Properties {
+			if _, ok := obj[fieldName]; !ok && fieldRequired(schema, fieldName) {
+				fieldNames = append(fieldNames, fieldName)
+			}
+		}
+	}
+
+	sort.Strings(fieldNames)
+
+	for _, fieldName := range fieldNames {
+		field, ok := schema.Properties[fieldName]
+		value := obj[fieldName]
+
+		if !ok {
+			list = append(list, &RufsFieldError{prefix + fieldName, "unknown field"})
+			continue
+		}
+
+		if value == nil {
+			// the fields filled by the database accept null, like in the insert without them
+			if fieldRequired(schema, fieldName) {
+				list = append(list, &RufsFieldError{prefix + fieldName, "required field"})
+			} else if field.IdentityGeneration == "" && field.Default == "" {
+				if err := openapi.validateValue(field, value); err != nil {
+					list = append(list, &RufsFieldError{prefix + fieldName, err.Error()})
+				}
+			}
+
+			continue
+		}
+
+		if err := openapi.validateValue(field, value); err != nil {
+			list = append(list, &RufsFieldError{prefix + fieldName, err.Error()})
+			continue
+		}
+
+		if objValue, ok := value.(map[string]any); ok && len(field.Properties) > 0 {
+			list = append(list, openapi.validateFields(field, objValue, false, prefix+fieldName+".")...)
+		} else if items, ok := value.([]any); ok && field.Items != nil && len(field.Items.Properties) > 0 {
+			for i, item := range items {
+				if objItem, ok := item.(map[string]any); ok {
+					list = append(list, openapi.validateFields(field.Items, objItem, false, fmt.Sprintf("%s%s[%d].", prefix, fieldName, i))...)
+				}
+			}
+		}
+	}
+
+	return list
+}
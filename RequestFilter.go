@@ -4,8 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"mime"
 	"net/http"
-	"os"
+	"net/url"
 	"sort"
 	"strings"
 
@@ -45,6 +46,12 @@ type RequestFilter struct {
 	schemaName   string
 	parameters   map[string]any
 	objIn        map[string]any
+	contentType  string
+	jsonPatch    []JsonPatchOperation
+	ifMatch      string
+	requestUrl   *url.URL
+	// in batches, the audit and notifications wait the commit
+	deferred *[]func()
 }
 
 func RequestFilterInitialize(req *http.Request, rms *RufsMicroService) (*RequestFilter, error) {
@@ -52,8 +59,19 @@ func RequestFilterInitialize(req *http.Request, rms *RufsMicroService) (*Request
 	rf := &RequestFilter{}
 	rf.microService = rms
 	rf.method = strings.ToLower(req.Method)
+	rf.contentType, _, _ = mime.ParseMediaType(req.Header.Get("Content-Type"))
+	rf.ifMatch = req.Header.Get("If-Match")
+	rf.requestUrl = req.URL
 
-	if rf.method == "post" || rf.method == "put" || rf.method == "patch" {
+	if rf.method == "post" && (rf.contentType == ContentTypeMergePatch || rf.contentType == ContentTypeJsonPatch) {
+		return nil, fmt.Errorf("[RequestFilter.Initialize] content type %s is only allowed in put and patch", rf.contentType)
+	}
+
+	if rf.contentType == ContentTypeJsonPatch && (rf.method == "put" || rf.method == "patch") {
+		if err := json.NewDecoder(req.Body).Decode(&rf.jsonPatch); err != nil {
+			return nil, err
+		}
+	} else if rf.method == "post" || rf.method == "put" || rf.method == "patch" {
 		err := json.NewDecoder(req.Body).Decode(&rf.objIn)
 
 		if err != nil {
@@ -87,12 +105,7 @@ func RequestFilterInitialize(req *http.Request, rms *RufsMicroService) (*Request
 		return nil, fmt.Errorf("[RufsMicroService.Initialize] : %s", err)
 	}
 
-	if _, ok := rf.microService.fileDbAdapter.fileTables[rf.schemaName]; ok {
-		rf.entityManager = rms.fileDbAdapter
-	} else {
-		rf.entityManager = rms.entityManager
-	}
-
+	rf.entityManager = rms.getEntityManager(rf.schemaName)
 	return rf, nil
 }
 
@@ -102,58 +115,175 @@ func (rf *RequestFilter) checkObjectAccess(obj map[string]any) Response {
 		return ResponseBadRequest(fmt.Sprintf("[RequestFilter.processQuery] Fail to find schema %s", rf.schemaName))
 	}
 
-	var response Response
-	userRufsGroupOwner := rf.tokenPayload.RufsGroupOwner
-	rufsGroupOwnerEntries, _ := rf.microService.openapi.getPropertiesWithRef(rf.schemaName, "#/components/schemas/rufsGroupOwner")
+	if err := rf.tenantCheck(obj); err != nil {
+		return ResponseUnauthorized(fmt.Sprint(err))
+	}
 
-	if userRufsGroupOwner > 1 && len(rufsGroupOwnerEntries) > 0 {
-		objRufsGroupOwner, _ := rf.microService.openapi.getPrimaryKeyForeign(rf.schemaName, "rufsGroupOwner", obj)
+	return Response{}
+}
+
+// fieldAllowed check the field permissions declared in schema (readOnly, writeOnly, x-readMask and x-writeMask)
+// against the role mask of tokenPayload for path. Administrators are allowed to read and write any field.
+func fieldAllowed(tokenPayload *TokenPayload, path string, field *Schema, write bool) bool {
+	if (write && field.ReadOnly) || (!write && field.WriteOnly) {
+		return false
+	}
 
-		if objRufsGroupOwner == nil {
-			obj["rufsGroupOwner"] = userRufsGroupOwner
-			objRufsGroupOwner.PrimaryKey["id"] = userRufsGroupOwner
+	if tokenPayload.isAdmin() {
+		return true
+	}
+
+	requiredMask := field.ReadMask
+
+	if write {
+		requiredMask = field.WriteMask
+	}
+
+	if requiredMask == 0 {
+		return true
+	}
+
+	idx := slices.IndexFunc(tokenPayload.Roles, func(e Role) bool { return e.Path == path })
+	return idx >= 0 && tokenPayload.Roles[idx].Mask&requiredMask == requiredMask
+}
+
+// filterReadable return one copy of obj without the fields that tokenPayload can't read.
+func (rf *RequestFilter) filterReadable(tokenPayload *TokenPayload, obj map[string]any) map[string]any {
+	schema, ok := rf.microService.openapi.getSchemaFromSchemas(rf.schemaName)
+
+	if !ok || obj == nil {
+		return obj
+	}
+
+	ret := map[string]any{}
+
+	for fieldName, value := range obj {
+		if field, ok := schema.Properties[fieldName]; !ok || fieldAllowed(tokenPayload, rf.path, field, false) {
+			ret[fieldName] = value
 		}
+	}
 
-		if objRufsGroupOwner.PrimaryKey["id"].(int) == userRufsGroupOwner {
-			rufsGroup, _ := rf.microService.openapi.getPrimaryKeyForeign(rf.schemaName, "rufsGroup", obj)
+	return ret
+}
 
-			if rufsGroup != nil {
-				found := false
+// checkWritable refuse the fields of objIn that the user can't write, except when it has the same value of oldObj.
+// In updates, the fields missing in objIn that the user can't read or write keep the old value.
+func (rf *RequestFilter) checkWritable(oldObj map[string]any) error {
+	schema, ok := rf.microService.openapi.getSchemaFromSchemas(rf.schemaName)
 
-				for _, group := range rf.tokenPayload.Groups {
-					if group == rufsGroup.PrimaryKey["id"].(int) {
-						found = true
-						break
-					}
-				}
+	if !ok {
+		return nil
+	}
 
-				if !found {
-					response = ResponseUnauthorized("unauthorized object rufsGroup")
-				}
+	for fieldName, field := range schema.Properties {
+		// the fields of soft delete are changed only by DELETE and restore
+		if !rf.softDeleteWritable(fieldName) {
+			readOnly := *field
+			readOnly.ReadOnly = true
+			field = &readOnly
+		}
+
+		value, exists := rf.objIn[fieldName]
+		// the clients never receive the writeOnly fields (ex. password), then empty means unchanged
+		if oldObj != nil && field.WriteOnly && (value == nil || value == "") {
+			exists = false
+		}
+
+		if oldObj != nil && !exists {
+			if oldValue, ok := oldObj[fieldName]; ok && (!fieldAllowed(rf.tokenPayload, rf.path, field, false) || !fieldAllowed(rf.tokenPayload, rf.path, field, true)) {
+				rf.objIn[fieldName] = oldValue
+			}
+
+			continue
+		}
+
+		if !exists || (oldObj == nil && value == nil) || fieldAllowed(rf.tokenPayload, rf.path, field, true) {
+			continue
+		}
+
+		if oldObj != nil {
+			dataNew, _ := json.Marshal(value)
+			dataOld, _ := json.Marshal(oldObj[fieldName])
+
+			if string(dataNew) == string(dataOld) {
+				continue
 			}
-		} else {
-			response = ResponseUnauthorized("unauthorized object rufsGroupOwner")
 		}
+
+		return fmt.Errorf("[RequestFilter.checkWritable] unauthorized write in field %s.%s", rf.schemaName, fieldName)
 	}
 
-	return response
+	return nil
+}
+
+// hashPasswords store only the hash of the new values of fields with format "password", after the policy check.
+// Values kept from oldObj are not changed, and hashes sent by clients are refused because they skip the policy.
+func (rf *RequestFilter) hashPasswords(oldObj map[string]any) error {
+	schema, ok := rf.microService.openapi.getSchemaFromSchemas(rf.schemaName)
+
+	if !ok {
+		return nil
+	}
+
+	for fieldName, field := range schema.Properties {
+		if password, ok := rf.objIn[fieldName].(string); ok && field.Format == "password" && password != "" && password != oldObj[fieldName] {
+			if passwordIsHash(password) {
+				return fmt.Errorf("[RequestFilter.hashPasswords] field %s must have the password, not its hash", fieldName)
+			}
+			// partial updates may omit the name
+			userName, _ := rf.objIn["name"].(string)
+
+			if userName == "" {
+				userName, _ = oldObj["name"].(string)
+			}
+
+			if err := passwordPolicyCheck(userName, password); err != nil {
+				return err
+			}
+
+			hash, err := PasswordHash(password)
+
+			if err != nil {
+				return err
+			}
+
+			rf.objIn[fieldName] = hash
+			rf.microService.basicAuthCache.remove(userName)
+		}
+	}
+
+	return nil
 }
 
 func (rf *RequestFilter) processCreate() Response {
+	// before the fill of rufsGroupOwner by checkObjectAccess, that is allowed without the write mask
+	if err := rf.checkWritable(nil); err != nil {
+		return ResponseUnauthorized(fmt.Sprint(err))
+	}
+
 	response := rf.checkObjectAccess(rf.objIn)
 
 	if response.StatusCode != 0 {
 		return response
 	}
 
+	if response := rf.validate(rf.objIn, false); response.StatusCode != 0 {
+		return response
+	}
+
+	if err := rf.hashPasswords(nil); err != nil {
+		return ResponseBadRequest(fmt.Sprint(err))
+	}
+
 	newObj, err := rf.entityManager.Insert(rf.schemaName, rf.objIn)
 
 	if err != nil {
 		return ResponseInternalServerError(fmt.Sprintf("[RequestFilter.processCreate] : %s", err))
 	}
 
+	rf.audit("create", nil, newObj)
 	rf.notify(newObj, false)
-	return ResponseOk(newObj)
+	return rf.responseWithETag(newObj, http.StatusOK)
 }
 
 func (rf *RequestFilter) getObject(useDocument bool) (map[string]any, error) {
@@ -168,15 +298,26 @@ func (rf *RequestFilter) getObject(useDocument bool) (map[string]any, error) {
 	if err != nil {
 		return nil, err
 	}
+	// the rows in trash are visible only in /trash
+	if rf.inTrash(obj) {
+		return nil, nil
+	}
 
-	if useDocument != true {
+	if useDocument != true || obj == nil {
 		return obj, nil
 	}
-	/*
-		const service = this.getSchema(entityManager, tokenData, serviceName)
-		return entityManager.dataStoreManager.getDocument(service, obj, true, tokenData)
-	*/
-	return nil, fmt.Errorf("[ResquestFilter.GetObject] don't implemented com rf useDocument == true")
+	// by default the document has the first level of references
+	expand, err := rf.parseExpand()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if expand == nil {
+		expand = rufsExpand{"*": rufsExpand{}}
+	}
+
+	return rf.getDocument(obj, obj, expand)
 }
 
 func (rf *RequestFilter) processRead() Response {
@@ -188,34 +329,136 @@ func (rf *RequestFilter) processRead() Response {
 		return ResponseInternalServerError(fmt.Sprintf("[RequestFilter.processRead] : %s", err))
 	}
 
-	return ResponseOk(obj)
+	if obj == nil {
+		return ResponseOk(obj)
+	}
+
+	fields, err := rf.parseFields()
+	var expand rufsExpand
+
+	if err == nil {
+		expand, err = rf.parseExpand()
+	}
+
+	if err != nil {
+		return ResponseBadRequest(fmt.Sprintf("[RequestFilter.processRead] : %s", err))
+	}
+
+	resp := rf.responseWithETag(obj, http.StatusOK)
+	// the ETag is the version of the stored row, also for projections and documents
+	if (fields != nil || expand != nil) && resp.StatusCode == http.StatusOK {
+		readable := rf.filterReadable(rf.tokenPayload, obj)
+		doc, err := rf.getDocument(readable, queryProjectFields(readable, fields), expand)
+
+		if err != nil {
+			return documentResponse(err)
+		}
+
+		header := resp.Header
+		resp = ResponseOk(doc)
+		resp.Header = header
+	}
+
+	return resp
+}
+
+// changedFields return the fields of objIn with values different of oldObj.
+func (rf *RequestFilter) changedFields(oldObj map[string]any) map[string]any {
+	changes := map[string]any{}
+
+	for fieldName, value := range rf.objIn {
+		if oldValue, ok := oldObj[fieldName]; !ok || !jsonEqual(value, oldValue) {
+			changes[fieldName] = value
+		}
+	}
+
+	return changes
+}
+
+// validate check obj against the schema before it reach the entity manager, returning 400 with the list of invalid fields.
+func (rf *RequestFilter) validate(obj map[string]any, partial bool) Response {
+	schema, ok := rf.microService.openapi.getSchemaFromSchemas(rf.schemaName)
+
+	if !ok {
+		return ResponseBadRequest(fmt.Sprintf("[RequestFilter.validate] missing schema %s", rf.schemaName))
+	}
+
+	errors := rf.microService.openapi.validateObject(schema, obj, partial)
+
+	if len(errors) == 0 {
+		return Response{}
+	}
+
+	resp := ResponseOk(map[string]any{"message": fmt.Sprintf("[RequestFilter.validate] invalid fields of %s", rf.schemaName), "errors": errors})
+
+	if resp.StatusCode == http.StatusOK {
+		resp.StatusCode = http.StatusBadRequest
+	}
+
+	return resp
 }
 
 func (rf *RequestFilter) processUpdate() Response {
-	if _, err := rf.getObject(false); err != nil {
+	oldObj, err := rf.getObject(false)
+
+	if err != nil {
 		return ResponseUnauthorized(fmt.Sprintf("[RequestFilter.processUpdate] err : %s", err))
 	}
 
+	if oldObj == nil {
+		return ResponseBadRequest("[RequestFilter.processUpdate] don't find register with informed parameters")
+	}
+
+	if response := rf.etagCheck(oldObj); response.StatusCode != 0 {
+		return response
+	}
+
+	if rf.contentType == ContentTypeMergePatch || rf.contentType == ContentTypeJsonPatch {
+		if rf.objIn, err = rf.patchApply(oldObj); err != nil {
+			return ResponseBadRequest(fmt.Sprint(err))
+		}
+	}
+
 	response := rf.checkObjectAccess(rf.objIn)
 
 	if response.StatusCode != 0 {
 		return response
 	}
 
+	if err := rf.checkWritable(oldObj); err != nil {
+		return ResponseUnauthorized(fmt.Sprint(err))
+	}
+	// the stored values aren't validated again
+	if response := rf.validate(rf.changedFields(oldObj), true); response.StatusCode != 0 {
+		return response
+	}
+
+	if err := rf.hashPasswords(oldObj); err != nil {
+		return ResponseBadRequest(fmt.Sprint(err))
+	}
+
 	primaryKey, err := rf.parseQueryParameters()
 
 	if err != nil {
 		return ResponseInternalServerError(fmt.Sprintf("[RequestFilter.processUpdate] : %s", err))
 	}
 
-	newObj, err := rf.entityManager.Update(rf.schemaName, primaryKey, rf.objIn)
+	// write only the changed fields
+	changes := rf.changedFields(oldObj)
+
+	if len(changes) == 0 {
+		return rf.responseWithETag(oldObj, http.StatusOK)
+	}
+
+	newObj, err := rf.entityManager.Update(rf.schemaName, primaryKey, changes)
 
 	if err != nil {
 		return ResponseInternalServerError(fmt.Sprintf("[RequestFilter.processUpdate] : %s", err))
 	}
 
+	rf.audit("update", oldObj, newObj)
 	rf.notify(newObj, false)
-	return ResponseOk(newObj)
+	return rf.responseWithETag(newObj, http.StatusOK)
 }
 
 func (rf *RequestFilter) processDelete() Response {
@@ -225,58 +468,127 @@ func (rf *RequestFilter) processDelete() Response {
 		return ResponseBadRequest(fmt.Sprintf("[RequestFilter.processDelete] don't find register with informed parameters : %s", err))
 	}
 
+	if objDeleted == nil {
+		return ResponseBadRequest("[RequestFilter.processDelete] don't find register with informed parameters")
+	}
+
+	if response := rf.etagCheck(objDeleted); response.StatusCode != 0 {
+		return response
+	}
+
 	primaryKey, err := rf.parseQueryParameters()
 
 	if err != nil {
 		return ResponseInternalServerError(fmt.Sprintf("[RequestFilter.processDelete] : %s", err))
 	}
 
-	err = rf.entityManager.DeleteOne(rf.schemaName, primaryKey)
+	if len(rf.softDeleteConditions()) > 0 {
+		_, err = rf.softDeleteMark(primaryKey, true)
+	} else {
+		err = rf.entityManager.DeleteOne(rf.schemaName, primaryKey)
+	}
 
 	if err != nil {
 		return ResponseInternalServerError(fmt.Sprintf("[RequestFilter.processDelete] : %s", err))
 	}
 
+	rf.audit("delete", objDeleted, nil)
 	rf.notify(objDeleted, true)
 	return ResponseOk(map[string]any{})
 }
 
+// processPatch is one upsert : the row is located by the primary key and then by each x-uniqueKeys set present in the
+// body, and it is updated when found or created otherwise.
 func (rf *RequestFilter) processPatch() Response {
-	return ResponseInternalServerError("TODO")
-	/*
-		const service = RequestFilter.getSchema(entityManager, user, serviceName);
+	// the json patch has only operations, the row is informed in parameters
+	if rf.contentType == ContentTypeJsonPatch {
+		if len(rf.parameters) == 0 {
+			return ResponseBadRequest("[RequestFilter.processPatch] missing parameters with primary key of json patch")
+		}
 
-		const process = keys => {
-			if (keys.length > 0) {
-				return entityManager.findOne(serviceName, keys.pop()).catch(() => process(keys));
-			} else {
-				return Promise.resolve(null);
-			}
-		};
-
-		return process(service.getKeys(obj)).then(foundObj => {
-			if (foundObj != null) {
-				const primaryKey = service.getPrimaryKey(foundObj);
-				return RequestFilter.processUpdate(user, primaryKey, entityManager, serviceName, obj, microService);
-			} else {
-				return RequestFilter.processCreate(user, entityManager, serviceName, obj, microService);
+		return rf.processUpdate()
+	}
+
+	schema, ok := rf.microService.openapi.getSchemaFromSchemas(rf.schemaName)
+
+	if !ok {
+		return ResponseInternalServerError(fmt.Sprintf("[RequestFilter.processPatch] missing schema %s", rf.schemaName))
+	}
+
+	candidates := [][]string{schema.PrimaryKeys}
+	names := []string{}
+
+	for name := range schema.UniqueKeys {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		candidates = append(candidates, schema.UniqueKeys[name])
+	}
+
+	var foundObj map[string]any
+
+	for _, fields := range candidates {
+		key := map[string]any{}
+
+		for _, fieldName := range fields {
+			if value, ok := rf.objIn[fieldName]; ok && value != nil {
+				key[fieldName] = value
 			}
-		});
-	*/
-}
+		}
 
-func (rf *RequestFilter) parseQueryParameters() (map[string]any, error) {
-	// se não for admin, limita os resultados para as rufsGroup vinculadas a empresa do usuário
-	/*
-		const userRufsGroupOwner = tokenData.rufsGroupOwner;
-		const rufsGroupOwnerEntries = entityManager.dataStoreManager.getPropertiesWithRef(serviceName, "rufsGroupOwner");
-		const rufsGroupEntries = entityManager.dataStoreManager.getPropertiesWithRef(serviceName, "rufsGroup");
+		if len(fields) == 0 || len(key) != len(fields) {
+			continue
+		}
+		// only the rows of the rufsGroupOwner and groups of the user
+		rf.tenantApply(key)
+		obj, err := rf.entityManager.FindOne(rf.schemaName, key)
 
-		if (userRufsGroupOwner > 1) {
-			if (rufsGroupOwnerEntries.length > 0) queryParameters[rufsGroupOwnerEntries[0].fieldName] = userRufsGroupOwner;
-			if (rufsGroupEntries.length > 0) queryParameters[rufsGroupEntries[0].fieldName] = tokenData.groups;
+		if err != nil {
+			return ResponseInternalServerError(fmt.Sprintf("[RequestFilter.processPatch] : %s", err))
 		}
-	*/
+
+		if rf.inTrash(obj) {
+			return ResponseBadRequest(fmt.Sprintf("[RequestFilter.processPatch] the register %v is in trash, restore it before the update", key))
+		}
+
+		if obj != nil {
+			foundObj = obj
+			break
+		}
+	}
+
+	if foundObj == nil {
+		if response := rf.etagCheck(nil); response.StatusCode != 0 {
+			return response
+		}
+
+		if rf.contentType == ContentTypeMergePatch {
+			rf.objIn = mergePatch(map[string]any{}, rf.objIn).(map[string]any)
+		}
+
+		return rf.processCreate()
+	}
+
+	primaryKey, err := rf.microService.openapi.copyFields(schema, foundObj, false, false, true)
+
+	if err != nil {
+		return ResponseInternalServerError(fmt.Sprintf("[RequestFilter.processPatch] : %s", err))
+	}
+	// found by unique key, the body may lack the primary key
+	for fieldName, value := range primaryKey {
+		if _, ok := rf.objIn[fieldName]; !ok {
+			rf.objIn[fieldName] = value
+		}
+	}
+
+	rf.parameters = primaryKey
+	return rf.processUpdate()
+}
+
+func (rf *RequestFilter) parseQueryParameters() (map[string]any, error) {
 	schema, err := rf.microService.openapi.getSchemaFromParameters(rf.path, rf.method)
 
 	if err != nil {
@@ -288,6 +600,8 @@ func (rf *RequestFilter) parseQueryParameters() (map[string]any, error) {
 	if err != nil {
 		return nil, fmt.Errorf("[RequestFilter.processQuery] Fail to parse fields from parameter of %s.%s : %s", rf.path, rf.method, err)
 	}
+	// se não for admin, limita os resultados para as rufsGroup vinculadas a empresa do usuário
+	rf.tenantApply(obj)
 
 	/*
 		if (queryParameters.filter != undefined) ret.filter = OpenApi.copyFields(schema, rf.queryParameters.filter);
@@ -319,88 +633,98 @@ func (rf *RequestFilter) processQuery() Response {
 
 		schema, err := getParameterSchema(rf.entityManager.openapi, "/"+rf.serviceName, rf.method, "primaryKey")
 	*/
-	schema, err := rf.microService.openapi.getSchemaFromParameters(rf.path, rf.method)
+	query, err := rf.parseQuery()
 
 	if err != nil {
-		return ResponseBadRequest(fmt.Sprintf("[RequestFilter.processQuery] Fail to find schema from parameter of %s.%s : %s", rf.path, rf.method, err))
+		return ResponseBadRequest(fmt.Sprintf("[RequestFilter.processQuery] Fail to parser parameters of %s.%s : %s", rf.path, rf.method, err))
 	}
 
-	//const fields = Object.entries(this.parameters).length > 0 ? this.parseQueryParameters() : null;
-	fields, err := rf.parseQueryParameters()
+	list, total, err := rf.entityManager.Query(rf.schemaName, query)
 
 	if err != nil {
-		return ResponseBadRequest(fmt.Sprintf("[RequestFilter.processQuery] Fail to parser parameters of %s.%s : %s", rf.path, rf.method, err))
+		return ResponseBadRequest(fmt.Sprintf("[RequestFilter.processQuery] Fail to find items of %s : %s", rf.schemaName, err))
 	}
 
-	orderBy := []string{}
+	fields, _ := rf.parseFields()
+	expand, _ := rf.parseExpand()
+	listOut := make([]map[string]any, 0, len(list))
 
-	for fieldName, field := range schema.Properties {
-		dataType := field.Type
+	for _, item := range list {
+		readable := rf.filterReadable(rf.tokenPayload, item)
+		doc := queryProjectFields(readable, fields)
 
-		if field.Format != "" {
-			dataType = field.Format
+		if expand != nil {
+			if doc, err = rf.getDocument(readable, doc, expand); err != nil {
+				return documentResponse(err)
+			}
 		}
 
-		if dataType == "integer" || strings.Contains(dataType, "date") || strings.Contains(dataType, "time") {
-			orderBy = append(orderBy, fieldName+" desc")
-		}
+		listOut = append(listOut, doc)
 	}
 
-	if list, err := rf.entityManager.Find(rf.schemaName, fields, orderBy); err != nil {
-		return ResponseBadRequest(fmt.Sprintf("[RequestFilter.processQuery] Fail to find items of %s : %s", rf.schemaName, err))
-	} else {
-		return ResponseOk(list)
+	resp := ResponseOk(listOut)
+	// the ETag is the version of the whole row
+	if query.Fields == nil {
+		resp = rf.queryETag(resp, list)
 	}
-}
 
-func (rf *RequestFilter) CheckAuthorization(req *http.Request) (access bool, err error) {
-	checkMask := func(mask int, method string) (ret bool) {
-		if idx := slices.Index([]string{"get", "post", "patch", "put", "delete", "query"}, method); idx >= 0 {
-			ret = mask&(1<<idx) != 0
-		}
+	return rf.queryLinks(resp, query, list, total)
+}
 
-		return ret
-	}
+// roleAllowMethod is the only rule of the masks of roles, used to authorize the requests and to filter the openapi of login.
+func roleAllowMethod(mask int, method string) bool {
+	idx := slices.Index([]string{"get", "post", "patch", "put", "delete", "query"}, method)
+	return idx >= 0 && mask&(1<<idx) != 0
+}
 
-	extractTokenPayload := func(tokenRaw string) (*TokenPayload, error) {
-		rufsClaims, err := RufsDecryptToken(tokenRaw)
+func (rf *RequestFilter) CheckAuthorization(req *http.Request) (access bool, err error) {
+	// security declared in the operation override the global one
+	securityRequirements := rf.microService.openapi.Security
 
-		if err == nil {
-			return &rufsClaims.TokenPayload, err
-		} else {
-			return nil, fmt.Errorf("Authorization token header invalid : %s", err)
-		}
+	if operationObject, ok := rf.microService.openapi.Paths[rf.path][rf.method]; ok && len(operationObject.Security) > 0 {
+		securityRequirements = operationObject.Security
 	}
 
-	for _, securityItem := range rf.microService.openapi.Security {
+	for _, securityItem := range securityRequirements {
 		for securityName := range securityItem {
 			if securityScheme, ok := rf.microService.openapi.Components.SecuritySchemes[securityName]; ok && rf.tokenPayload == nil {
-				if securityScheme.Type == "http" && securityScheme.Scheme == "bearer" && securityScheme.BearerFormat == "JWT" {
-					authorizationHeaderPrefix := "Bearer "
-					tokenRaw := req.Header["Authorization"][0]
+				if securityScheme.Type == "http" && securityScheme.Scheme == "basic" {
+					if userName, password, ok := req.BasicAuth(); ok {
+						// the locked users are refused also with credentials in cache
+						if rf.microService.loginLockout.isLocked(userName) {
+							return false, fmt.Errorf("[RequestFilter.CheckAuthorization] user %s temporarily locked by excess of wrong passwords", userName)
+						}
+
+						if rf.tokenPayload = rf.microService.basicAuthCache.get(userName, password); rf.tokenPayload == nil {
+							loginResponse, err := rf.microService.authenticateUser(userName, password, req.RemoteAddr)
 
-					if strings.HasPrefix(tokenRaw, authorizationHeaderPrefix) {
-						tokenRaw = tokenRaw[len(authorizationHeaderPrefix):]
+							if err != nil {
+								return false, err
+							}
+
+							if rf.microService.totpEnabled(loginResponse.Id) {
+								return false, fmt.Errorf("[RequestFilter.CheckAuthorization] basic authentication is disabled for users with two-factor authentication")
+							}
 
-						if rf.tokenPayload, err = extractTokenPayload(tokenRaw); err != nil {
+							rf.tokenPayload = &loginResponse.TokenPayload
+							rf.microService.basicAuthCache.register(userName, password, rf.tokenPayload)
+						}
+					}
+				} else if securityScheme.Type == "http" && securityScheme.Scheme == "bearer" && securityScheme.BearerFormat == "JWT" {
+					if strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") {
+						rufsClaims, err := rf.microService.authorizationClaims(req)
+
+						if err != nil {
 							return false, err
 						}
+
+						rf.tokenPayload = &rufsClaims.TokenPayload
 					}
 				} else if securityScheme.Type == "apiKey" {
 					if securityScheme.In == "header" {
-						for headerName, headerArray := range req.Header {
-							if strings.ToLower(headerName) == strings.ToLower(securityScheme.Name) {
-								tokenRaw := headerArray[0]
-
-								if user, err := rf.microService.fileDbAdapter.FindOne("rufsUser", map[string]any{"password": tokenRaw}); err != nil || user == nil {
-									return false, err
-								} else {
-									rf.tokenPayload = &TokenPayload{}
-									buffer, _ := json.Marshal(user)
-									json.Unmarshal(buffer, rf.tokenPayload)
-								}
-
-								break
+						if tokenRaw := req.Header.Get(securityScheme.Name); tokenRaw != "" {
+							if rf.tokenPayload, err = rf.microService.apiKeyAuthenticate(tokenRaw, req.RemoteAddr); err != nil {
+								return false, err
 							}
 						}
 					}
@@ -414,7 +738,7 @@ func (rf *RequestFilter) CheckAuthorization(req *http.Request) (access bool, err
 	}
 
 	if idx := slices.IndexFunc(rf.tokenPayload.Roles, func(e Role) bool { return e.Path == rf.path }); idx >= 0 {
-		if checkMask(rf.tokenPayload.Roles[idx].Mask, rf.method) {
+		if roleAllowMethod(rf.tokenPayload.Roles[idx].Mask, rf.method) {
 			access = true
 		}
 	} else {
@@ -431,14 +755,7 @@ func RufsDecryptToken(tokenString string) (*RufsClaims, error) {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 
-		jwtSecret := os.Getenv("RUFS_JWT_SECRET")
-
-		if jwtSecret == "" {
-			jwtSecret = "123456"
-		}
-
-		hmacSampleSecret := []byte(jwtSecret)
-		return hmacSampleSecret, nil
+		return rufsJwtSecret(), nil
 	})
 
 	if err != nil {
@@ -456,6 +773,10 @@ func (rf *RequestFilter) ProcessRequest() Response {
 	var err error
 	var resp Response
 	schemaResponse, _ := rf.microService.openapi.getSchema(rf.path, rf.method, "responseObject")
+	// the database also restrict the rows to the rufsGroupOwner and groups of the user
+	if dbClientSql, ok := rf.entityManager.(*DbClientSql); ok && dbClientSql.dbConfig.rowLevelSecurity && rf.tokenPayload != nil {
+		rf.entityManager = dbClientSql.withTenant(rf.tokenPayload)
+	}
 
 	if rf.method == "get" && schemaResponse != nil && schemaResponse.Type == "array" {
 		resp = rf.processQuery()
@@ -477,7 +798,7 @@ func (rf *RequestFilter) ProcessRequest() Response {
 		log.Printf("ProcessRequest error : %s", err)
 		return ResponseInternalServerError(err.Error())
 	} else {
-		return resp
+		return rf.responseCheck(resp)
 	}
 }
 
@@ -488,6 +809,11 @@ type NotifyMessage struct {
 }
 
 func (rf *RequestFilter) notify(obj map[string]any, isRemove bool) {
+	if rf.deferred != nil {
+		*rf.deferred = append(*rf.deferred, func() { rf.deferred = nil; rf.notify(obj, isRemove) })
+		return
+	}
+
 	schema, ok := rf.microService.openapi.getSchemaFromSchemas(rf.schemaName)
 
 	if !ok {
@@ -508,13 +834,13 @@ func (rf *RequestFilter) notify(obj map[string]any, isRemove bool) {
 	rufsGroup, rufsGroupErr := rf.microService.openapi.getPrimaryKeyForeign(rf.schemaName, "rufsGroup", obj)
 	log.Printf("[RequestFilter.notify] broadcasting %s ...", msg)
 
-	for tokenString, wsServerConnection := range rf.microService.wsServerConnections {
-		tokenData := rf.microService.wsServerConnectionsTokens[tokenString]
+	for _, client := range rf.microService.wsSelect("", 0) {
+		tokenData := client.claims
 		// enviar somente para os clients de "rufsGroupOwner"
 		checkRufsGroupOwner := objRufsGroupOwner == nil
 
 		if checkRufsGroupOwner == false && objRufsGroupOwnerErr == nil {
-			if id, ok := objRufsGroupOwner.PrimaryKey["id"]; ok && id.(int64) == (int64)(tokenData.RufsGroupOwner) {
+			if id, ok := objRufsGroupOwner.PrimaryKey["id"]; ok && UtilsToInt(id) == tokenData.RufsGroupOwner {
 				checkRufsGroupOwner = true
 			}
 		}
@@ -522,7 +848,7 @@ func (rf *RequestFilter) notify(obj map[string]any, isRemove bool) {
 		checkRufsGroup := rufsGroup == nil
 
 		if checkRufsGroup == false && rufsGroupErr == nil {
-			if id, ok := rufsGroup.PrimaryKey["id"]; ok && sort.SearchInts(tokenData.Groups, (int)(id.(int64))) >= 0 {
+			if id, ok := rufsGroup.PrimaryKey["id"]; ok && slices.Contains(tokenData.Groups, UtilsToInt(id)) {
 				checkRufsGroup = true
 			}
 		}
@@ -531,7 +857,7 @@ func (rf *RequestFilter) notify(obj map[string]any, isRemove bool) {
 			if idx := slices.IndexFunc(tokenData.Roles, func(e Role) bool { return e.Path == rf.path }); idx >= 0 {
 				if (tokenData.Roles[idx].Mask & 0x01) != 0 {
 					log.Printf("[RequestFilter.notify] send to client %s", tokenData.Name)
-					wsServerConnection.WriteJSON(msg)
+					client.connection.WriteJSON(NotifyMessage{msg.Service, msg.Action, rf.filterReadable(&tokenData.TokenPayload, msg.PrimaryKey)})
 				}
 			}
 		}
@@ -0,0 +1,212 @@
+package rufsBase
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// RufsApiKey grant to scripts the access of its owner, restricted to Roles.
+// Only the sha256 of the key is stored, the key itself is returned once, at creation.
+type RufsApiKey struct {
+	Id         int        `json:"id"`
+	RufsUser   int        `json:"rufsUser"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `json:"keyHash,omitempty"`
+	Roles      []Role     `json:"roles"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	Revoked    bool       `json:"revoked"`
+}
+
+func apiKeyToMap(apiKey *RufsApiKey) map[string]any {
+	obj := map[string]any{}
+	data, _ := json.Marshal(apiKey)
+	json.Unmarshal(data, &obj)
+
+	if apiKey.Id == 0 {
+		delete(obj, "id")
+	}
+
+	return obj
+}
+
+func (rms *RufsMicroService) apiKeyFind(fields map[string]any) ([]*RufsApiKey, error) {
+	list, err := rms.getEntityManager("rufsApiKey").Find("rufsApiKey", fields, []string{})
+
+	if err != nil {
+		return nil, fmt.Errorf("[RufsMicroService.apiKeyFind] : %s", err)
+	}
+
+	apiKeys := []*RufsApiKey{}
+
+	for _, item := range list {
+		apiKey := &RufsApiKey{}
+		data, _ := json.Marshal(item)
+
+		if err := json.Unmarshal(data, apiKey); err != nil {
+			UtilsShowJsonUnmarshalError(string(data), err)
+			return nil, err
+		}
+
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	return apiKeys, nil
+}
+
+// apiKeyAuthenticate return the token payload of the owner of key, with roles reduced to the scope of the key.
+func (rms *RufsMicroService) apiKeyAuthenticate(key string, remoteAddr string) (*TokenPayload, error) {
+	apiKeys, err := rms.apiKeyFind(map[string]any{"keyHash": rufsSessionHash(key)})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(apiKeys) != 1 {
+		return nil, fmt.Errorf("[RufsMicroService.apiKeyAuthenticate] invalid api key")
+	}
+
+	apiKey := apiKeys[0]
+	now := time.Now()
+
+	if apiKey.Revoked || (apiKey.ExpiresAt != nil && now.After(*apiKey.ExpiresAt)) {
+		return nil, fmt.Errorf("[RufsMicroService.apiKeyAuthenticate] api key expired or revoked")
+	}
+
+	userMap, err := rms.getEntityManager("rufsUser").FindOne("rufsUser", map[string]any{"id": apiKey.RufsUser})
+
+	if err != nil || userMap == nil {
+		return nil, fmt.Errorf("[RufsMicroService.apiKeyAuthenticate] missing owner of api key : %v", err)
+	}
+
+	user := &RufsUser{}
+	data, _ := json.Marshal(userMap)
+
+	if err := json.Unmarshal(data, user); err != nil {
+		UtilsShowJsonUnmarshalError(string(data), err)
+		return nil, err
+	}
+
+	loginResponse, err := rms.buildLoginResponse(user, remoteAddr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	roles := []Role{}
+
+	for _, role := range apiKey.Roles {
+		if idx := slices.IndexFunc(loginResponse.Roles, func(e Role) bool { return e.Path == role.Path }); idx >= 0 {
+			roles = append(roles, Role{Path: role.Path, Mask: role.Mask & loginResponse.Roles[idx].Mask})
+		}
+	}
+
+	loginResponse.Roles = roles
+	// avoid one write by request
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > time.Minute {
+		apiKey.LastUsedAt = &now
+
+		if _, err := rms.getEntityManager("rufsApiKey").Update("rufsApiKey", map[string]any{"id": apiKey.Id}, apiKeyToMap(apiKey)); err != nil {
+			log.Printf("[RufsMicroService.apiKeyAuthenticate] fail to update lastUsedAt : %s", err)
+		}
+	}
+
+	return &loginResponse.TokenPayload, nil
+}
+
+func (rms *RufsMicroService) onRequestApiKeys(req *http.Request) Response {
+	claims, err := rms.authorizationClaims(req)
+
+	if err != nil {
+		return ResponseUnauthorized(fmt.Sprint(err))
+	}
+
+	tokenPayload := &claims.TokenPayload
+	entityManager := rms.getEntityManager("rufsApiKey")
+
+	switch req.Method {
+	case http.MethodGet:
+		userId := tokenPayload.Id
+
+		if str := req.URL.Query().Get("rufsUser"); str != "" && tokenPayload.isAdmin() {
+			userId, _ = strconv.Atoi(str)
+		}
+
+		apiKeys, err := rms.apiKeyFind(map[string]any{"rufsUser": userId})
+
+		if err != nil {
+			return ResponseInternalServerError(fmt.Sprint(err))
+		}
+
+		for _, apiKey := range apiKeys {
+			apiKey.KeyHash = ""
+		}
+
+		return ResponseOk(apiKeys)
+	case http.MethodPost:
+		apiKeyRequest := &RufsApiKey{}
+
+		if err := json.NewDecoder(req.Body).Decode(apiKeyRequest); err != nil {
+			return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestApiKeys] : %s", err))
+		}
+
+		if len(apiKeyRequest.Roles) == 0 {
+			return ResponseBadRequest("[RufsMicroService.onRequestApiKeys] missing field 'roles'")
+		}
+
+		for _, role := range apiKeyRequest.Roles {
+			idx := slices.IndexFunc(tokenPayload.Roles, func(e Role) bool { return e.Path == role.Path })
+
+			if idx < 0 || role.Mask&tokenPayload.Roles[idx].Mask != role.Mask {
+				return ResponseUnauthorized(fmt.Sprintf("[RufsMicroService.onRequestApiKeys] role %s exceeds the user roles", role.Path))
+			}
+		}
+
+		key := "rufs_" + rufsSessionRandomString(32)
+		apiKey := &RufsApiKey{RufsUser: tokenPayload.Id, Name: apiKeyRequest.Name, Prefix: key[:13], KeyHash: rufsSessionHash(key), Roles: apiKeyRequest.Roles, CreatedAt: time.Now(), ExpiresAt: apiKeyRequest.ExpiresAt}
+		obj, err := entityManager.Insert("rufsApiKey", apiKeyToMap(apiKey))
+
+		if err != nil {
+			return ResponseInternalServerError(fmt.Sprintf("[RufsMicroService.onRequestApiKeys] : %s", err))
+		}
+
+		apiKey.Id = UtilsToInt(obj["id"])
+		apiKey.KeyHash = ""
+		return ResponseOk(map[string]any{"apiKey": apiKey, "key": key})
+	case http.MethodDelete:
+		id, _ := strconv.Atoi(req.URL.Query().Get("id"))
+		apiKeys, err := rms.apiKeyFind(map[string]any{"id": id})
+
+		if err != nil {
+			return ResponseInternalServerError(fmt.Sprint(err))
+		}
+
+		if len(apiKeys) != 1 {
+			return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestApiKeys] missing api key %d", id))
+		}
+
+		apiKey := apiKeys[0]
+
+		if apiKey.RufsUser != tokenPayload.Id && !tokenPayload.isAdmin() {
+			return ResponseUnauthorized("[RufsMicroService.onRequestApiKeys] api key of other user")
+		}
+
+		apiKey.Revoked = true
+
+		if _, err := entityManager.Update("rufsApiKey", map[string]any{"id": apiKey.Id}, apiKeyToMap(apiKey)); err != nil {
+			return ResponseInternalServerError(fmt.Sprintf("[RufsMicroService.onRequestApiKeys] : %s", err))
+		}
+
+		return ResponseOk(map[string]any{})
+	}
+
+	return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestApiKeys] unsupported method %s", req.Method))
+}
@@ -0,0 +1,192 @@
+package rufsBase
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/derekstavis/go-qs"
+)
+
+// RufsAuditLog register one write of data done by the CRUD services.
+type RufsAuditLog struct {
+	Id         int                         `json:"id"`
+	RufsUser   int                         `json:"rufsUser"`
+	UserName   string                      `json:"userName"`
+	Ip         string                      `json:"ip"`
+	CreatedAt  time.Time                   `json:"createdAt"`
+	SchemaName string                      `json:"schemaName"`
+	Action     string                      `json:"action"`
+	PrimaryKey map[string]any              `json:"primaryKey"`
+	Changes    map[string]*RufsAuditChange `json:"changes"`
+}
+
+type RufsAuditChange struct {
+	Old any `json:"old"`
+	New any `json:"new"`
+}
+
+// auditDiff return the fields with different values in oldObj and newObj, hiding the values of writeOnly fields.
+func auditDiff(schema *Schema, oldObj map[string]any, newObj map[string]any) map[string]*RufsAuditChange {
+	changes := map[string]*RufsAuditChange{}
+	fieldNames := map[string]bool{}
+
+	for fieldName := range oldObj {
+		fieldNames[fieldName] = true
+	}
+
+	for fieldName := range newObj {
+		fieldNames[fieldName] = true
+	}
+
+	for fieldName := range fieldNames {
+		oldValue := oldObj[fieldName]
+		newValue := newObj[fieldName]
+		dataOld, _ := json.Marshal(oldValue)
+		dataNew, _ := json.Marshal(newValue)
+
+		if string(dataOld) == string(dataNew) {
+			continue
+		}
+
+		if field, ok := schema.Properties[fieldName]; ok && field.WriteOnly {
+			if oldValue != nil {
+				oldValue = "***"
+			}
+
+			if newValue != nil {
+				newValue = "***"
+			}
+		}
+
+		changes[fieldName] = &RufsAuditChange{oldValue, newValue}
+	}
+
+	return changes
+}
+
+// audit register the write of rf, the failure is only logged because the data is already changed.
+func (rf *RequestFilter) audit(action string, oldObj map[string]any, newObj map[string]any) {
+	if rf.deferred != nil {
+		*rf.deferred = append(*rf.deferred, func() { rf.deferred = nil; rf.audit(action, oldObj, newObj) })
+		return
+	}
+
+	schema, ok := rf.microService.openapi.getSchemaFromSchemas(rf.schemaName)
+
+	if !ok {
+		return
+	}
+
+	obj := newObj
+
+	if obj == nil {
+		obj = oldObj
+	}
+
+	primaryKey, _ := rf.microService.openapi.copyFields(schema, obj, false, false, true)
+	auditLog := &RufsAuditLog{RufsUser: rf.tokenPayload.Id, UserName: rf.tokenPayload.Name, Ip: rf.tokenPayload.Ip, CreatedAt: time.Now(), SchemaName: rf.schemaName, Action: action, PrimaryKey: primaryKey}
+	auditLog.Changes = auditDiff(schema, oldObj, newObj)
+	data, _ := json.Marshal(auditLog)
+	item := map[string]any{}
+	json.Unmarshal(data, &item)
+	delete(item, "id")
+
+	if _, err := rf.microService.getEntityManager("rufsAuditLog").Insert("rufsAuditLog", item); err != nil {
+		log.Printf("[RequestFilter.audit] fail to register %s of %s %v by %s : %s", action, rf.schemaName, primaryKey, rf.tokenPayload.Name, err)
+	}
+}
+
+// onRequestAuditLog return to administrators the audit log filtered by the query parameters
+// schemaName, primaryKey (ex. primaryKey[id]=1), rufsUser, from and to (RFC 3339), the most recent first,
+// paged by limit and offset and with the header X-Total-Count.
+func (rms *RufsMicroService) onRequestAuditLog(req *http.Request) Response {
+	claims, err := rms.authorizationClaims(req)
+
+	if err != nil {
+		return ResponseUnauthorized(fmt.Sprint(err))
+	}
+
+	if !claims.TokenPayload.isAdmin() {
+		return ResponseUnauthorized("[RufsMicroService.onRequestAuditLog] only administrators can see the audit log")
+	}
+
+	query := map[string]any{}
+
+	if req.URL.RawQuery != "" {
+		if query, err = qs.Unmarshal(req.URL.RawQuery); err != nil {
+			return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestAuditLog] fail to parse url query parameters : %s", err))
+		}
+	}
+
+	conditions := []*RufsQueryCondition{}
+
+	if schemaName, ok := query["schemaName"].(string); ok {
+		conditions = append(conditions, &RufsQueryCondition{"schemaName", "eq", schemaName})
+	}
+
+	if str, ok := query["rufsUser"].(string); ok {
+		rufsUser, _ := strconv.Atoi(str)
+		conditions = append(conditions, &RufsQueryCondition{"rufsUser", "eq", rufsUser})
+	}
+
+	for name, operator := range map[string]string{"from": "gte", "to": "lte"} {
+		if str, ok := query[name].(string); ok {
+			date, err := time.Parse(time.RFC3339, str)
+
+			if err != nil {
+				return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestAuditLog] invalid parameter '%s' : %s", name, err))
+			}
+
+			conditions = append(conditions, &RufsQueryCondition{"createdAt", operator, date})
+		}
+	}
+
+	primaryKey, _ := query["primaryKey"].(map[string]any)
+
+	for fieldName, value := range primaryKey {
+		conditions = append(conditions, &RufsQueryCondition{"primaryKey." + fieldName, "eq", fmt.Sprint(value)})
+	}
+	// the most recent first, in pages of limit (default and maximum is the limitQuery of database)
+	auditQuery := &RufsQuery{Conditions: conditions, Sort: []string{"-createdAt", "-id"}}
+
+	if str, ok := query["limit"].(string); ok {
+		if auditQuery.Limit, err = strconv.Atoi(str); err != nil || auditQuery.Limit < 0 {
+			return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestAuditLog] invalid parameter 'limit' : %s", str))
+		}
+	}
+
+	if str, ok := query["offset"].(string); ok {
+		if auditQuery.Offset, err = strconv.Atoi(str); err != nil || auditQuery.Offset < 0 {
+			return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestAuditLog] invalid parameter 'offset' : %s", str))
+		}
+	}
+
+	list, total, err := rms.getEntityManager("rufsAuditLog").Query("rufsAuditLog", auditQuery)
+
+	if err != nil {
+		return ResponseInternalServerError(fmt.Sprintf("[RufsMicroService.onRequestAuditLog] : %s", err))
+	}
+
+	auditLogs := []*RufsAuditLog{}
+
+	for _, item := range list {
+		auditLog := &RufsAuditLog{}
+		data, _ := json.Marshal(item)
+
+		if err := json.Unmarshal(data, auditLog); err != nil {
+			UtilsShowJsonUnmarshalError(string(data), err)
+			return ResponseInternalServerError(fmt.Sprint(err))
+		}
+
+		auditLogs = append(auditLogs, auditLog)
+	}
+
+	resp := ResponseOk(auditLogs)
+	resp.Header = http.Header{}
+	resp.Header.Set("X-Total-Count", strconv.Itoa(total))
+	return resp
+}
@@ -0,0 +1,270 @@
+package rufsBase
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RufsBatchOperation is one CRUD request of batch, ex. {"id": "invoice", "method": "POST", "path": "/invoice", "body": {...}}.
+// Strings of body and path in the form "${<id>.<field>}" are replaced by the field of the response of the previous operation <id>.
+type RufsBatchOperation struct {
+	Id          string `json:"id"`
+	Method      string `json:"method"`
+	Path        string `json:"path"`
+	ContentType string `json:"contentType"`
+	IfMatch     string `json:"ifMatch"`
+	Body        any    `json:"body"`
+}
+
+type RufsBatchResult struct {
+	Id         string          `json:"id"`
+	StatusCode int             `json:"statusCode"`
+	ETag       string          `json:"etag,omitempty"`
+	Body       json.RawMessage `json:"body"`
+}
+
+var batchReferenceRegExp = regexp.MustCompile(`\$\{([^.}]+)\.([^}]+)\}`)
+
+// batchReference return the value of reference "${<id>.<field>}" in the previous results.
+func batchReference(results map[string]map[string]any, id string, field string) (any, error) {
+	obj, ok := results[id]
+
+	if !ok {
+		return nil, fmt.Errorf("[batchReference] missing previous operation %s", id)
+	}
+
+	value, err := jsonPointerGet(obj, strings.Split(field, "."))
+
+	if err != nil {
+		return nil, fmt.Errorf("[batchReference] missing field %s in result of %s", field, id)
+	}
+
+	return value, nil
+}
+
+func batchReferenceString(results map[string]map[string]any, str string) (string, error) {
+	var err error
+
+	ret := batchReferenceRegExp.ReplaceAllStringFunc(str, func(match string) string {
+		groups := batchReferenceRegExp.FindStringSubmatch(match)
+		value, errRef := batchReference(results, groups[1], groups[2])
+
+		if errRef != nil {
+			err = errRef
+			return match
+		}
+
+		if number, ok := value.(float64); ok && number == float64(int64(number)) {
+			return strconv.FormatInt(int64(number), 10)
+		}
+
+		return fmt.Sprint(value)
+	})
+
+	return ret, err
+}
+
+// batchResolve return value with the references replaced, keeping the type of value when the string is only one reference.
+func batchResolve(results map[string]map[string]any, value any) (any, error) {
+	switch v := value.(type) {
+	case string:
+		if groups := batchReferenceRegExp.FindStringSubmatch(v); groups != nil && groups[0] == v {
+			return batchReference(results, groups[1], groups[2])
+		}
+
+		return batchReferenceString(results, v)
+	case map[string]any:
+		for name, item := range v {
+			resolved, err := batchResolve(results, item)
+
+			if err != nil {
+				return nil, err
+			}
+
+			v[name] = resolved
+		}
+	case []any:
+		for i, item := range v {
+			resolved, err := batchResolve(results, item)
+
+			if err != nil {
+				return nil, err
+			}
+
+			v[i] = resolved
+		}
+	}
+
+	return value, nil
+}
+
+// rufsBatch keep the transactions started by the operations of one batch, and the snapshots of the file tables written by them.
+type rufsBatch struct {
+	tokenPayload *TokenPayload
+	transactions map[*DbClientSql]*DbClientSql
+	restores     map[*FileDbAdapter]map[string]func() error
+	deferred     []func()
+}
+
+func (batch *rufsBatch) entityManager(entityManager EntityManager, schemaName string) (EntityManager, error) {
+	switch em := entityManager.(type) {
+	case *DbClientSql:
+		if transaction, ok := batch.transactions[em]; ok {
+			return transaction, nil
+		}
+
+		transaction, err := em.transaction(batch.tokenPayload)
+
+		if err != nil {
+			return nil, err
+		}
+
+		batch.transactions[em] = transaction
+		return transaction, nil
+	case *FileDbAdapter:
+		if _, ok := batch.restores[em]; !ok {
+			batch.restores[em] = map[string]func() error{}
+		}
+
+		if _, ok := batch.restores[em][schemaName]; !ok {
+			batch.restores[em][schemaName] = em.snapshot(schemaName)
+		}
+	}
+
+	return entityManager, nil
+}
+
+func (batch *rufsBatch) rollback() {
+	for _, transaction := range batch.transactions {
+		transaction.tx.Rollback()
+	}
+
+	for _, restores := range batch.restores {
+		for _, restore := range restores {
+			restore()
+		}
+	}
+}
+
+func (batch *rufsBatch) commit() error {
+	for em, transaction := range batch.transactions {
+		if err := transaction.tx.Commit(); err != nil {
+			delete(batch.transactions, em)
+			batch.rollback()
+			return err
+		}
+
+		delete(batch.transactions, em)
+	}
+
+	return nil
+}
+
+// onRequestBatch run the list of operations (POST /rest/batch) in one transaction, stopping and undoing all at the first
+// failure. Each operation is authorized like one individual request, and the audit and notifications are done after commit.
+func (rms *RufsMicroService) onRequestBatch(req *http.Request) Response {
+	claims, err := rms.authorizationClaims(req)
+
+	if err != nil {
+		return ResponseUnauthorized(fmt.Sprint(err))
+	}
+
+	if req.Method != http.MethodPost {
+		return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestBatch] unsupported method %s", req.Method))
+	}
+
+	operations := []*RufsBatchOperation{}
+
+	if err := json.NewDecoder(req.Body).Decode(&operations); err != nil {
+		return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestBatch] : %s", err))
+	}
+
+	batch := &rufsBatch{tokenPayload: &claims.TokenPayload, transactions: map[*DbClientSql]*DbClientSql{}, restores: map[*FileDbAdapter]map[string]func() error{}}
+	results := map[string]map[string]any{}
+	list := []*RufsBatchResult{}
+
+	fail := func(i int, operation *RufsBatchOperation, resp Response) Response {
+		batch.rollback()
+		msg := fmt.Sprintf("[RufsMicroService.onRequestBatch] operation %d (%s %s) : %s", i, operation.Method, operation.Path, resp.Body)
+		return ResponseCreate([]byte(msg), resp.StatusCode)
+	}
+
+	for i, operation := range operations {
+		path, err := batchReferenceString(results, operation.Path)
+
+		if err != nil {
+			return fail(i, operation, ResponseBadRequest(err.Error()))
+		}
+
+		body, err := batchResolve(results, operation.Body)
+
+		if err != nil {
+			return fail(i, operation, ResponseBadRequest(err.Error()))
+		}
+
+		data, _ := json.Marshal(body)
+		operationReq, err := http.NewRequest(strings.ToUpper(operation.Method), path, bytes.NewReader(data))
+
+		if err != nil {
+			return fail(i, operation, ResponseBadRequest(err.Error()))
+		}
+
+		operationReq.RemoteAddr = req.RemoteAddr
+
+		if operation.ContentType != "" {
+			operationReq.Header.Set("Content-Type", operation.ContentType)
+		}
+
+		if operation.IfMatch != "" {
+			operationReq.Header.Set("If-Match", operation.IfMatch)
+		}
+
+		rf, err := RequestFilterInitialize(operationReq, rms)
+
+		if err != nil {
+			return fail(i, operation, ResponseBadRequest(err.Error()))
+		}
+
+		rf.tokenPayload = batch.tokenPayload
+
+		if access, err := rf.CheckAuthorization(operationReq); err != nil {
+			return fail(i, operation, ResponseUnauthorized(err.Error()))
+		} else if !access {
+			return fail(i, operation, ResponseUnauthorized("Explicit Unauthorized"))
+		}
+
+		if rf.entityManager, err = batch.entityManager(rf.entityManager, rf.schemaName); err != nil {
+			return fail(i, operation, ResponseInternalServerError(err.Error()))
+		}
+
+		rf.deferred = &batch.deferred
+		resp := rf.ProcessRequest()
+
+		if resp.StatusCode != http.StatusOK {
+			return fail(i, operation, resp)
+		}
+
+		if operation.Id != "" {
+			obj := map[string]any{}
+			json.Unmarshal(resp.Body, &obj)
+			results[operation.Id] = obj
+		}
+
+		list = append(list, &RufsBatchResult{operation.Id, resp.StatusCode, resp.Header.Get("ETag"), bytes.TrimSpace(resp.Body)})
+	}
+
+	if err := batch.commit(); err != nil {
+		return ResponseInternalServerError(fmt.Sprintf("[RufsMicroService.onRequestBatch] fail to commit : %s", err))
+	}
+
+	for _, fn := range batch.deferred {
+		fn()
+	}
+
+	return ResponseOk(list)
+}
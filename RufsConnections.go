@@ -0,0 +1,226 @@
+package rufsBase
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// RufsActiveSession is one session not revoked and not expired, with the websocket clients connected with its tokens.
+type RufsActiveSession struct {
+	Session        string              `json:"session"`
+	RufsUser       int                 `json:"rufsUser"`
+	UserName       string              `json:"userName"`
+	RufsGroupOwner int                 `json:"rufsGroupOwner"`
+	Ip             string              `json:"ip"`
+	CreatedAt      time.Time           `json:"createdAt"`
+	ExpiresAt      time.Time           `json:"expiresAt"`
+	Connections    []*RufsWsConnection `json:"connections"`
+}
+
+// RufsWsConnection is one websocket client, the subscriptions are the paths that it receive notifications.
+type RufsWsConnection struct {
+	Ip            string    `json:"ip"`
+	ConnectedAt   time.Time `json:"connectedAt"`
+	Subscriptions []string  `json:"subscriptions"`
+}
+
+// SystemMessage is sent by administrators to the websocket clients.
+type SystemMessage struct {
+	Action  string `json:"action"`
+	Message string `json:"message"`
+}
+
+// wsClient is one websocket client copied from the maps guarded by wsMutex, used after the unlock.
+type wsClient struct {
+	tokenString string
+	connection  *wsConn
+	claims      *RufsClaims
+	since       time.Time
+}
+
+func (rms *RufsMicroService) wsDisconnect(tokenString string) {
+	rms.wsMutex.Lock()
+	connection, ok := rms.wsServerConnections[tokenString]
+	delete(rms.wsServerConnections, tokenString)
+	delete(rms.wsServerConnectionsTokens, tokenString)
+	delete(rms.wsServerConnectionsSince, tokenString)
+	rms.wsMutex.Unlock()
+
+	if ok {
+		connection.Close()
+	}
+}
+
+func (rms *RufsMicroService) OnWsClose(connection *websocket.Conn) {
+	rms.wsMutex.Lock()
+	defer rms.wsMutex.Unlock()
+
+	for tokenString, wsServerConnection := range rms.wsServerConnections {
+		if wsServerConnection.Conn == connection {
+			delete(rms.wsServerConnections, tokenString)
+			delete(rms.wsServerConnectionsTokens, tokenString)
+			delete(rms.wsServerConnectionsSince, tokenString)
+		}
+	}
+}
+
+// wsSelect return the websocket clients of the session or of the user, or all when both are empty.
+func (rms *RufsMicroService) wsSelect(session string, userId int) []*wsClient {
+	rms.wsMutex.RLock()
+	defer rms.wsMutex.RUnlock()
+	list := []*wsClient{}
+
+	for tokenString, claims := range rms.wsServerConnectionsTokens {
+		connection, ok := rms.wsServerConnections[tokenString]
+
+		if !ok {
+			continue
+		}
+
+		if (session == "" || claims.Session == session) && (userId == 0 || claims.TokenPayload.Id == userId) {
+			list = append(list, &wsClient{tokenString, connection, claims, rms.wsServerConnectionsSince[tokenString]})
+		}
+	}
+
+	return list
+}
+
+func (rms *RufsMicroService) activeSessions() ([]*RufsActiveSession, error) {
+	sessions, err := rms.sessionFind(map[string]any{"revoked": false})
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	users := map[int]*RufsUser{}
+	list := []*RufsActiveSession{}
+
+	for _, session := range sessions {
+		if session.ExpiresAt.Before(now) {
+			continue
+		}
+
+		user, ok := users[session.RufsUser]
+
+		if !ok {
+			user = &RufsUser{}
+			userMap, err := rms.getEntityManager("rufsUser").FindOne("rufsUser", map[string]any{"id": session.RufsUser})
+
+			if err != nil {
+				return nil, fmt.Errorf("[RufsMicroService.activeSessions] : %s", err)
+			}
+
+			data, _ := json.Marshal(userMap)
+			json.Unmarshal(data, user)
+			users[session.RufsUser] = user
+		}
+
+		activeSession := &RufsActiveSession{Session: session.Token, RufsUser: session.RufsUser, UserName: user.Name, RufsGroupOwner: user.RufsGroupOwner, Ip: session.Ip, CreatedAt: session.CreatedAt, ExpiresAt: session.ExpiresAt, Connections: []*RufsWsConnection{}}
+
+		for _, client := range rms.wsSelect(session.Token, 0) {
+			wsConnection := &RufsWsConnection{Ip: client.connection.RemoteAddr().String(), ConnectedAt: client.since, Subscriptions: []string{}}
+
+			for _, role := range client.claims.Roles {
+				if role.Mask&0x01 != 0 {
+					wsConnection.Subscriptions = append(wsConnection.Subscriptions, role.Path)
+				}
+			}
+
+			activeSession.Connections = append(activeSession.Connections, wsConnection)
+		}
+
+		list = append(list, activeSession)
+	}
+
+	return list, nil
+}
+
+// onRequestActiveSessions let administrators see and control who is logged :
+// GET list the active sessions with its websocket clients, DELETE close the websocket clients of ?session= or ?rufsUser=
+// (also revoking the sessions with &revoke=true) and POST send the body {"message": "...", "session": "...", "rufsUser": id}
+// to the websocket clients, of all when session and rufsUser are omitted.
+func (rms *RufsMicroService) onRequestActiveSessions(req *http.Request) Response {
+	claims, err := rms.authorizationClaims(req)
+
+	if err != nil {
+		return ResponseUnauthorized(fmt.Sprint(err))
+	}
+
+	if !claims.TokenPayload.isAdmin() {
+		return ResponseUnauthorized("[RufsMicroService.onRequestActiveSessions] only administrators can see the active sessions")
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		list, err := rms.activeSessions()
+
+		if err != nil {
+			return ResponseInternalServerError(fmt.Sprint(err))
+		}
+
+		return ResponseOk(list)
+	case http.MethodDelete:
+		session := req.URL.Query().Get("session")
+		userId, _ := strconv.Atoi(req.URL.Query().Get("rufsUser"))
+
+		if session == "" && userId == 0 {
+			return ResponseBadRequest("[RufsMicroService.onRequestActiveSessions] missing parameter 'session' or 'rufsUser'")
+		}
+
+		clients := rms.wsSelect(session, userId)
+
+		for _, client := range clients {
+			rms.wsDisconnect(client.tokenString)
+		}
+
+		if req.URL.Query().Get("revoke") == "true" {
+			if session != "" {
+				err = rms.sessionRevoke(session)
+			} else {
+				err = rms.sessionRevokeUser(userId)
+			}
+
+			if err != nil {
+				return ResponseInternalServerError(fmt.Sprintf("[RufsMicroService.onRequestActiveSessions] : %s", err))
+			}
+		}
+
+		return ResponseOk(map[string]any{"disconnected": len(clients)})
+	case http.MethodPost:
+		messageRequest := struct {
+			Message  string `json:"message"`
+			Session  string `json:"session"`
+			RufsUser int    `json:"rufsUser"`
+		}{}
+
+		if err := json.NewDecoder(req.Body).Decode(&messageRequest); err != nil {
+			return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestActiveSessions] : %s", err))
+		}
+
+		if messageRequest.Message == "" {
+			return ResponseBadRequest("[RufsMicroService.onRequestActiveSessions] missing field 'message'")
+		}
+
+		count := 0
+
+		for _, client := range rms.wsSelect(messageRequest.Session, messageRequest.RufsUser) {
+			if err := client.connection.WriteJSON(SystemMessage{"system", messageRequest.Message}); err != nil {
+				log.Printf("[RufsMicroService.onRequestActiveSessions] fail to send message to %s : %s", client.claims.Name, err)
+				continue
+			}
+
+			count++
+		}
+
+		return ResponseOk(map[string]any{"sent": count})
+	}
+
+	return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestActiveSessions] unsupported method %s", req.Method))
+}
@@ -0,0 +1,47 @@
+package rufsBase
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+)
+
+// responseValidationMode is RUFS_VALIDATE_RESPONSES, "log" to log or "fail" to replace by 500 the CRUD responses that
+// don't match the 200 response of openapi (for development and tests, empty disable the check).
+func responseValidationMode() string {
+	return os.Getenv("RUFS_VALIDATE_RESPONSES")
+}
+
+// responseCheck validate the body of resp against the response schema of the operation. The documents of expand
+// have references that aren't in the schema, then they are ignored.
+func (rf *RequestFilter) responseCheck(resp Response) Response {
+	mode := responseValidationMode()
+
+	if mode == "" || resp.StatusCode != http.StatusOK || rf.parameters["expand"] != nil {
+		return resp
+	}
+
+	schema, err := rf.microService.openapi.getSchema(rf.path, rf.method, "responseObject")
+
+	if err != nil || schema == nil {
+		return resp
+	}
+
+	errors := rf.microService.openapi.validateResponse(schema, resp.Body)
+
+	if len(errors) == 0 {
+		return resp
+	}
+
+	data, _ := json.Marshal(errors)
+	msg := fmt.Sprintf("[RequestFilter.responseCheck] response of %s %s don't match openapi : %s", rf.method, rf.path, data)
+	log.Print(msg)
+
+	if mode == "fail" {
+		return ResponseInternalServerError(msg)
+	}
+
+	return resp
+}
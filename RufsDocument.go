@@ -0,0 +1,297 @@
+package rufsBase
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// rufsExpand is the tree of the parameter expand, ex. "rufsGroupOwner,rufsUser.rufsGroupOwner" is
+// {"rufsGroupOwner": {}, "rufsUser": {"rufsGroupOwner": {}}}, and "*" expand all references of the level.
+type rufsExpand map[string]rufsExpand
+
+var errDocumentUnauthorized = errors.New("unauthorized")
+
+// expandMaxDepth is the limit of levels of expand, RUFS_EXPAND_MAX_DEPTH (default 3).
+func expandMaxDepth() int {
+	if depth, err := strconv.Atoi(os.Getenv("RUFS_EXPAND_MAX_DEPTH")); err == nil && depth > 0 {
+		return depth
+	}
+
+	return 3
+}
+
+func expandParse(value string) (rufsExpand, error) {
+	expand := rufsExpand{}
+	maxDepth := expandMaxDepth()
+
+	for _, path := range strings.Split(value, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+
+		tokens := strings.Split(path, ".")
+
+		if len(tokens) > maxDepth {
+			return nil, fmt.Errorf("[expandParse] %s exceed the maximum depth %d", path, maxDepth)
+		}
+
+		node := expand
+
+		for _, token := range tokens {
+			if token == "" {
+				return nil, fmt.Errorf("[expandParse] invalid expand %s", path)
+			}
+
+			child, ok := node[token]
+
+			if !ok {
+				child = rufsExpand{}
+				node[token] = child
+			}
+
+			node = child
+		}
+	}
+
+	return expand, nil
+}
+
+// expandColumns return the fields of schema needed by the first level of expand.
+func expandColumns(schema *Schema, expand rufsExpand) []string {
+	list := []string{}
+
+	for fieldName, field := range schema.Properties {
+		if _, ok := expand[fieldName]; field.Ref != "" && (ok || expand["*"] != nil) {
+			list = append(list, fieldName)
+		}
+	}
+
+	return list
+}
+
+// parseExpand return the tree of the parameter expand, nil when missing.
+func (rf *RequestFilter) parseExpand() (rufsExpand, error) {
+	value, ok := rf.parameters["expand"]
+
+	if !ok {
+		return nil, nil
+	}
+
+	return expandParse(fmt.Sprint(value))
+}
+
+// documentFilter return the filter of the rows of schemaName embedded in the document, with the user and the
+// transaction of rf.
+func (rf *RequestFilter) documentFilter(schemaName string) *RequestFilter {
+	child := &RequestFilter{microService: rf.microService, tokenPayload: rf.tokenPayload, method: "get", schemaName: schemaName}
+	child.path = "/" + CamelToUnderscore(schemaName)
+	child.entityManager = rf.microService.getEntityManager(schemaName)
+
+	if child.entityManager == rf.microService.getEntityManager(rf.schemaName) {
+		child.entityManager = rf.entityManager
+	}
+
+	return child
+}
+
+// readAllowed check the role of the user in the path of rf, like CheckAuthorization of get.
+func (rf *RequestFilter) readAllowed() bool {
+	if rf.tokenPayload == nil {
+		return false
+	}
+
+	idx := slices.IndexFunc(rf.tokenPayload.Roles, func(e Role) bool { return e.Path == rf.path })
+	return idx >= 0 && rf.tokenPayload.Roles[idx].Mask&1 != 0
+}
+
+// documentFind return the rows with fields, restricted to the tenant of user.
+func (rf *RequestFilter) documentFind(fields map[string]any, limit int) ([]map[string]any, error) {
+	schema, ok := rf.microService.openapi.getSchemaFromSchemas(rf.schemaName)
+
+	if !ok {
+		return nil, fmt.Errorf("[RequestFilter.documentFind] missing schema %s", rf.schemaName)
+	}
+
+	conditions := append(queryConditionsFromFields(fields), rf.tenantConditions()...)
+	query := &RufsQuery{Conditions: append(conditions, rf.softDeleteConditions()...), Sort: schema.PrimaryKeys, Limit: limit}
+	list, _, err := rf.entityManager.Query(rf.schemaName, query)
+	return list, err
+}
+
+// getDocument return one copy of doc with the references of obj expanded : the fields with $ref receive the referenced
+// row (one to one) and the names of dependents (x-document of the field or the name of its schema) receive the rows
+// that reference obj (one to many). Schemas that the user can't read are refused, or ignored by "*".
+func (rf *RequestFilter) getDocument(obj map[string]any, doc map[string]any, expand rufsExpand) (map[string]any, error) {
+	openapi := rf.microService.openapi
+	schema, ok := openapi.getSchemaFromSchemas(rf.schemaName)
+
+	if !ok {
+		return nil, fmt.Errorf("[RequestFilter.getDocument] missing schema %s", rf.schemaName)
+	}
+
+	ret := map[string]any{}
+
+	for fieldName, value := range doc {
+		ret[fieldName] = value
+	}
+
+	dependents := map[string]*Dependent{}
+
+	for _, dependent := range openapi.getDependents(rf.schemaName) {
+		name := dependent.Table
+
+		if field, ok := openapi.getProperty(dependent.Table, dependent.Field); ok && field.Document != "" {
+			name = field.Document
+		}
+
+		if _, ok := dependents[name]; !ok {
+			dependents[name] = dependent
+		}
+	}
+
+	// the names informed by "*" are ignored when unauthorized
+	subtrees := map[string]rufsExpand{}
+	explicitNames := []string{}
+
+	if all, ok := expand["*"]; ok {
+		for fieldName, field := range schema.Properties {
+			if field.Ref != "" {
+				subtrees[fieldName] = all
+			}
+		}
+
+		for name := range dependents {
+			subtrees[name] = all
+		}
+	}
+
+	for name, subtree := range expand {
+		if name != "*" {
+			subtrees[name] = subtree
+			explicitNames = append(explicitNames, name)
+		}
+	}
+
+	names := []string{}
+
+	for name := range subtrees {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		explicit := slices.Contains(explicitNames, name)
+
+		if field, ok := schema.Properties[name]; ok && field.Ref != "" {
+			key, err := openapi.getPrimaryKeyForeign(rf.schemaName, name, obj)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if key == nil || !key.Valid || mapHasNil(key.PrimaryKey) {
+				continue
+			}
+
+			child := rf.documentFilter(OpenApiGetSchemaName(key.Table))
+
+			if !child.readAllowed() {
+				if explicit {
+					return nil, fmt.Errorf("[RequestFilter.getDocument] %w to read %s", errDocumentUnauthorized, child.path)
+				}
+
+				continue
+			}
+
+			list, err := child.documentFind(key.PrimaryKey, 1)
+
+			if err != nil || len(list) == 0 {
+				continue
+			}
+
+			item := child.filterReadable(child.tokenPayload, list[0])
+
+			if ret[name], err = child.getDocument(item, item, subtrees[name]); err != nil {
+				return nil, err
+			}
+		} else if dependent, ok := dependents[name]; ok {
+			child := rf.documentFilter(dependent.Table)
+
+			if !child.readAllowed() {
+				if explicit {
+					return nil, fmt.Errorf("[RequestFilter.getDocument] %w to read %s", errDocumentUnauthorized, child.path)
+				}
+
+				continue
+			}
+
+			description, err := openapi.getForeignKeyDescription(dependent.Table, dependent.Field)
+
+			if err != nil || description == nil {
+				continue
+			}
+
+			fields := map[string]any{}
+
+			for fieldRef, fieldName := range description.FieldsRef {
+				if fieldName, ok := fieldName.(string); ok && !strings.HasPrefix(fieldName, "*") {
+					fields[fieldName] = obj[fieldRef]
+				}
+			}
+
+			if mapHasNil(fields) {
+				continue
+			}
+
+			list, err := child.documentFind(fields, 0)
+
+			if err != nil {
+				return nil, err
+			}
+
+			listOut := make([]map[string]any, 0, len(list))
+
+			for _, item := range list {
+				item = child.filterReadable(child.tokenPayload, item)
+
+				if item, err = child.getDocument(item, item, subtrees[name]); err != nil {
+					return nil, err
+				}
+
+				listOut = append(listOut, item)
+			}
+
+			ret[name] = listOut
+		} else {
+			return nil, fmt.Errorf("[RequestFilter.getDocument] unknown reference %s of %s", name, rf.schemaName)
+		}
+	}
+
+	return ret, nil
+}
+
+// documentResponse return the error of getDocument in one response.
+func documentResponse(err error) Response {
+	if errors.Is(err, errDocumentUnauthorized) {
+		return ResponseUnauthorized(err.Error())
+	}
+
+	return ResponseBadRequest(err.Error())
+}
+
+func mapHasNil(obj map[string]any) bool {
+	for _, value := range obj {
+		if value == nil {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,82 @@
+package rufsBase
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// etag return the version of the stored row, the hash of its content (all fields, also the ones that the user can't read).
+func etag(obj map[string]any) string {
+	data, _ := json.Marshal(jsonDeepCopy(obj))
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagRequired is enabled by RUFS_REQUIRE_IF_MATCH=true, then PUT, PATCH and DELETE of existent rows without If-Match are refused.
+func etagRequired() bool {
+	return os.Getenv("RUFS_REQUIRE_IF_MATCH") == "true"
+}
+
+// responseWithETag return the readable fields of obj with the header ETag.
+func (rf *RequestFilter) responseWithETag(obj map[string]any, statusCode int) Response {
+	resp := ResponseOk(rf.filterReadable(rf.tokenPayload, obj))
+
+	if resp.StatusCode == http.StatusOK {
+		resp.StatusCode = statusCode
+		resp.Header = http.Header{}
+		resp.Header.Set("ETag", etag(obj))
+	}
+
+	return resp
+}
+
+// etagCheck compare If-Match of request with the version of oldObj (nil when the row don't exists), the conflicts
+// return 412 with the current row and its ETag.
+func (rf *RequestFilter) etagCheck(oldObj map[string]any) Response {
+	if rf.ifMatch == "" {
+		if oldObj != nil && etagRequired() {
+			return ResponseCreate([]byte("[RequestFilter.etagCheck] missing header If-Match"), http.StatusPreconditionRequired)
+		}
+
+		return Response{}
+	}
+
+	if oldObj == nil {
+		return ResponseCreate([]byte("[RequestFilter.etagCheck] If-Match of missing register"), http.StatusPreconditionFailed)
+	}
+
+	current := etag(oldObj)
+
+	for _, item := range strings.Split(rf.ifMatch, ",") {
+		item = strings.TrimPrefix(strings.TrimSpace(item), "W/")
+
+		if item == "*" || item == current {
+			return Response{}
+		}
+	}
+
+	return rf.responseWithETag(oldObj, http.StatusPreconditionFailed)
+}
+
+// queryETag add the version of the row to the query by primary key (ex. GET /rest/rufs_group?id=1), that is the read of rufs-crud.
+func (rf *RequestFilter) queryETag(resp Response, list []map[string]any) Response {
+	schema, ok := rf.microService.openapi.getSchemaFromSchemas(rf.schemaName)
+
+	if !ok || len(list) != 1 || len(schema.PrimaryKeys) == 0 || resp.StatusCode != http.StatusOK {
+		return resp
+	}
+
+	for _, fieldName := range schema.PrimaryKeys {
+		if _, ok := rf.parameters[fieldName]; !ok {
+			return resp
+		}
+	}
+
+	resp.Header = http.Header{}
+	resp.Header.Set("ETag", etag(list[0]))
+	return resp
+}
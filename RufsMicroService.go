@@ -5,19 +5,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
-	"regexp"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt"
 	"github.com/gorilla/websocket"
+	"golang.org/x/exp/slices"
 )
 
 type RufsGroupOwner struct {
@@ -71,19 +68,32 @@ type TokenPayload struct {
 type LoginResponse struct {
 	TokenPayload
 	RufsUserPublic
-	JwtHeader string   `json:"jwtHeader"`
-	Title     string   `json:"title"`
-	Openapi   *OpenApi `json:"openapi"`
+	JwtHeader    string   `json:"jwtHeader"`
+	RefreshToken string   `json:"refreshToken"`
+	TotpToken    string   `json:"totpToken,omitempty"`
+	Title        string   `json:"title"`
+	Openapi      *OpenApi `json:"openapi"`
 }
 
 type RufsClaims struct {
 	*jwt.StandardClaims
 	TokenPayload
+	Session string `json:"sid,omitempty"`
+}
+
+func (tokenPayload *TokenPayload) isAdmin() bool {
+	if tokenPayload.RufsGroupOwner != 1 {
+		return false
+	}
+
+	idx := slices.IndexFunc(tokenPayload.Roles, func(e Role) bool { return e.Path == "/rufs_user" })
+	return idx >= 0 && tokenPayload.Roles[idx].Mask&0x1f == 0x1f
 }
 
 type EntityManager interface {
 	Connect() error
 	Find(tableName string, fields map[string]any, orderBy []string) ([]map[string]any, error)
+	Query(tableName string, query *RufsQuery) ([]map[string]any, int, error)
 	FindOne(tableName string, fields map[string]any) (map[string]any, error)
 	Insert(tableName string, obj map[string]any) (map[string]any, error)
 	Update(tableName string, key map[string]any, obj map[string]any) (map[string]any, error)
@@ -102,45 +112,88 @@ type RufsMicroService struct {
 	dbConfig                  *DbConfig
 	checkRufsTables           bool
 	migrationPath             string
+	seedPath                  string
+	migrations                []*RufsMigration
 	Irms                      IRufsMicroService
 	wsServerConnectionsTokens map[string]*RufsClaims
+	wsServerConnectionsSince  map[string]time.Time
 	//dataStoreManager          *DataStoreManager
-	entityManager EntityManager
-	fileDbAdapter *FileDbAdapter
+	entityManager          EntityManager
+	fileDbAdapter          *FileDbAdapter
+	tokenExpiration        time.Duration
+	refreshTokenExpiration time.Duration
+	loginLockout           LoginLockout
+	sessionCache           SessionCache
+	basicAuthCache         BasicAuthCache
+	oidc                   *RufsOidc
+}
+
+// getEntityManager return the file adapter when the table was loaded from file, otherwise the database.
+func (rms *RufsMicroService) getEntityManager(schemaName string) EntityManager {
+	if rms.fileDbAdapter != nil {
+		if rms.fileDbAdapter.hasTable(schemaName) {
+			return rms.fileDbAdapter
+		}
+	}
+
+	return rms.entityManager
 }
 
 func (rms *RufsMicroService) authenticateUser(userName string, userPassword string, remoteAddr string) (*LoginResponse, error) {
-	var entityManager EntityManager
+	entityManager := rms.getEntityManager("rufsUser")
+	time.Sleep(100 * time.Millisecond)
 
-	if _, ok := rms.fileDbAdapter.fileTables["rufsUser"]; ok {
-		entityManager = rms.fileDbAdapter
-	} else {
-		entityManager = rms.entityManager
+	if rms.loginLockout.isLocked(userName) {
+		return nil, errors.New("User temporarily locked by excess of wrong passwords.")
 	}
 
-	time.Sleep(100 * time.Millisecond)
 	user := &RufsUser{}
+	userMap, err := entityManager.FindOne("rufsUser", map[string]any{"name": userName})
 
-	if userMap, err := entityManager.FindOne("rufsUser", map[string]any{"name": userName}); err == nil {
-		data, _ := json.Marshal(userMap)
-
-		if err := json.Unmarshal(data, user); err != nil {
-			UtilsShowJsonUnmarshalError(string(data), err)
-			return nil, err
-		}
-	} else {
+	if err != nil {
 		return nil, fmt.Errorf("[RufsMicroService.authenticateUser] internal error : %s", err)
 	}
 
-	if len(user.Password) > 0 && user.Password != userPassword {
+	if userMap == nil {
+		rms.loginLockout.registerFailure(userName)
 		return nil, errors.New("Don't match user and password.")
 	}
 
+	data, _ := json.Marshal(userMap)
+
+	if err := json.Unmarshal(data, user); err != nil {
+		UtilsShowJsonUnmarshalError(string(data), err)
+		return nil, err
+	}
+
+	match, rehash := passwordCheck(user.Password, userPassword)
+
+	if len(user.Password) == 0 || !match {
+		rms.loginLockout.registerFailure(userName)
+		return nil, errors.New("Don't match user and password.")
+	}
+
+	rms.loginLockout.registerSuccess(userName)
+
+	if rehash {
+		if userMap["password"], err = PasswordHash(userPassword); err != nil {
+			return nil, err
+		}
+
+		if _, err := entityManager.Update("rufsUser", map[string]any{"id": user.Id}, userMap); err != nil {
+			return nil, fmt.Errorf("[RufsMicroService.authenticateUser] fail to store password hash : %s", err)
+		}
+	}
+
+	return rms.buildLoginResponse(user, remoteAddr)
+}
+
+func (rms *RufsMicroService) buildLoginResponse(user *RufsUser, remoteAddr string) (*LoginResponse, error) {
+	userName := user.Name
 	loginResponse := &LoginResponse{TokenPayload: TokenPayload{Ip: remoteAddr, RufsUserProteced: RufsUserProteced{Name: userName}}}
 	loginResponse.Title = user.Name
 	loginResponse.Id = user.Id
 	loginResponse.RufsGroupOwner = user.RufsGroupOwner
-	loginResponse.Roles = user.Roles
 	loginResponse.Routes = user.Routes
 	loginResponse.Path = user.Path
 	loginResponse.Menu = user.Menu
@@ -155,19 +208,71 @@ func (rms *RufsMicroService) authenticateUser(userName string, userPassword stri
 		*/
 	}
 
-	if list, err := entityManager.Find("rufsGroupUser", map[string]any{"rufsUser": loginResponse.Id}, []string{}); err == nil {
-		for _, item := range list {
-			loginResponse.Groups = append(loginResponse.Groups, int(item["rufsGroup"].(int64)))
-		}
-	} else {
-		return nil, fmt.Errorf("[RufsMicroService.authenticateUser] internal error : %s", err)
+	groups, err := rms.userGroups(loginResponse.Id)
+
+	if err != nil {
+		return nil, fmt.Errorf("[RufsMicroService.buildLoginResponse] internal error : %s", err)
 	}
 
+	loginResponse.Groups = groups
+	rolesInherited, err := rms.rolesInherited(user, groups)
+
+	if err != nil {
+		return nil, fmt.Errorf("[RufsMicroService.buildLoginResponse] internal error : %s", err)
+	}
+
+	loginResponse.Roles = rolesInherited.Roles
 	return loginResponse, nil
 }
 
+func (rms *RufsMicroService) loginResponseFillOpenApi(loginResponse *LoginResponse) {
+	if loginResponse.isAdmin() {
+		loginResponse.Openapi = rms.openapi
+	} else {
+		loginResponse.Openapi = rms.openapi.copy(loginResponse.Roles)
+	}
+}
+
 func (rms *RufsMicroService) OnRequest(req *http.Request) Response {
-	if strings.HasSuffix(req.URL.Path, "/login") {
+	if strings.HasSuffix(req.URL.Path, "/oidc/login") {
+		return rms.onRequestOidcLogin(req)
+	} else if strings.HasSuffix(req.URL.Path, "/oidc/callback") {
+		return rms.onRequestOidcCallback(req)
+	} else if strings.HasSuffix(req.URL.Path, "/refresh") {
+		return rms.onRequestRefresh(req)
+	} else if strings.HasSuffix(req.URL.Path, "/logout") {
+		return rms.onRequestLogout(req)
+	} else if strings.HasSuffix(req.URL.Path, "/revoke_sessions") {
+		return rms.onRequestRevokeSessions(req)
+	} else if strings.HasSuffix(req.URL.Path, "/active_sessions") {
+		return rms.onRequestActiveSessions(req)
+	} else if strings.HasSuffix(req.URL.Path, "/login_totp") {
+		return rms.onRequestLoginTotp(req)
+	} else if strings.HasSuffix(req.URL.Path, "/totp/enroll") {
+		return rms.onRequestTotp(req, "enroll")
+	} else if strings.HasSuffix(req.URL.Path, "/totp/activate") {
+		return rms.onRequestTotp(req, "activate")
+	} else if strings.HasSuffix(req.URL.Path, "/totp/disable") {
+		return rms.onRequestTotp(req, "disable")
+	} else if strings.HasSuffix(req.URL.Path, "/change_password") {
+		return rms.onRequestChangePassword(req)
+	} else if strings.HasSuffix(req.URL.Path, "/password_reset") {
+		return rms.onRequestPasswordReset(req)
+	} else if strings.HasSuffix(req.URL.Path, "/password_reset_confirm") {
+		return rms.onRequestPasswordResetConfirm(req)
+	} else if strings.HasSuffix(req.URL.Path, "/audit_log") {
+		return rms.onRequestAuditLog(req)
+	} else if strings.HasSuffix(req.URL.Path, "/migrations") {
+		return rms.onRequestMigrations(req)
+	} else if strings.HasSuffix(req.URL.Path, "/effective_roles") {
+		return rms.onRequestEffectiveRoles(req)
+	} else if strings.HasSuffix(req.URL.Path, "/api_keys") {
+		return rms.onRequestApiKeys(req)
+	} else if strings.HasSuffix(req.URL.Path, "/batch") {
+		return rms.onRequestBatch(req)
+	} else if strings.HasSuffix(req.URL.Path, "/trash") {
+		return rms.onRequestTrash(req)
+	} else if strings.HasSuffix(req.URL.Path, "/login") {
 		loginRequest := map[string]string{}
 		err := json.NewDecoder(req.Body).Decode(&loginRequest)
 
@@ -188,22 +293,23 @@ func (rms *RufsMicroService) OnRequest(req *http.Request) Response {
 		}
 
 		if loginResponse, err := rms.authenticateUser(userName, password, req.RemoteAddr); err == nil {
-			if userName == "admin" {
-				loginResponse.Openapi = rms.openapi
-			} else {
-				//loginResponse.Openapi = rms.openapi.copy(loginResponse.Roles)
-				loginResponse.Openapi = rms.openapi
+			// with two-factor enabled the login response is issued by /login_totp
+			if rms.totpEnabled(loginResponse.Id) {
+				totpToken, err := totpChallenge(loginResponse.Id)
+
+				if err != nil {
+					return ResponseInternalServerError(fmt.Sprint(err))
+				}
+
+				return ResponseOk(map[string]string{"totpToken": totpToken})
 			}
 
-			token := jwt.New(jwt.SigningMethodHS256)
-			token.Claims = &RufsClaims{&jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Minute * 60 * 8).Unix()}, loginResponse.TokenPayload}
-			jwtSecret := os.Getenv("RUFS_JWT_SECRET")
+			rms.loginResponseFillOpenApi(loginResponse)
 
-			if jwtSecret == "" {
-				jwtSecret = "123456"
+			if err := rms.sessionCreate(loginResponse); err != nil {
+				return ResponseInternalServerError(fmt.Sprint(err))
 			}
 
-			loginResponse.JwtHeader, err = token.SignedString([]byte(jwtSecret))
 			return ResponseOk(loginResponse)
 		} else {
 			return ResponseUnauthorized(fmt.Sprint(err))
@@ -227,26 +333,23 @@ func (rms *RufsMicroService) OnRequest(req *http.Request) Response {
 
 func (rms *RufsMicroService) OnWsMessageFromClient(connection *websocket.Conn, tokenString string) {
 	rms.MicroServiceServer.OnWsMessageFromClient(connection, tokenString)
+	claims, err := RufsDecryptToken(tokenString)
 
-	token, err := jwt.ParseWithClaims(tokenString, &RufsClaims{}, func(token *jwt.Token) (interface{}, error) {
-		// Don't forget to validate the alg is what you expect:
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
+	if err == nil && rms.sessionIsRevoked(claims.Session) {
+		err = fmt.Errorf("[RufsMicroService.OnWsMessageFromClient] session revoked")
+		connection.Close()
+	}
 
-		jwtSecret := os.Getenv("RUFS_JWT_SECRET")
+	if err == nil {
+		rms.wsMutex.Lock()
 
-		if jwtSecret == "" {
-			jwtSecret = "123456"
+		if wsServerConnection, ok := rms.wsServerConnections[tokenString]; !ok || wsServerConnection.Conn != connection {
+			rms.wsServerConnectionsSince[tokenString] = time.Now()
+			rms.wsServerConnections[tokenString] = &wsConn{Conn: connection}
 		}
 
-		hmacSampleSecret := []byte(jwtSecret)
-		return hmacSampleSecret, nil
-	})
-
-	if claims, ok := token.Claims.(*RufsClaims); ok && token.Valid {
-		rms.wsServerConnections[tokenString] = connection
 		rms.wsServerConnectionsTokens[tokenString] = claims
+		rms.wsMutex.Unlock()
 		log.Printf("[MicroServiceServer.onWsMessageFromClient] Ok")
 	} else {
 		fmt.Println(err)
@@ -283,15 +386,58 @@ func (rms *RufsMicroService) LoadFileTables() error {
 		return err
 	}
 
-	if err := loadTable("rufsGroupOwner", []map[string]any{defaultGroupOwnerAdmin}); err != nil {
+	if err := loadTable("rufsGroupOwner", emptyList); err != nil {
 		return err
 	}
 
-	if err := loadTable("rufsUser", []map[string]any{defaultUserAdmin}); err != nil {
+	if err := loadTable("rufsUser", emptyList); err != nil {
 		return err
 	}
 
-	return nil
+	if err := loadTable("rufsSession", emptyList); err != nil {
+		return err
+	}
+
+	if err := loadTable("rufsApiKey", emptyList); err != nil {
+		return err
+	}
+
+	if err := loadTable("rufsIdentity", emptyList); err != nil {
+		return err
+	}
+
+	if err := loadTable("rufsAuditLog", emptyList); err != nil {
+		return err
+	}
+
+	if err := loadTable("rufsPasswordReset", emptyList); err != nil {
+		return err
+	}
+
+	if err := loadTable("rufsTotp", emptyList); err != nil {
+		return err
+	}
+
+	return rms.seed()
+}
+
+// UtilsToInt convert numbers from database drivers (int64) and from json decoding (float64).
+func UtilsToInt(value any) int {
+	switch v := value.(type) {
+	case int:
+		return v
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	case string:
+		ret, _ := strconv.Atoi(v)
+		return ret
+	}
+
+	return 0
 }
 
 func UtilsShowJsonUnmarshalError(str string, err error) {
@@ -350,7 +496,7 @@ func (rms *RufsMicroService) Listen() error {
 			return nil
 		}
 
-		for _, name := range []string{"rufsGroupOwner", "rufsUser", "rufsGroup", "rufsGroupUser"} {
+		for _, name := range []string{"rufsGroupOwner", "rufsUser", "rufsGroup", "rufsGroupUser", "rufsSession", "rufsApiKey", "rufsIdentity", "rufsAuditLog", "rufsPasswordReset", "rufsTotp"} {
 			if _, ok := rms.openapi.Components.Schemas[name]; !ok {
 				schema := openapiRufs.Components.Schemas[name]
 
@@ -360,131 +506,32 @@ func (rms *RufsMicroService) Listen() error {
 			}
 		}
 
-		if response, _ := rms.entityManager.FindOne("rufsGroupOwner", map[string]any{"name": "ADMIN"}); response == nil {
-			if _, err := rms.entityManager.Insert("rufsGroupOwner", defaultGroupOwnerAdmin); err != nil {
-				return err
-			}
-		}
-
-		if response, _ := rms.entityManager.FindOne("rufsUser", map[string]any{"name": "admin"}); response == nil {
-			if _, err := rms.entityManager.Insert("rufsUser", defaultUserAdmin); err != nil {
-				return err
-			}
-		}
-
 		return nil
 	}
 
-	execMigrations := func() error {
-		getVersion := func(name string) (int, error) {
-			regExp := regexp.MustCompile(`(\d{1,3})\.(\d{1,3})\.(\d{1,3})`)
-			regExpResult := regExp.FindStringSubmatch(name)
-
-			if len(regExpResult) != 4 {
-				return 0, fmt.Errorf(`Missing valid version in name %s`, name)
-			}
-
-			version, _ := strconv.Atoi(fmt.Sprintf(`%03s%03s%03s`, regExpResult[1], regExpResult[2], regExpResult[3]))
-			return version, nil
-		}
-
-		migrate := func(fileName string) error {
-			file, err := os.Open(filepath.Join(rms.migrationPath, fileName)) //`${this.config.migrationPath}/${fileName}`, "utf8"
-
-			if err != nil {
-				return err
-			}
-
-			defer file.Close()
-			fileData, err := ioutil.ReadAll(file)
-
-			if err != nil {
-				return err
-			}
-
-			text := string(fileData)
-			list := strings.Split(text, "--split")
-
-			for _, sql := range list {
-				_, err := rms.entityManager.(*DbClientSql).client.Exec(sql)
-
-				if err != nil {
-					return err
-				}
-			}
-
-			newVersion, err := getVersion(fileName)
-
-			if err != nil {
-				return err
-			}
-
-			rms.openapi.Info.Version = fmt.Sprintf(`%d.%d.%d`, ((newVersion/1000)/1000)%1000, (newVersion/1000)%1000, newVersion%1000)
-			return err
-		}
-
-		if rms.migrationPath == "" {
-			rms.migrationPath = fmt.Sprintf(`./rufs-%s-es6/sql`, rms.appName)
-		}
-
-		if _, err := os.Stat(rms.migrationPath); errors.Is(err, os.ErrNotExist) {
-			return nil
-		}
-
-		oldVersion, err := getVersion(rms.openapi.Info.Version)
-
-		if err != nil {
-			return err
-		}
-
-		files, err := ioutil.ReadDir(rms.migrationPath)
-
-		if err != nil {
-			return err
-		}
-
-		list := []string{}
-
-		for _, fileInfo := range files {
-			version, err := getVersion(fileInfo.Name())
+	rms.wsServerConnectionsTokens = make(map[string]*RufsClaims)
+	rms.wsServerConnectionsSince = make(map[string]time.Time)
 
-			if err != nil {
-				return err
-			}
+	if rms.tokenExpiration == 0 {
+		rms.tokenExpiration = 8 * time.Hour
 
-			if version > oldVersion {
-				list = append(list, fileInfo.Name())
-			}
+		if duration, err := time.ParseDuration(os.Getenv("RUFS_JWT_EXPIRATION")); err == nil {
+			rms.tokenExpiration = duration
 		}
+	}
 
-		sort.Slice(list, func(i, j int) bool {
-			versionI, _ := getVersion(list[i])
-			versionJ, _ := getVersion(list[j])
-			return versionI < versionJ
-		})
+	if rms.refreshTokenExpiration == 0 {
+		rms.refreshTokenExpiration = 30 * 24 * time.Hour
 
-		for _, fileName := range list {
-			if err := migrate(fileName); err != nil {
-				return err
-			}
+		if duration, err := time.ParseDuration(os.Getenv("RUFS_REFRESH_TOKEN_EXPIRATION")); err == nil {
+			rms.refreshTokenExpiration = duration
 		}
-
-		rms.entityManager.UpdateOpenApi(rms.openapi, FillOpenApiOptions{requestBodyContentType: rms.requestBodyContentType})
-		return rms.StoreOpenApi("")
 	}
 
-	if err := json.Unmarshal([]byte(defaultGroupOwnerAdminStr), &defaultGroupOwnerAdmin); err != nil {
-		UtilsShowJsonUnmarshalError(defaultGroupOwnerAdminStr, err)
-		return err
+	if rms.oidc == nil {
+		rms.oidc = RufsOidcFromEnv()
 	}
 
-	if err := json.Unmarshal([]byte(defaultUserAdminStr), &defaultUserAdmin); err != nil {
-		UtilsShowJsonUnmarshalError(defaultUserAdminStr, err)
-		return err
-	}
-
-	rms.wsServerConnectionsTokens = make(map[string]*RufsClaims)
-
 	if rms.appName == "" {
 		rms.appName = "base"
 	}
@@ -527,16 +574,32 @@ func (rms *RufsMicroService) Listen() error {
 
 	rms.openapi.FillOpenApi(FillOpenApiOptions{schemas: openapiRufs.Components.Schemas, requestBodyContentType: rms.requestBodyContentType, security: map[string][]string{"jwt": {}}})
 
-	if err := execMigrations(); err != nil {
+	if os.Getenv("RUFS_MIGRATION_DRY_RUN") == "true" {
+		// only report the pending migrations, without start the service
+		return rms.migrate(true)
+	}
+
+	if err := rms.migrate(false); err != nil {
 		return err
 	}
 
-	rms.Irms.LoadFileTables()
+	if dbClientSql, ok := rms.entityManager.(*DbClientSql); ok {
+		if err := dbClientSql.rowLevelSecurityUpdate(rms.openapi); err != nil {
+			return err
+		}
+	}
+
+	if err := rms.Irms.LoadFileTables(); err != nil {
+		return err
+	}
 
 	if err := RequestFilterUpdateRufsServices(rms.entityManager, rms.openapi); err != nil {
 		return err
 	}
 
+	rms.trashPurgeStart()
+	rms.sessionPurgeStart()
+
 	if err := rms.MicroServiceServer.Listen(); err != nil {
 		return err
 	}
@@ -549,19 +612,20 @@ var rufsMicroServiceOpenApiStr string = `{
 		"schemas": {
 			"rufsGroupOwner": {
 				"properties": {
-					"id":   {"type": "integer", "x-identityGeneration": "BY DEFAULT"},
-					"name": {"nullable": false, "unique": true}
+					"id":    {"type": "integer", "x-identityGeneration": "BY DEFAULT"},
+					"name":  {"nullable": false, "unique": true},
+					"roles": {"type": "array", "nullable": true, "items": {"properties": {"path": {"type": "string"}, "mask": {"type": "integer"}}}, "x-writeMask": 128}
 				},
 				"x-primaryKeys": ["id"]
 			},
 			"rufsUser": {
 				"properties": {
 					"id":             {"type": "integer", "x-identityGeneration": "BY DEFAULT"},
-					"rufsGroupOwner": {"type": "integer", "nullable": false, "$ref": "#/components/schemas/rufsGroupOwner"},
+					"rufsGroupOwner": {"type": "integer", "nullable": false, "$ref": "#/components/schemas/rufsGroupOwner", "x-writeMask": 128},
 					"name":           {"maxLength": 32, "nullable": false, "unique": true},
-					"password":       {"nullable": false},
+					"password":       {"nullable": false, "writeOnly": true, "format": "password"},
 					"path":           {},
-					"roles":          {"type": "array", "items": {"properties": {"name": {"type": "string"}, "mask": {"type": "integer"}}}},
+					"roles":          {"type": "array", "items": {"properties": {"path": {"type": "string"}, "mask": {"type": "integer"}}}, "x-writeMask": 128},
 					"routes":         {"type": "array", "items": {"properties": {"path": {"type": "string"}, "controller": {"type": "string"}, "templateUrl": {"type": "string"}}}},
 					"menu":           {"type": "object", "properties": {"menu": {"type": "string"}, "label": {"type": "string"}, "path": {"type": "string"}}}
 				},
@@ -570,8 +634,9 @@ var rufsMicroServiceOpenApiStr string = `{
 			},
 			"rufsGroup": {
 				"properties": {
-					"id":   {"type": "integer", "x-identityGeneration": "BY DEFAULT"},
-					"name": {"nullable": false, "unique": true}
+					"id":    {"type": "integer", "x-identityGeneration": "BY DEFAULT"},
+					"name":  {"nullable": false, "unique": true},
+					"roles": {"type": "array", "nullable": true, "items": {"properties": {"path": {"type": "string"}, "mask": {"type": "integer"}}}, "x-writeMask": 128}
 				},
 				"x-primaryKeys": ["id"]
 			},
@@ -582,13 +647,87 @@ var rufsMicroServiceOpenApiStr string = `{
 				},
 				"x-primaryKeys": ["rufsUser", "rufsGroup"],
 				"x-uniqueKeys":  {}
+			},
+			"rufsSession": {
+				"properties": {
+					"id":           {"type": "integer", "x-identityGeneration": "BY DEFAULT"},
+					"token":        {"maxLength": 32, "nullable": false, "unique": true},
+					"rufsUser":     {"type": "integer", "nullable": false, "$ref": "#/components/schemas/rufsUser"},
+					"refreshToken": {"maxLength": 64, "nullable": false, "writeOnly": true},
+					"ip":           {"nullable": true},
+					"createdAt":    {"type": "string", "format": "date-time", "nullable": false},
+					"expiresAt":    {"type": "string", "format": "date-time", "nullable": false},
+					"revoked":      {"type": "boolean", "nullable": false}
+				},
+				"x-primaryKeys": ["id"]
+			},
+			"rufsApiKey": {
+				"properties": {
+					"id":         {"type": "integer", "x-identityGeneration": "BY DEFAULT"},
+					"rufsUser":   {"type": "integer", "nullable": false, "$ref": "#/components/schemas/rufsUser"},
+					"name":       {"maxLength": 64, "nullable": true},
+					"prefix":     {"maxLength": 16, "nullable": false},
+					"keyHash":    {"maxLength": 64, "nullable": false, "unique": true, "writeOnly": true},
+					"roles":      {"type": "array", "items": {"properties": {"path": {"type": "string"}, "mask": {"type": "integer"}}}},
+					"createdAt":  {"type": "string", "format": "date-time", "nullable": false},
+					"expiresAt":  {"type": "string", "format": "date-time", "nullable": true},
+					"lastUsedAt": {"type": "string", "format": "date-time", "nullable": true},
+					"revoked":    {"type": "boolean", "nullable": false}
+				},
+				"x-primaryKeys": ["id"]
+			},
+			"rufsIdentity": {
+				"properties": {
+					"id":       {"type": "integer", "x-identityGeneration": "BY DEFAULT"},
+					"rufsUser": {"type": "integer", "nullable": false, "$ref": "#/components/schemas/rufsUser"},
+					"issuer":   {"maxLength": 255, "nullable": false},
+					"subject":  {"maxLength": 255, "nullable": false}
+				},
+				"x-primaryKeys": ["id"],
+				"x-uniqueKeys":  {"issuerSubject": ["issuer", "subject"]}
+			},
+			"rufsAuditLog": {
+				"properties": {
+					"id":         {"type": "integer", "x-identityGeneration": "BY DEFAULT"},
+					"rufsUser":   {"type": "integer", "nullable": true},
+					"userName":   {"maxLength": 32, "nullable": true},
+					"ip":         {"nullable": true},
+					"createdAt":  {"type": "string", "format": "date-time", "nullable": false},
+					"schemaName": {"maxLength": 64, "nullable": false},
+					"action":     {"maxLength": 16, "nullable": false},
+					"primaryKey": {"type": "object", "nullable": true},
+					"changes":    {"type": "object", "nullable": true}
+				},
+				"x-primaryKeys": ["id"]
+			},
+			"rufsPasswordReset": {
+				"properties": {
+					"id":        {"type": "integer", "x-identityGeneration": "BY DEFAULT"},
+					"rufsUser":  {"type": "integer", "nullable": false, "$ref": "#/components/schemas/rufsUser"},
+					"tokenHash": {"maxLength": 64, "nullable": false, "unique": true, "writeOnly": true},
+					"createdAt": {"type": "string", "format": "date-time", "nullable": false},
+					"expiresAt": {"type": "string", "format": "date-time", "nullable": false},
+					"usedAt":    {"type": "string", "format": "date-time", "nullable": true}
+				},
+				"x-primaryKeys": ["id"]
+			},
+			"rufsTotp": {
+				"properties": {
+					"id":            {"type": "integer", "x-identityGeneration": "BY DEFAULT"},
+					"rufsUser":      {"type": "integer", "nullable": false, "unique": true, "$ref": "#/components/schemas/rufsUser"},
+					"secret":        {"maxLength": 64, "nullable": false, "writeOnly": true},
+					"enabled":       {"type": "boolean", "nullable": false},
+					"recoveryCodes": {"type": "array", "nullable": true, "writeOnly": true, "items": {"type": "string"}},
+					"lastUsedStep":  {"type": "integer", "nullable": false},
+					"createdAt":     {"type": "string", "format": "date-time", "nullable": false}
+				},
+				"x-primaryKeys": ["id"]
 			}
 		}
 	}
 }
 `
 var defaultGroupOwnerAdminStr string = `{"name": "admin"}`
-var defaultGroupOwnerAdmin map[string]any = map[string]any{}
 
 var defaultUserAdminStr string = `{
 		"name": "admin",
@@ -625,4 +764,3 @@ var defaultUserAdminStr string = `{
 			}
 		]
 	}`
-var defaultUserAdmin map[string]any = map[string]any{}
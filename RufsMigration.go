@@ -0,0 +1,556 @@
+package rufsBase
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RufsMigration is one change of database, from one file of migrationPath (<version>[-name].sql, with the optional
+// revert in <version>[-name].down.sql, statements separated by "--split") or registered in code by MigrationRegister.
+// Each migration runs in one transaction and is registered in the table rufs.schema_migrations.
+type RufsMigration struct {
+	Version  string
+	Name     string
+	Up       func(tx *sql.Tx) error
+	Down     func(tx *sql.Tx) error
+	source   string
+	checksum string
+}
+
+type RufsMigrationStatus struct {
+	Version   string     `json:"version"`
+	Name      string     `json:"name"`
+	Source    string     `json:"source"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"appliedAt"`
+	Checksum  string     `json:"checksum"`
+	Modified  bool       `json:"modified"`
+	Missing   bool       `json:"missing"`
+	HasDown   bool       `json:"hasDown"`
+}
+
+type rufsMigrationApplied struct {
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+// migrationLockKey is the key of the postgres advisory lock that serializes the migrations of replicas.
+const migrationLockKey = 0x72756673
+
+var migrationVersionRegExp = regexp.MustCompile(`(\d{1,3})\.(\d{1,3})\.(\d{1,3})`)
+
+// migrationVersion return the version found in name as one comparable number.
+func migrationVersion(name string) (int, error) {
+	regExpResult := migrationVersionRegExp.FindStringSubmatch(name)
+
+	if len(regExpResult) != 4 {
+		return 0, fmt.Errorf(`Missing valid version in name %s`, name)
+	}
+
+	version, _ := strconv.Atoi(fmt.Sprintf(`%03s%03s%03s`, regExpResult[1], regExpResult[2], regExpResult[3]))
+	return version, nil
+}
+
+func migrationVersionString(version int) string {
+	return fmt.Sprintf(`%d.%d.%d`, ((version/1000)/1000)%1000, (version/1000)%1000, version%1000)
+}
+
+func migrationExecSql(text string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, statement := range strings.Split(text, "--split") {
+			if strings.TrimSpace(statement) == "" {
+				continue
+			}
+
+			if _, err := tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// rufsMigrations change the rufs tables of databases created by older versions. They are registered with the prefix
+// "rufs-", out of the versions of application, and applied before the migrations of application.
+var rufsMigrations = []*RufsMigration{
+	migrationRufs("rufs-1", "roles of rufsGroup and rufsGroupOwner", `ALTER TABLE IF EXISTS rufs_group ADD COLUMN IF NOT EXISTS roles jsonb array
+--split
+ALTER TABLE IF EXISTS rufs_group_owner ADD COLUMN IF NOT EXISTS roles jsonb array`),
+}
+
+func migrationRufs(version string, name string, text string) *RufsMigration {
+	sum := sha256.Sum256([]byte(text))
+	return &RufsMigration{Version: version, Name: name, Up: migrationExecSql(text), source: "rufs", checksum: hex.EncodeToString(sum[:])}
+}
+
+// MigrationRegister add one migration written in Go, applied in version order with the files of migrationPath.
+// The code can't be hashed, then the checksum comes from version and name : changes of applied Go migrations must
+// be registered with one new version.
+func (rms *RufsMicroService) MigrationRegister(migration *RufsMigration) {
+	migration.source = "go"
+	rms.migrations = append(rms.migrations, migration)
+}
+
+// migrationLockTimeout is the maximum wait for the lock of migrations held by other replica (default 5m).
+func migrationLockTimeout() time.Duration {
+	if duration, err := time.ParseDuration(os.Getenv("RUFS_MIGRATION_LOCK_TIMEOUT")); err == nil && duration > 0 {
+		return duration
+	}
+
+	return 5 * time.Minute
+}
+
+// migrationList return the migrations of files and of code, sorted by version.
+func (rms *RufsMicroService) migrationList() ([]*RufsMigration, error) {
+	if rms.migrationPath == "" {
+		rms.migrationPath = fmt.Sprintf(`./rufs-%s-es6/sql`, rms.appName)
+	}
+
+	byVersion := map[int]*RufsMigration{}
+
+	for _, migration := range rms.migrations {
+		version, err := migrationVersion(migration.Version)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := byVersion[version]; ok {
+			return nil, fmt.Errorf("[RufsMicroService.migrationList] duplicated migration version %s", migration.Version)
+		}
+
+		if migration.Up == nil {
+			return nil, fmt.Errorf("[RufsMicroService.migrationList] missing up of migration %s", migration.Version)
+		}
+
+		migration.Version = migrationVersionString(version)
+		sum := sha256.Sum256([]byte("go " + migration.Version + " " + migration.Name))
+		migration.checksum = hex.EncodeToString(sum[:])
+		byVersion[version] = migration
+	}
+
+	fileNames, err := filepath.Glob(filepath.Join(rms.migrationPath, "*.sql"))
+
+	if err != nil {
+		return nil, fmt.Errorf("[RufsMicroService.migrationList] : %s", err)
+	}
+
+	sort.Strings(fileNames)
+	downs := map[int]string{}
+
+	for _, fileName := range fileNames {
+		baseName := filepath.Base(fileName)
+		version, err := migrationVersion(baseName)
+
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := os.ReadFile(fileName)
+
+		if err != nil {
+			return nil, fmt.Errorf("[RufsMicroService.migrationList] : %s", err)
+		}
+
+		if strings.HasSuffix(baseName, ".down.sql") {
+			downs[version] = string(data)
+			continue
+		}
+
+		if _, ok := byVersion[version]; ok {
+			return nil, fmt.Errorf("[RufsMicroService.migrationList] duplicated migration version %s in %s", migrationVersionString(version), baseName)
+		}
+
+		sum := sha256.Sum256(data)
+		byVersion[version] = &RufsMigration{Version: migrationVersionString(version), Name: strings.TrimSuffix(baseName, ".sql"), Up: migrationExecSql(string(data)), source: "file", checksum: hex.EncodeToString(sum[:])}
+	}
+
+	for version, text := range downs {
+		migration, ok := byVersion[version]
+
+		if !ok || migration.source != "file" {
+			return nil, fmt.Errorf("[RufsMicroService.migrationList] missing migration of down file of version %s", migrationVersionString(version))
+		}
+
+		migration.Down = migrationExecSql(text)
+	}
+
+	list := []*RufsMigration{}
+
+	for _, migration := range byVersion {
+		list = append(list, migration)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		versionI, _ := migrationVersion(list[i].Version)
+		versionJ, _ := migrationVersion(list[j].Version)
+		return versionI < versionJ
+	})
+
+	return list, nil
+}
+
+func (rms *RufsMicroService) migrationDb() (*DbClientSql, error) {
+	dbClientSql, ok := rms.entityManager.(*DbClientSql)
+
+	if !ok {
+		return nil, errors.New("[RufsMicroService.migrationDb] migrations require one sql database")
+	}
+
+	return dbClientSql, nil
+}
+
+// migrationApplied return the registered migrations by version, creating the table when missing.
+func migrationApplied(ctx context.Context, conn *sql.Conn) (map[string]*rufsMigrationApplied, error) {
+	if _, err := conn.ExecContext(ctx, `CREATE SCHEMA IF NOT EXISTS rufs; CREATE TABLE IF NOT EXISTS rufs.schema_migrations (version varchar(16) PRIMARY KEY, name varchar(255) NOT NULL, checksum varchar(64) NOT NULL, applied_at timestamptz NOT NULL DEFAULT now(), execution_ms integer NOT NULL DEFAULT 0)`); err != nil {
+		return nil, fmt.Errorf("[migrationApplied] fail to create table rufs.schema_migrations : %s", err)
+	}
+
+	rows, err := conn.QueryContext(ctx, `SELECT version, name, checksum, applied_at FROM rufs.schema_migrations`)
+
+	if err != nil {
+		return nil, fmt.Errorf("[migrationApplied] : %s", err)
+	}
+
+	defer rows.Close()
+	applied := map[string]*rufsMigrationApplied{}
+
+	for rows.Next() {
+		var version string
+		item := &rufsMigrationApplied{}
+
+		if err := rows.Scan(&version, &item.name, &item.checksum, &item.appliedAt); err != nil {
+			return nil, fmt.Errorf("[migrationApplied] : %s", err)
+		}
+
+		applied[version] = item
+	}
+
+	return applied, rows.Err()
+}
+
+// migrationLock return one connection holding the advisory lock, released by the returned function.
+func (rms *RufsMicroService) migrationLock(ctx context.Context) (*sql.Conn, func(), error) {
+	dbClientSql, err := rms.migrationDb()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := dbClientSql.client.Conn(ctx)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("[RufsMicroService.migrationLock] : %s", err)
+	}
+
+	log.Printf("[RufsMicroService.migrationLock] waiting lock of migrations ...")
+	// pg_advisory_lock would wait forever for one replica stuck in its migrations
+	deadline := time.Now().Add(migrationLockTimeout())
+
+	for locked := false; !locked; {
+		if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, migrationLockKey).Scan(&locked); err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("[RufsMicroService.migrationLock] : %s", err)
+		}
+
+		if !locked && time.Now().After(deadline) {
+			conn.Close()
+			return nil, nil, fmt.Errorf("[RufsMicroService.migrationLock] timeout of %s waiting the lock of migrations held by other process", migrationLockTimeout())
+		}
+
+		if !locked {
+			time.Sleep(time.Second)
+		}
+	}
+	// the migrations see and write the rows of all tenants, also in tables with FORCE ROW LEVEL SECURITY
+	if _, err := conn.ExecContext(ctx, `SELECT set_config('rufs.group_owner', '1', false)`); err != nil {
+		conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+		conn.Close()
+		return nil, nil, fmt.Errorf("[RufsMicroService.migrationLock] : %s", err)
+	}
+
+	release := func() {
+		// the connection returns to the pool without the access to all tenants
+		conn.ExecContext(context.Background(), `SELECT set_config('rufs.group_owner', '', false)`)
+		conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+		conn.Close()
+	}
+
+	return conn, release, nil
+}
+
+// migrationRun execute one migration (up or down) in one transaction, together with the update of rufs.schema_migrations.
+func migrationRun(ctx context.Context, conn *sql.Conn, migration *RufsMigration, up bool) error {
+	start := time.Now()
+	tx, err := conn.BeginTx(ctx, nil)
+
+	if err != nil {
+		return fmt.Errorf("[migrationRun] : %s", err)
+	}
+
+	exec := migration.Up
+
+	if !up {
+		exec = migration.Down
+	}
+
+	if err = exec(tx); err == nil {
+		if up {
+			_, err = tx.ExecContext(ctx, `INSERT INTO rufs.schema_migrations (version, name, checksum, execution_ms) VALUES ($1, $2, $3, $4)`, migration.Version, migration.Name, migration.checksum, time.Since(start).Milliseconds())
+		} else {
+			_, err = tx.ExecContext(ctx, `DELETE FROM rufs.schema_migrations WHERE version = $1`, migration.Version)
+		}
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("[migrationRun] migration %s (%s) failed and was rolled back : %s", migration.Version, migration.Name, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("[migrationRun] migration %s (%s) : %s", migration.Version, migration.Name, err)
+	}
+
+	log.Printf("[migrationRun] migration %s (%s) %s in %s", migration.Version, migration.Name, map[bool]string{true: "applied", false: "reverted"}[up], time.Since(start))
+	return nil
+}
+
+// migrationUpdateOpenApi set the openapi version to the last applied migration and reload the tables of database.
+func (rms *RufsMicroService) migrationUpdateOpenApi(ctx context.Context, conn *sql.Conn) error {
+	applied, err := migrationApplied(ctx, conn)
+
+	if err != nil {
+		return err
+	}
+
+	lastVersion := 0
+
+	for version := range applied {
+		if value, _ := migrationVersion(version); value > lastVersion {
+			lastVersion = value
+		}
+	}
+
+	rms.openapi.Info.Version = migrationVersionString(lastVersion)
+	rms.entityManager.UpdateOpenApi(rms.openapi, FillOpenApiOptions{requestBodyContentType: rms.requestBodyContentType})
+	return rms.StoreOpenApi("")
+}
+
+// migrate apply the pending migrations, refusing to start when one applied file was changed.
+// Databases migrated by older versions (without rufs.schema_migrations) register the migrations until openapi.info.version as applied.
+// With dryRun the pending migrations are only reported.
+func (rms *RufsMicroService) migrate(dryRun bool) error {
+	migrations, err := rms.migrationList()
+
+	if err != nil {
+		return err
+	}
+	// without migrations of application, only the sql databases have the migrations of rufs tables
+	if _, errDb := rms.migrationDb(); errDb != nil && len(migrations) == 0 {
+		return nil
+	}
+
+	ctx := context.Background()
+	conn, release, err := rms.migrationLock(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer release()
+	applied, err := migrationApplied(ctx, conn)
+
+	if err != nil {
+		return err
+	}
+
+	if oldVersion, err := migrationVersion(rms.openapi.Info.Version); len(applied) == 0 && err == nil && oldVersion > 0 {
+		for _, migration := range migrations {
+			if version, _ := migrationVersion(migration.Version); version <= oldVersion {
+				log.Printf("[RufsMicroService.migrate] registering migration %s (%s) as applied by openapi version %s", migration.Version, migration.Name, rms.openapi.Info.Version)
+
+				if _, err := conn.ExecContext(ctx, `INSERT INTO rufs.schema_migrations (version, name, checksum) VALUES ($1, $2, $3)`, migration.Version, migration.Name, migration.checksum); err != nil {
+					return fmt.Errorf("[RufsMicroService.migrate] : %s", err)
+				}
+
+				applied[migration.Version] = &rufsMigrationApplied{name: migration.Name, checksum: migration.checksum}
+			}
+		}
+	}
+
+	pending := []*RufsMigration{}
+
+	for _, migration := range rufsMigrations {
+		if _, ok := applied[migration.Version]; !ok {
+			pending = append(pending, migration)
+		}
+	}
+
+	for _, migration := range migrations {
+		if item, ok := applied[migration.Version]; !ok {
+			pending = append(pending, migration)
+		} else if item.checksum != migration.checksum {
+			return fmt.Errorf("[RufsMicroService.migrate] migration %s (%s) was changed after applied, create one new migration instead", migration.Version, migration.Name)
+		}
+	}
+
+	for _, migration := range pending {
+		log.Printf("[RufsMicroService.migrate] pending migration %s (%s, %s)", migration.Version, migration.Name, migration.source)
+	}
+
+	if dryRun || len(pending) == 0 {
+		return nil
+	}
+
+	for _, migration := range pending {
+		if err := migrationRun(ctx, conn, migration, true); err != nil {
+			return err
+		}
+	}
+
+	return rms.migrationUpdateOpenApi(ctx, conn)
+}
+
+// MigrationDown revert, in reverse order, the applied migrations with version greater than targetVersion.
+func (rms *RufsMicroService) MigrationDown(targetVersion string) error {
+	target, err := migrationVersion(targetVersion)
+
+	if err != nil {
+		return err
+	}
+
+	migrations, err := rms.migrationList()
+
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	conn, release, err := rms.migrationLock(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer release()
+	applied, err := migrationApplied(ctx, conn)
+
+	if err != nil {
+		return err
+	}
+
+	list := []*RufsMigration{}
+
+	for _, migration := range migrations {
+		if version, _ := migrationVersion(migration.Version); version > target && applied[migration.Version] != nil {
+			if migration.Down == nil {
+				return fmt.Errorf("[RufsMicroService.MigrationDown] missing down of migration %s (%s)", migration.Version, migration.Name)
+			}
+
+			list = append([]*RufsMigration{migration}, list...)
+		}
+	}
+
+	for _, migration := range list {
+		if err := migrationRun(ctx, conn, migration, false); err != nil {
+			return err
+		}
+	}
+
+	return rms.migrationUpdateOpenApi(ctx, conn)
+}
+
+// MigrationStatus report the known migrations, the applied ones that are missing in files and code,
+// and the applied files changed after applied.
+func (rms *RufsMicroService) MigrationStatus() ([]*RufsMigrationStatus, error) {
+	migrations, err := rms.migrationList()
+
+	if err != nil {
+		return nil, err
+	}
+
+	dbClientSql, err := rms.migrationDb()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	conn, err := dbClientSql.client.Conn(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("[RufsMicroService.MigrationStatus] : %s", err)
+	}
+
+	defer conn.Close()
+	applied, err := migrationApplied(ctx, conn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	list := []*RufsMigrationStatus{}
+
+	for _, migration := range append(append([]*RufsMigration{}, rufsMigrations...), migrations...) {
+		status := &RufsMigrationStatus{Version: migration.Version, Name: migration.Name, Source: migration.source, Checksum: migration.checksum, HasDown: migration.Down != nil}
+
+		if item, ok := applied[migration.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = &item.appliedAt
+			status.Modified = item.checksum != migration.checksum
+			delete(applied, migration.Version)
+		}
+
+		list = append(list, status)
+	}
+
+	for version, item := range applied {
+		appliedAt := item.appliedAt
+		list = append(list, &RufsMigrationStatus{Version: version, Name: item.name, Applied: true, AppliedAt: &appliedAt, Checksum: item.checksum, Missing: true})
+	}
+
+	// the migrations of rufs tables, without version of application, stay in the top
+	sort.SliceStable(list, func(i, j int) bool {
+		versionI, _ := migrationVersion(list[i].Version)
+		versionJ, _ := migrationVersion(list[j].Version)
+		return versionI < versionJ
+	})
+
+	return list, nil
+}
+
+// onRequestMigrations return to administrators the status of migrations.
+func (rms *RufsMicroService) onRequestMigrations(req *http.Request) Response {
+	claims, err := rms.authorizationClaims(req)
+
+	if err != nil {
+		return ResponseUnauthorized(fmt.Sprint(err))
+	}
+
+	if !claims.TokenPayload.isAdmin() {
+		return ResponseUnauthorized("[RufsMicroService.onRequestMigrations] only administrators can see the migrations")
+	}
+
+	list, err := rms.MigrationStatus()
+
+	if err != nil {
+		return ResponseInternalServerError(fmt.Sprint(err))
+	}
+
+	return ResponseOk(list)
+}
@@ -0,0 +1,529 @@
+package rufsBase
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"golang.org/x/exp/slices"
+)
+
+// RufsOidc login the users in one external OpenID Connect provider, with the authorization code flow and PKCE.
+// The redirectUri is a page of webapp that forward the query parameters "code" and "state" to <apiPath>/oidc/callback.
+type RufsOidc struct {
+	Issuer            string
+	ClientId          string
+	ClientSecret      string
+	RedirectUri       string
+	Scopes            []string
+	UserClaim         string // claim used as rufsUser.name of new users, default "preferred_username"
+	GroupsClaim       string // claim with the names of rufsGroup of the user, default "groups"
+	GroupOwnerClaim   string // claim with the name of rufsGroupOwner of the user, optional
+	DefaultGroupOwner string // name of rufsGroupOwner when GroupOwnerClaim is missing
+	DefaultRoles      []Role // roles of the new users
+	httpClient        *http.Client
+	discovery         *oidcDiscovery
+	keys              map[string]*rsa.PublicKey
+	keysLoadedAt      time.Time
+	pending           map[string]*oidcPending
+	mutex             sync.Mutex
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type oidcPending struct {
+	nonce        string
+	codeVerifier string
+	expiresAt    time.Time
+}
+
+// RufsIdentity link one subject of the provider to the rufsUser.
+type RufsIdentity struct {
+	Id       int    `json:"id"`
+	RufsUser int    `json:"rufsUser"`
+	Issuer   string `json:"issuer"`
+	Subject  string `json:"subject"`
+}
+
+// RufsOidcFromEnv return nil when RUFS_OIDC_ISSUER is not defined.
+func RufsOidcFromEnv() *RufsOidc {
+	issuer := os.Getenv("RUFS_OIDC_ISSUER")
+
+	if issuer == "" {
+		return nil
+	}
+
+	oidc := &RufsOidc{Issuer: issuer, ClientId: os.Getenv("RUFS_OIDC_CLIENT_ID"), ClientSecret: os.Getenv("RUFS_OIDC_CLIENT_SECRET"), RedirectUri: os.Getenv("RUFS_OIDC_REDIRECT_URI")}
+	oidc.UserClaim = os.Getenv("RUFS_OIDC_USER_CLAIM")
+	oidc.GroupsClaim = os.Getenv("RUFS_OIDC_GROUPS_CLAIM")
+	oidc.GroupOwnerClaim = os.Getenv("RUFS_OIDC_GROUP_OWNER_CLAIM")
+	oidc.DefaultGroupOwner = os.Getenv("RUFS_OIDC_DEFAULT_GROUP_OWNER")
+
+	if scopes := os.Getenv("RUFS_OIDC_SCOPES"); scopes != "" {
+		oidc.Scopes = strings.Fields(scopes)
+	}
+
+	return oidc
+}
+
+func (oidc *RufsOidc) client() *http.Client {
+	if oidc.httpClient == nil {
+		oidc.httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return oidc.httpClient
+}
+
+func (oidc *RufsOidc) getJson(url string, obj any) error {
+	resp, err := oidc.client().Get(url)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d from %s", resp.StatusCode, url)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(obj)
+}
+
+func (oidc *RufsOidc) discover() (*oidcDiscovery, error) {
+	oidc.mutex.Lock()
+	defer oidc.mutex.Unlock()
+
+	if oidc.discovery != nil {
+		return oidc.discovery, nil
+	}
+
+	discovery := &oidcDiscovery{}
+
+	if err := oidc.getJson(strings.TrimSuffix(oidc.Issuer, "/")+"/.well-known/openid-configuration", discovery); err != nil {
+		return nil, fmt.Errorf("[RufsOidc.discover] : %s", err)
+	}
+
+	if discovery.Issuer != oidc.Issuer {
+		return nil, fmt.Errorf("[RufsOidc.discover] issuer %s don't match the configured %s", discovery.Issuer, oidc.Issuer)
+	}
+
+	oidc.discovery = discovery
+	return discovery, nil
+}
+
+// publicKey return the key of kid, reloading the jwks when the provider rotate its keys. The unknown kids reload
+// the jwks at most once per minute, and the request to provider is made without the mutex.
+func (oidc *RufsOidc) publicKey(kid string) (*rsa.PublicKey, error) {
+	discovery, err := oidc.discover()
+
+	if err != nil {
+		return nil, err
+	}
+
+	oidc.mutex.Lock()
+
+	if key, ok := oidc.keys[kid]; ok {
+		oidc.mutex.Unlock()
+		return key, nil
+	}
+
+	if time.Since(oidc.keysLoadedAt) < time.Minute {
+		oidc.mutex.Unlock()
+		return nil, fmt.Errorf("[RufsOidc.publicKey] missing key %s", kid)
+	}
+
+	oidc.keysLoadedAt = time.Now()
+	oidc.mutex.Unlock()
+	jwks := struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}{}
+
+	if err := oidc.getJson(discovery.JwksUri, &jwks); err != nil {
+		return nil, fmt.Errorf("[RufsOidc.publicKey] : %s", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+
+	for _, item := range jwks.Keys {
+		if item.Kty != "RSA" {
+			continue
+		}
+
+		n, errN := base64.RawURLEncoding.DecodeString(item.N)
+		e, errE := base64.RawURLEncoding.DecodeString(item.E)
+
+		if errN != nil || errE != nil {
+			continue
+		}
+
+		keys[item.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	oidc.mutex.Lock()
+	oidc.keys = keys
+	oidc.mutex.Unlock()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("[RufsOidc.publicKey] missing key %s", kid)
+}
+
+// authorizationUrl return the url of provider where the browser must be redirected to login.
+func (oidc *RufsOidc) authorizationUrl() (string, error) {
+	discovery, err := oidc.discover()
+
+	if err != nil {
+		return "", err
+	}
+
+	state := rufsSessionRandomString(16)
+	pending := &oidcPending{nonce: rufsSessionRandomString(16), codeVerifier: rufsSessionRandomString(32), expiresAt: time.Now().Add(10 * time.Minute)}
+	codeChallenge := sha256.Sum256([]byte(pending.codeVerifier))
+	scopes := oidc.Scopes
+
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	}
+
+	oidc.mutex.Lock()
+
+	if oidc.pending == nil {
+		oidc.pending = map[string]*oidcPending{}
+	}
+
+	for key, item := range oidc.pending {
+		if time.Now().After(item.expiresAt) {
+			delete(oidc.pending, key)
+		}
+	}
+
+	oidc.pending[state] = pending
+	oidc.mutex.Unlock()
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", oidc.ClientId)
+	query.Set("redirect_uri", oidc.RedirectUri)
+	query.Set("scope", strings.Join(scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", pending.nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(codeChallenge[:]))
+	query.Set("code_challenge_method", "S256")
+	separator := "?"
+
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// exchange change the code by the tokens of provider and return the claims of the validated id_token.
+func (oidc *RufsOidc) exchange(code string, state string) (jwt.MapClaims, error) {
+	oidc.mutex.Lock()
+	pending, ok := oidc.pending[state]
+	delete(oidc.pending, state)
+	oidc.mutex.Unlock()
+
+	if !ok || time.Now().After(pending.expiresAt) {
+		return nil, fmt.Errorf("[RufsOidc.exchange] invalid or expired state")
+	}
+
+	discovery, err := oidc.discover()
+
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", oidc.RedirectUri)
+	form.Set("client_id", oidc.ClientId)
+	form.Set("code_verifier", pending.codeVerifier)
+
+	if oidc.ClientSecret != "" {
+		form.Set("client_secret", oidc.ClientSecret)
+	}
+
+	resp, err := oidc.client().PostForm(discovery.TokenEndpoint, form)
+
+	if err != nil {
+		return nil, fmt.Errorf("[RufsOidc.exchange] : %s", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("[RufsOidc.exchange] token endpoint returned status %d", resp.StatusCode)
+	}
+
+	tokenResponse := struct {
+		IdToken string `json:"id_token"`
+	}{}
+
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
+		return nil, fmt.Errorf("[RufsOidc.exchange] : %s", err)
+	}
+
+	claims := jwt.MapClaims{}
+
+	_, err = jwt.ParseWithClaims(tokenResponse.IdToken, claims, func(token *jwt.Token) (any, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		return oidc.publicKey(kid)
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("[RufsOidc.exchange] invalid id_token : %s", err)
+	}
+
+	if !claims.VerifyIssuer(oidc.Issuer, true) || !claims.VerifyAudience(oidc.ClientId, true) || !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, fmt.Errorf("[RufsOidc.exchange] id_token with invalid iss, aud or exp")
+	}
+
+	if nonce, _ := claims["nonce"].(string); nonce != pending.nonce {
+		return nil, fmt.Errorf("[RufsOidc.exchange] id_token with invalid nonce")
+	}
+
+	if subject, _ := claims["sub"].(string); subject == "" {
+		return nil, fmt.Errorf("[RufsOidc.exchange] id_token without sub")
+	}
+
+	return claims, nil
+}
+
+func oidcClaimStrings(claims jwt.MapClaims, name string) []string {
+	list := []string{}
+
+	switch value := claims[name].(type) {
+	case string:
+		list = append(list, value)
+	case []any:
+		for _, item := range value {
+			if str, ok := item.(string); ok {
+				list = append(list, str)
+			}
+		}
+	}
+
+	return list
+}
+
+func (rms *RufsMicroService) oidcFindIdByName(schemaName string, name string) (int, error) {
+	obj, err := rms.getEntityManager(schemaName).FindOne(schemaName, map[string]any{"name": name})
+
+	if err != nil || obj == nil {
+		return 0, err
+	}
+
+	return UtilsToInt(obj["id"]), nil
+}
+
+// oidcUser return the rufsUser linked to the subject of claims, creating it at the first login,
+// and synchronize its rufsGroupOwner and rufsGroup with the claims.
+func (rms *RufsMicroService) oidcUser(claims jwt.MapClaims) (*RufsUser, error) {
+	oidc := rms.oidc
+	subject, _ := claims["sub"].(string)
+	userEntityManager := rms.getEntityManager("rufsUser")
+	identityEntityManager := rms.getEntityManager("rufsIdentity")
+	groupOwnerName := oidc.DefaultGroupOwner
+
+	if oidc.GroupOwnerClaim != "" {
+		if list := oidcClaimStrings(claims, oidc.GroupOwnerClaim); len(list) > 0 {
+			groupOwnerName = list[0]
+		}
+	}
+
+	groupOwner, err := rms.oidcFindIdByName("rufsGroupOwner", groupOwnerName)
+
+	if err != nil {
+		return nil, fmt.Errorf("[RufsMicroService.oidcUser] : %s", err)
+	}
+
+	var userMap map[string]any
+	identity, err := identityEntityManager.FindOne("rufsIdentity", map[string]any{"issuer": oidc.Issuer, "subject": subject})
+
+	if err != nil {
+		return nil, fmt.Errorf("[RufsMicroService.oidcUser] : %s", err)
+	}
+
+	if identity != nil {
+		if userMap, err = userEntityManager.FindOne("rufsUser", map[string]any{"id": identity["rufsUser"]}); err != nil || userMap == nil {
+			return nil, fmt.Errorf("[RufsMicroService.oidcUser] missing rufsUser of identity %s : %v", subject, err)
+		}
+
+		if groupOwner > 0 && UtilsToInt(userMap["rufsGroupOwner"]) != groupOwner {
+			userMap["rufsGroupOwner"] = groupOwner
+
+			if _, err := userEntityManager.Update("rufsUser", map[string]any{"id": userMap["id"]}, userMap); err != nil {
+				return nil, fmt.Errorf("[RufsMicroService.oidcUser] : %s", err)
+			}
+		}
+	} else {
+		userClaim := oidc.UserClaim
+
+		if userClaim == "" {
+			userClaim = "preferred_username"
+		}
+
+		name, _ := claims[userClaim].(string)
+
+		if name == "" {
+			name = subject
+		}
+
+		if groupOwner == 0 {
+			return nil, fmt.Errorf("[RufsMicroService.oidcUser] missing rufsGroupOwner '%s' for user %s", groupOwnerName, name)
+		}
+		// a local user with the same name must be linked by the administrator, otherwise the provider could take over it
+		if obj, err := userEntityManager.FindOne("rufsUser", map[string]any{"name": name}); err != nil || obj != nil {
+			return nil, fmt.Errorf("[RufsMicroService.oidcUser] user name %s already in use by other account : %v", name, err)
+		}
+
+		roles := oidc.DefaultRoles
+
+		if roles == nil {
+			roles = []Role{}
+		}
+		// empty password disable the local login
+		if userMap, err = userEntityManager.Insert("rufsUser", map[string]any{"name": name, "rufsGroupOwner": groupOwner, "password": "", "roles": roles, "routes": []Route{}, "menu": map[string]any{}}); err != nil {
+			return nil, fmt.Errorf("[RufsMicroService.oidcUser] : %s", err)
+		}
+
+		if _, err := identityEntityManager.Insert("rufsIdentity", map[string]any{"rufsUser": userMap["id"], "issuer": oidc.Issuer, "subject": subject}); err != nil {
+			return nil, fmt.Errorf("[RufsMicroService.oidcUser] : %s", err)
+		}
+	}
+
+	user := &RufsUser{}
+	data, _ := json.Marshal(userMap)
+
+	if err := json.Unmarshal(data, user); err != nil {
+		UtilsShowJsonUnmarshalError(string(data), err)
+		return nil, err
+	}
+
+	groupsClaim := oidc.GroupsClaim
+
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+	// groups unknown by rufs are ignored
+	groups := []int{}
+
+	for _, name := range oidcClaimStrings(claims, groupsClaim) {
+		if id, err := rms.oidcFindIdByName("rufsGroup", name); err != nil {
+			return nil, fmt.Errorf("[RufsMicroService.oidcUser] : %s", err)
+		} else if id > 0 {
+			groups = append(groups, id)
+		}
+	}
+
+	groupUserEntityManager := rms.getEntityManager("rufsGroupUser")
+	list, err := groupUserEntityManager.Find("rufsGroupUser", map[string]any{"rufsUser": user.Id}, []string{})
+
+	if err != nil {
+		return nil, fmt.Errorf("[RufsMicroService.oidcUser] : %s", err)
+	}
+
+	for _, item := range list {
+		if idx := slices.Index(groups, UtilsToInt(item["rufsGroup"])); idx >= 0 {
+			groups = slices.Delete(groups, idx, idx+1)
+		} else if err := groupUserEntityManager.DeleteOne("rufsGroupUser", map[string]any{"rufsUser": user.Id, "rufsGroup": item["rufsGroup"]}); err != nil {
+			return nil, fmt.Errorf("[RufsMicroService.oidcUser] : %s", err)
+		}
+	}
+
+	for _, group := range groups {
+		if _, err := groupUserEntityManager.Insert("rufsGroupUser", map[string]any{"rufsUser": user.Id, "rufsGroup": group}); err != nil {
+			return nil, fmt.Errorf("[RufsMicroService.oidcUser] : %s", err)
+		}
+	}
+
+	return user, nil
+}
+
+func (rms *RufsMicroService) onRequestOidcLogin(req *http.Request) Response {
+	if rms.oidc == nil {
+		return ResponseBadRequest("[RufsMicroService.onRequestOidcLogin] OpenID Connect is not configured")
+	}
+
+	url, err := rms.oidc.authorizationUrl()
+
+	if err != nil {
+		return ResponseInternalServerError(fmt.Sprint(err))
+	}
+
+	return ResponseOk(map[string]string{"url": url})
+}
+
+func (rms *RufsMicroService) onRequestOidcCallback(req *http.Request) Response {
+	if rms.oidc == nil {
+		return ResponseBadRequest("[RufsMicroService.onRequestOidcCallback] OpenID Connect is not configured")
+	}
+
+	query := req.URL.Query()
+
+	if errorCode := query.Get("error"); errorCode != "" {
+		return ResponseUnauthorized(fmt.Sprintf("[RufsMicroService.onRequestOidcCallback] %s : %s", errorCode, query.Get("error_description")))
+	}
+
+	code := query.Get("code")
+	state := query.Get("state")
+
+	if code == "" || state == "" {
+		return ResponseBadRequest("[RufsMicroService.onRequestOidcCallback] missing parameters 'code' and 'state'")
+	}
+
+	claims, err := rms.oidc.exchange(code, state)
+
+	if err != nil {
+		return ResponseUnauthorized(fmt.Sprint(err))
+	}
+
+	user, err := rms.oidcUser(claims)
+
+	if err != nil {
+		return ResponseUnauthorized(fmt.Sprint(err))
+	}
+
+	loginResponse, err := rms.buildLoginResponse(user, req.RemoteAddr)
+
+	if err != nil {
+		return ResponseInternalServerError(fmt.Sprint(err))
+	}
+
+	rms.loginResponseFillOpenApi(loginResponse)
+
+	if err := rms.sessionCreate(loginResponse); err != nil {
+		return ResponseInternalServerError(fmt.Sprint(err))
+	}
+
+	return ResponseOk(loginResponse)
+}
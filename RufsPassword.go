@@ -0,0 +1,380 @@
+package rufsBase
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Passwords of rufsUser are stored as bcrypt hashes of the value sent by the client (the md5 of the typed password).
+// Old databases have the value stored in plain, it is accepted once and replaced by the hash.
+func PasswordHash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+
+	if err != nil {
+		return "", fmt.Errorf("[PasswordHash] : %s", err)
+	}
+
+	return string(hash), nil
+}
+
+func passwordIsHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// passwordCheck return if password match the stored value and if stored value must be rehashed.
+func passwordCheck(stored string, password string) (match bool, rehash bool) {
+	if passwordIsHash(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil, false
+	}
+
+	match = stored == password
+	return match, match
+}
+
+type loginFailure struct {
+	count       int
+	lockedUntil time.Time
+}
+
+// LoginLockout block the user name after maxFailures wrong passwords in sequence.
+type LoginLockout struct {
+	maxFailures int
+	duration    time.Duration
+	failures    map[string]*loginFailure
+	mutex       sync.Mutex
+}
+
+func (ll *LoginLockout) isLocked(userName string) bool {
+	ll.mutex.Lock()
+	defer ll.mutex.Unlock()
+
+	if failure, ok := ll.failures[userName]; ok {
+		return time.Now().Before(failure.lockedUntil)
+	}
+
+	return false
+}
+
+func (ll *LoginLockout) registerFailure(userName string) {
+	ll.mutex.Lock()
+	defer ll.mutex.Unlock()
+
+	if ll.failures == nil {
+		ll.failures = map[string]*loginFailure{}
+	}
+
+	if ll.maxFailures == 0 {
+		ll.maxFailures = 5
+	}
+
+	if ll.duration == 0 {
+		ll.duration = 15 * time.Minute
+	}
+
+	failure, ok := ll.failures[userName]
+
+	if !ok {
+		failure = &loginFailure{}
+		ll.failures[userName] = failure
+	}
+
+	failure.count++
+
+	if failure.count >= ll.maxFailures {
+		failure.count = 0
+		failure.lockedUntil = time.Now().Add(ll.duration)
+	}
+}
+
+func (ll *LoginLockout) registerSuccess(userName string) {
+	ll.mutex.Lock()
+	defer ll.mutex.Unlock()
+	delete(ll.failures, userName)
+}
+
+type basicAuthEntry struct {
+	userName     string
+	tokenPayload TokenPayload
+	checkedAt    time.Time
+}
+
+// BasicAuthCache keep for ttl (default 30s) the users authenticated by http basic, that send the password in every
+// request, to avoid the delay and the bcrypt of authenticateUser in each one. The key is the hash of name and password.
+type BasicAuthCache struct {
+	ttl     time.Duration
+	entries map[string]*basicAuthEntry
+	mutex   sync.Mutex
+}
+
+func (bc *BasicAuthCache) get(userName string, password string) *TokenPayload {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	if entry, ok := bc.entries[rufsSessionHash(userName+"\x00"+password)]; ok && time.Since(entry.checkedAt) < bc.ttl {
+		tokenPayload := entry.tokenPayload
+		return &tokenPayload
+	}
+
+	return nil
+}
+
+func (bc *BasicAuthCache) register(userName string, password string, tokenPayload *TokenPayload) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	if bc.entries == nil {
+		bc.entries = map[string]*basicAuthEntry{}
+	}
+
+	if bc.ttl == 0 {
+		bc.ttl = 30 * time.Second
+	}
+
+	if len(bc.entries) > 1000 {
+		for key, entry := range bc.entries {
+			if time.Since(entry.checkedAt) >= bc.ttl {
+				delete(bc.entries, key)
+			}
+		}
+	}
+
+	bc.entries[rufsSessionHash(userName+"\x00"+password)] = &basicAuthEntry{userName, *tokenPayload, time.Now()}
+}
+
+// remove forget the credentials of user, after the change of its password.
+func (bc *BasicAuthCache) remove(userName string) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	for key, entry := range bc.entries {
+		if entry.userName == userName {
+			delete(bc.entries, key)
+		}
+	}
+}
+
+var passwordCommonList []string = []string{"123456", "12345678", "123456789", "1234567890", "password", "password1", "qwerty", "qwerty123", "abc123", "111111", "000000", "admin", "admin123", "senha", "senha123", "iloveyou", "welcome"}
+
+// passwordPolicyCheck refuse weak passwords. The webapp send the md5 of the typed password (32 characters), then the
+// minimum length is effective only for clients that send the plain password (ex. scripts), and for the webapp it must be
+// checked before the md5. The user name and the common passwords are refused in both forms.
+func passwordPolicyCheck(userName string, password string) error {
+	md5Hex := func(str string) string {
+		sum := md5.Sum([]byte(str))
+		return hex.EncodeToString(sum[:])
+	}
+
+	minLength := 8
+
+	if value, err := strconv.Atoi(os.Getenv("RUFS_PASSWORD_MIN_LENGTH")); err == nil {
+		minLength = value
+	}
+
+	if len(password) < minLength {
+		return fmt.Errorf("[passwordPolicyCheck] password must have at least %d characters", minLength)
+	}
+
+	lowerCase := strings.ToLower(password)
+
+	for _, weak := range append([]string{strings.ToLower(userName)}, passwordCommonList...) {
+		if lowerCase == weak || lowerCase == md5Hex(weak) {
+			return fmt.Errorf("[passwordPolicyCheck] password is too common or equal to the user name")
+		}
+	}
+
+	return nil
+}
+
+// RufsPasswordReset is one token issued by administrators to the user define a new password, used only once.
+type RufsPasswordReset struct {
+	Id        int        `json:"id"`
+	RufsUser  int        `json:"rufsUser"`
+	TokenHash string     `json:"tokenHash"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt"`
+}
+
+// passwordStore check the policy and store the hash of password in the rufsUser of userId.
+// Hashes are refused, they would skip the policy.
+func (rms *RufsMicroService) passwordStore(userId int, password string) error {
+	if passwordIsHash(password) {
+		return fmt.Errorf("[RufsMicroService.passwordStore] the new password must be informed, not its hash")
+	}
+
+	entityManager := rms.getEntityManager("rufsUser")
+	userMap, err := entityManager.FindOne("rufsUser", map[string]any{"id": userId})
+
+	if err != nil || userMap == nil {
+		return fmt.Errorf("[RufsMicroService.passwordStore] missing rufsUser %d : %v", userId, err)
+	}
+
+	userName, _ := userMap["name"].(string)
+
+	if err := passwordPolicyCheck(userName, password); err != nil {
+		return err
+	}
+
+	if userMap["password"], err = PasswordHash(password); err != nil {
+		return err
+	}
+
+	if _, err := entityManager.Update("rufsUser", map[string]any{"id": userId}, userMap); err != nil {
+		return fmt.Errorf("[RufsMicroService.passwordStore] : %s", err)
+	}
+
+	rms.loginLockout.registerSuccess(userName)
+	rms.basicAuthCache.remove(userName)
+	return nil
+}
+
+// onRequestChangePassword change the password of the logged user, closing its other sessions.
+func (rms *RufsMicroService) onRequestChangePassword(req *http.Request) Response {
+	claims, err := rms.authorizationClaims(req)
+
+	if err != nil {
+		return ResponseUnauthorized(fmt.Sprint(err))
+	}
+
+	changeRequest := map[string]string{}
+
+	if err := json.NewDecoder(req.Body).Decode(&changeRequest); err != nil {
+		return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestChangePassword] : %s", err))
+	}
+
+	if changeRequest["password"] == "" || changeRequest["newPassword"] == "" {
+		return ResponseBadRequest("[RufsMicroService.onRequestChangePassword] missing fields 'password' and 'newPassword'")
+	}
+	// the current password is checked by authenticateUser, subject to lockout
+	if _, err := rms.authenticateUser(claims.TokenPayload.Name, changeRequest["password"], req.RemoteAddr); err != nil {
+		return ResponseUnauthorized(fmt.Sprint(err))
+	}
+
+	if err := rms.passwordStore(claims.TokenPayload.Id, changeRequest["newPassword"]); err != nil {
+		return ResponseBadRequest(fmt.Sprint(err))
+	}
+
+	sessions, err := rms.sessionFind(map[string]any{"rufsUser": claims.TokenPayload.Id})
+
+	if err != nil {
+		return ResponseInternalServerError(fmt.Sprint(err))
+	}
+
+	others := []*RufsSession{}
+
+	for _, session := range sessions {
+		if session.Token != claims.Session {
+			others = append(others, session)
+		}
+	}
+
+	if err := rms.sessionRevokeList(others); err != nil {
+		return ResponseInternalServerError(fmt.Sprint(err))
+	}
+
+	return ResponseOk(map[string]any{})
+}
+
+// onRequestPasswordReset issue to administrators one reset token of the user, valid for 24 hours.
+func (rms *RufsMicroService) onRequestPasswordReset(req *http.Request) Response {
+	claims, err := rms.authorizationClaims(req)
+
+	if err != nil {
+		return ResponseUnauthorized(fmt.Sprint(err))
+	}
+
+	if !claims.TokenPayload.isAdmin() {
+		return ResponseUnauthorized("[RufsMicroService.onRequestPasswordReset] only administrators can reset passwords")
+	}
+
+	resetRequest := map[string]int{}
+
+	if err := json.NewDecoder(req.Body).Decode(&resetRequest); err != nil {
+		return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestPasswordReset] : %s", err))
+	}
+
+	userId, ok := resetRequest["rufsUser"]
+
+	if !ok {
+		return ResponseBadRequest("[RufsMicroService.onRequestPasswordReset] missing field 'rufsUser'")
+	}
+
+	if userMap, err := rms.getEntityManager("rufsUser").FindOne("rufsUser", map[string]any{"id": userId}); err != nil || userMap == nil {
+		return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestPasswordReset] missing rufsUser %d : %v", userId, err))
+	}
+
+	token := rufsSessionRandomString(32)
+	now := time.Now()
+	passwordReset := &RufsPasswordReset{RufsUser: userId, TokenHash: rufsSessionHash(token), CreatedAt: now, ExpiresAt: now.Add(24 * time.Hour)}
+	obj := map[string]any{"rufsUser": passwordReset.RufsUser, "tokenHash": passwordReset.TokenHash, "createdAt": passwordReset.CreatedAt, "expiresAt": passwordReset.ExpiresAt, "usedAt": nil}
+
+	if _, err := rms.getEntityManager("rufsPasswordReset").Insert("rufsPasswordReset", obj); err != nil {
+		return ResponseInternalServerError(fmt.Sprintf("[RufsMicroService.onRequestPasswordReset] : %s", err))
+	}
+
+	return ResponseOk(map[string]any{"token": token, "expiresAt": passwordReset.ExpiresAt})
+}
+
+// onRequestPasswordResetConfirm define the new password with one reset token, closing all sessions of the user.
+func (rms *RufsMicroService) onRequestPasswordResetConfirm(req *http.Request) Response {
+	confirmRequest := map[string]string{}
+
+	if err := json.NewDecoder(req.Body).Decode(&confirmRequest); err != nil {
+		return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestPasswordResetConfirm] : %s", err))
+	}
+
+	if confirmRequest["token"] == "" || confirmRequest["newPassword"] == "" {
+		return ResponseBadRequest("[RufsMicroService.onRequestPasswordResetConfirm] missing fields 'token' and 'newPassword'")
+	}
+
+	entityManager := rms.getEntityManager("rufsPasswordReset")
+	obj, err := entityManager.FindOne("rufsPasswordReset", map[string]any{"tokenHash": rufsSessionHash(confirmRequest["token"])})
+
+	if err != nil {
+		return ResponseInternalServerError(fmt.Sprintf("[RufsMicroService.onRequestPasswordResetConfirm] : %s", err))
+	}
+
+	passwordReset := &RufsPasswordReset{}
+	data, _ := json.Marshal(obj)
+
+	if err := json.Unmarshal(data, passwordReset); obj == nil || err != nil {
+		return ResponseUnauthorized("[RufsMicroService.onRequestPasswordResetConfirm] invalid token")
+	}
+
+	now := time.Now()
+
+	if passwordReset.UsedAt != nil || now.After(passwordReset.ExpiresAt) {
+		return ResponseUnauthorized("[RufsMicroService.onRequestPasswordResetConfirm] token expired or already used")
+	}
+
+	// the token is claimed by the conditional update, only one of concurrent requests find it unused
+	if _, err := entityManager.Update("rufsPasswordReset", map[string]any{"id": passwordReset.Id, "usedAt": nil}, map[string]any{"usedAt": now}); err != nil {
+		return ResponseUnauthorized("[RufsMicroService.onRequestPasswordResetConfirm] token expired or already used")
+	}
+
+	if err := rms.passwordStore(passwordReset.RufsUser, confirmRequest["newPassword"]); err != nil {
+		// the token remain valid for one new password that follows the policy
+		if _, errRelease := entityManager.Update("rufsPasswordReset", map[string]any{"id": passwordReset.Id}, map[string]any{"usedAt": nil}); errRelease != nil {
+			log.Printf("[RufsMicroService.onRequestPasswordResetConfirm] fail to release token : %s", errRelease)
+		}
+
+		return ResponseBadRequest(fmt.Sprint(err))
+	}
+
+	if err := rms.sessionRevokeUser(passwordReset.RufsUser); err != nil {
+		return ResponseInternalServerError(fmt.Sprint(err))
+	}
+
+	return ResponseOk(map[string]any{})
+}
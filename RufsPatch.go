@@ -0,0 +1,317 @@
+package rufsBase
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Content types of partial updates accepted by PUT and PATCH, the result is computed against the stored row.
+const (
+	ContentTypeMergePatch = "application/merge-patch+json"
+	ContentTypeJsonPatch  = "application/json-patch+json"
+)
+
+// JsonPatchOperation is one operation of RFC 6902.
+type JsonPatchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	From  string `json:"from,omitempty"`
+	Value any    `json:"value,omitempty"`
+}
+
+// mergePatch apply patch to target as RFC 7396 : null remove the member, objects are merged recursively and
+// any other value replace the target.
+func mergePatch(target any, patch any) any {
+	patchMap, ok := patch.(map[string]any)
+
+	if !ok {
+		return patch
+	}
+
+	targetMap, ok := target.(map[string]any)
+
+	if !ok {
+		targetMap = map[string]any{}
+	}
+
+	for name, value := range patchMap {
+		if value == nil {
+			delete(targetMap, name)
+		} else {
+			targetMap[name] = mergePatch(targetMap[name], value)
+		}
+	}
+
+	return targetMap
+}
+
+func jsonPointerParse(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("[jsonPointerParse] invalid pointer %s", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+
+	return tokens, nil
+}
+
+func jsonPointerIndex(list []any, token string, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return len(list), nil
+	}
+
+	idx, err := strconv.Atoi(token)
+	max := len(list) - 1
+
+	if allowEnd {
+		max = len(list)
+	}
+
+	if err != nil || idx < 0 || idx > max || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("[jsonPointerIndex] invalid index %s", token)
+	}
+
+	return idx, nil
+}
+
+func jsonPointerGet(doc any, tokens []string) (any, error) {
+	for _, token := range tokens {
+		switch node := doc.(type) {
+		case map[string]any:
+			value, ok := node[token]
+
+			if !ok {
+				return nil, fmt.Errorf("[jsonPointerGet] missing member %s", token)
+			}
+
+			doc = value
+		case []any:
+			idx, err := jsonPointerIndex(node, token, false)
+
+			if err != nil {
+				return nil, err
+			}
+
+			doc = node[idx]
+		default:
+			return nil, fmt.Errorf("[jsonPointerGet] can't find %s in scalar value", token)
+		}
+	}
+
+	return doc, nil
+}
+
+// jsonPointerAdd return doc with value in the location of tokens, inserted in arrays when replace is false.
+func jsonPointerAdd(doc any, tokens []string, value any, replace bool) (any, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	token := tokens[0]
+
+	switch node := doc.(type) {
+	case map[string]any:
+		child, ok := node[token]
+
+		if len(tokens) == 1 {
+			if replace && !ok {
+				return nil, fmt.Errorf("[jsonPointerAdd] missing member %s", token)
+			}
+
+			node[token] = value
+			return node, nil
+		}
+
+		if !ok {
+			return nil, fmt.Errorf("[jsonPointerAdd] missing member %s", token)
+		}
+
+		child, err := jsonPointerAdd(child, tokens[1:], value, replace)
+		node[token] = child
+		return node, err
+	case []any:
+		idx, err := jsonPointerIndex(node, token, len(tokens) == 1 && !replace)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(tokens) > 1 {
+			node[idx], err = jsonPointerAdd(node[idx], tokens[1:], value, replace)
+			return node, err
+		}
+
+		if replace {
+			node[idx] = value
+			return node, nil
+		}
+
+		node = append(node, nil)
+		copy(node[idx+1:], node[idx:])
+		node[idx] = value
+		return node, nil
+	}
+
+	return nil, fmt.Errorf("[jsonPointerAdd] can't add %s in scalar value", token)
+}
+
+// jsonPointerRemove return doc without the location of tokens.
+func jsonPointerRemove(doc any, tokens []string) (any, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("[jsonPointerRemove] can't remove the whole document")
+	}
+
+	token := tokens[0]
+
+	switch node := doc.(type) {
+	case map[string]any:
+		child, ok := node[token]
+
+		if !ok {
+			return nil, fmt.Errorf("[jsonPointerRemove] missing member %s", token)
+		}
+
+		if len(tokens) == 1 {
+			delete(node, token)
+			return node, nil
+		}
+
+		child, err := jsonPointerRemove(child, tokens[1:])
+		node[token] = child
+		return node, err
+	case []any:
+		idx, err := jsonPointerIndex(node, token, false)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(tokens) > 1 {
+			node[idx], err = jsonPointerRemove(node[idx], tokens[1:])
+			return node, err
+		}
+
+		return append(node[:idx], node[idx+1:]...), nil
+	}
+
+	return nil, fmt.Errorf("[jsonPointerRemove] can't remove %s of scalar value", token)
+}
+
+// jsonPatchApply apply the operations of RFC 6902 to doc, all or none of them.
+func jsonPatchApply(doc any, operations []JsonPatchOperation) (any, error) {
+	for i, operation := range operations {
+		tokens, err := jsonPointerParse(operation.Path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch operation.Op {
+		case "add":
+			doc, err = jsonPointerAdd(doc, tokens, operation.Value, false)
+		case "replace":
+			if _, err = jsonPointerGet(doc, tokens); err == nil {
+				doc, err = jsonPointerAdd(doc, tokens, operation.Value, true)
+			}
+		case "remove":
+			doc, err = jsonPointerRemove(doc, tokens)
+		case "move", "copy":
+			var from []string
+			var value any
+
+			if from, err = jsonPointerParse(operation.From); err != nil {
+				break
+			}
+
+			if value, err = jsonPointerGet(doc, from); err != nil {
+				break
+			}
+
+			if operation.Op == "move" {
+				if strings.HasPrefix(operation.Path+"/", operation.From+"/") && operation.Path != operation.From {
+					err = fmt.Errorf("can't move %s to one of its children", operation.From)
+					break
+				}
+
+				if doc, err = jsonPointerRemove(doc, from); err != nil {
+					break
+				}
+			} else {
+				value = jsonDeepCopy(value)
+			}
+
+			doc, err = jsonPointerAdd(doc, tokens, value, false)
+		case "test":
+			var value any
+
+			if value, err = jsonPointerGet(doc, tokens); err == nil && !reflect.DeepEqual(jsonDeepCopy(value), jsonDeepCopy(operation.Value)) {
+				err = fmt.Errorf("test failed for %s", operation.Path)
+			}
+		default:
+			err = fmt.Errorf("unknown op %s", operation.Op)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("[jsonPatchApply] operation %d (%s %s) : %s", i, operation.Op, operation.Path, err)
+		}
+	}
+
+	return doc, nil
+}
+
+// jsonDeepCopy return one copy of value in the form of json.Unmarshal (float64 numbers, map[string]any and []any).
+func jsonDeepCopy(value any) any {
+	var ret any
+	data, _ := json.Marshal(value)
+	json.Unmarshal(data, &ret)
+	return ret
+}
+
+func jsonEqual(value any, other any) bool {
+	data, _ := json.Marshal(value)
+	dataOther, _ := json.Marshal(other)
+	return string(data) == string(dataOther)
+}
+
+// patchApply return the object resulting of the merge patch or json patch of the request applied to the readable
+// fields of oldObj, with the removed fields as null (the changed fields are validated by processUpdate).
+func (rf *RequestFilter) patchApply(oldObj map[string]any) (map[string]any, error) {
+	base, _ := jsonDeepCopy(rf.filterReadable(rf.tokenPayload, oldObj)).(map[string]any)
+	var result any
+	var err error
+
+	if rf.contentType == ContentTypeJsonPatch {
+		result, err = jsonPatchApply(jsonDeepCopy(base), rf.jsonPatch)
+	} else {
+		result = mergePatch(jsonDeepCopy(base), jsonDeepCopy(rf.objIn))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	obj, ok := result.(map[string]any)
+
+	if !ok {
+		return nil, fmt.Errorf("[RequestFilter.patchApply] the result of patch is not one object")
+	}
+
+	for fieldName := range base {
+		if _, ok := obj[fieldName]; !ok {
+			obj[fieldName] = nil
+		}
+	}
+
+	return obj, nil
+}
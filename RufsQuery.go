@@ -0,0 +1,775 @@
+package rufsBase
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// The query of the list of rows (GET /rest/<schema>) accept :
+//
+//	<field>=<value>                 equal
+//	<field>[<operator>]=<value>     operators eq, ne, lt, lte, gt, gte, like, ilike (% and _ wildcards), in (comma separated
+//	                                values or repeated <field>[in][]=) and isnull (true or false)
+//	filter[<field>]=<value>         equal, filterRangeMin[<field>] greater than and filterRangeMax[<field>] less than
+//	sort=<field>,-<field>           order, "-" for descending (default is the primary key descending)
+//	limit=<n>&offset=<n>            page, the limit is also restricted by limitQuery of database
+//	cursor=<cursor>                 page after the row of cursor, received in the header Link with rel="next"
+//	fields=<field>,<field>.<field>  only these fields in the response, nested fields of objects separated by "."
+//
+// The response has the headers X-Total-Count (rows of conditions, without pagination) and Link (rel="first" and rel="next").
+// Conditions and sort only accept the fields that the user can read (not writeOnly and with the x-readMask of its role).
+var queryOperators = []string{"eq", "ne", "lt", "lte", "gt", "gte", "in", "like", "ilike", "isnull"}
+
+// RufsQueryCondition compare Field with Value using Operator, one of queryOperators.
+type RufsQueryCondition struct {
+	Field    string
+	Operator string
+	Value    any
+}
+
+// RufsQuery has the conditions (all of them must match), the Cursor (one of the lists of conditions must match),
+// the Sort ("-" prefix for descending), the page (Limit 0 is the maximum of entity manager) and the Fields to read
+// (nil for all of them).
+type RufsQuery struct {
+	Conditions []*RufsQueryCondition
+	Cursor     [][]*RufsQueryCondition
+	Sort       []string
+	Limit      int
+	Offset     int
+	Fields     []string
+}
+
+// queryConditionsFromFields convert the fields used by EntityManager.Find, with optional filter, filterRangeMin and filterRangeMax.
+func queryConditionsFromFields(fields map[string]any) []*RufsQueryCondition {
+	conditions := []*RufsQueryCondition{}
+
+	add := func(fields map[string]any, operator string) {
+		for fieldName, value := range fields {
+			condition := &RufsQueryCondition{fieldName, operator, value}
+
+			if list, ok := filterList(value); ok && operator == "eq" {
+				condition.Operator = "in"
+				condition.Value = list
+			} else if value == nil && operator == "eq" {
+				condition.Operator = "isnull"
+				condition.Value = true
+			}
+
+			conditions = append(conditions, condition)
+		}
+	}
+
+	filter, okFilter := fields["filter"].(map[string]any)
+	filterRangeMin, okFilterRangeMin := fields["filterRangeMin"].(map[string]any)
+	filterRangeMax, okFilterRangeMax := fields["filterRangeMax"].(map[string]any)
+
+	if okFilter || okFilterRangeMin || okFilterRangeMax {
+		add(filter, "eq")
+		add(filterRangeMin, "gt")
+		add(filterRangeMax, "lt")
+	} else {
+		add(fields, "eq")
+	}
+
+	return conditions
+}
+
+// queryOrderBy convert the orderBy of EntityManager.Find ("field desc") to the sort of RufsQuery ("-field").
+func queryOrderBy(orderBy []string) []string {
+	list := []string{}
+
+	for _, item := range orderBy {
+		fields := strings.Fields(item)
+
+		if len(fields) > 1 && strings.ToLower(fields[1]) == "desc" {
+			list = append(list, "-"+fields[0])
+		} else if len(fields) > 0 {
+			list = append(list, fields[0])
+		}
+	}
+
+	return list
+}
+
+// queryCompare return -1, 0 or 1, comparing numbers, dates and strings (without trailing spaces), and false when not comparable.
+func queryCompare(value any, expected any) (int, bool) {
+	if value == nil || expected == nil {
+		return 0, false
+	}
+
+	toTime := func(v any) (time.Time, bool) {
+		switch t := v.(type) {
+		case time.Time:
+			return t, true
+		case string:
+			if parsed, err := time.Parse(time.RFC3339, t); err == nil {
+				return parsed, true
+			}
+		}
+
+		return time.Time{}, false
+	}
+
+	if a, ok := filterNormalizeNumber(value).(float64); ok {
+		if b, ok := filterNormalizeNumber(expected).(float64); ok {
+			if a < b {
+				return -1, true
+			} else if a > b {
+				return 1, true
+			}
+
+			return 0, true
+		}
+	}
+
+	if a, ok := value.(bool); ok {
+		if b, ok := expected.(bool); ok {
+			if a == b {
+				return 0, true
+			} else if !a {
+				return -1, true
+			}
+
+			return 1, true
+		}
+	}
+
+	if a, ok := toTime(value); ok {
+		if b, ok := toTime(expected); ok {
+			if a.Before(b) {
+				return -1, true
+			} else if a.After(b) {
+				return 1, true
+			}
+
+			return 0, true
+		}
+	}
+
+	return strings.Compare(strings.TrimRight(fmt.Sprint(value), " "), strings.TrimRight(fmt.Sprint(expected), " ")), true
+}
+
+func queryLikeRegExp(pattern string, ignoreCase bool) *regexp.Regexp {
+	str := ""
+
+	for _, ch := range pattern {
+		switch ch {
+		case '%':
+			str += ".*"
+		case '_':
+			str += "."
+		default:
+			str += regexp.QuoteMeta(string(ch))
+		}
+	}
+
+	if ignoreCase {
+		str = "(?i)" + str
+	}
+
+	return regexp.MustCompile("^(?s)" + str + "$")
+}
+
+// queryFieldValue return the value of field in item, the nested fields of objects separated by "." (ex. primaryKey.id).
+func queryFieldValue(item map[string]any, fieldName string) any {
+	if value, ok := item[fieldName]; ok || !strings.Contains(fieldName, ".") {
+		return value
+	}
+
+	var value any = item
+
+	for _, token := range strings.Split(fieldName, ".") {
+		obj, ok := value.(map[string]any)
+
+		if !ok {
+			return nil
+		}
+
+		value = obj[token]
+	}
+
+	return value
+}
+
+// queryMatchCondition has the same result of the sql built by DbClientSql.buildConditions : null only match isnull.
+func queryMatchCondition(item map[string]any, condition *RufsQueryCondition) bool {
+	value := queryFieldValue(item, condition.Field)
+
+	if condition.Operator == "isnull" {
+		return (value == nil) == (condition.Value == true)
+	}
+
+	if value == nil {
+		return false
+	}
+
+	if condition.Operator == "in" {
+		list, _ := filterList(condition.Value)
+		return slices.IndexFunc(list, func(e any) bool { cmp, ok := queryCompare(value, e); return ok && cmp == 0 }) >= 0
+	}
+
+	if condition.Operator == "like" || condition.Operator == "ilike" {
+		return queryLikeRegExp(fmt.Sprint(condition.Value), condition.Operator == "ilike").MatchString(fmt.Sprint(value))
+	}
+
+	cmp, ok := queryCompare(value, condition.Value)
+
+	if !ok {
+		return false
+	}
+
+	switch condition.Operator {
+	case "eq":
+		return cmp == 0
+	case "ne":
+		return cmp != 0
+	case "lt":
+		return cmp < 0
+	case "lte":
+		return cmp <= 0
+	case "gt":
+		return cmp > 0
+	case "gte":
+		return cmp >= 0
+	}
+
+	return false
+}
+
+func queryMatch(item map[string]any, conditions []*RufsQueryCondition) bool {
+	for _, condition := range conditions {
+		if !queryMatchCondition(item, condition) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// queryApply filter, sort and page list in memory, like DbClientSql.Query, returning also the count of rows before the pagination.
+func queryApply(list []map[string]any, query *RufsQuery) ([]map[string]any, int) {
+	listOut := []map[string]any{}
+
+	for _, item := range list {
+		if queryMatch(item, query.Conditions) {
+			listOut = append(listOut, item)
+		}
+	}
+
+	total := len(listOut)
+
+	if len(query.Cursor) > 0 {
+		listCursor := []map[string]any{}
+
+		for _, item := range listOut {
+			if slices.IndexFunc(query.Cursor, func(conditions []*RufsQueryCondition) bool { return queryMatch(item, conditions) }) >= 0 {
+				listCursor = append(listCursor, item)
+			}
+		}
+
+		listOut = listCursor
+	}
+
+	sort.SliceStable(listOut, func(i, j int) bool {
+		for _, fieldName := range query.Sort {
+			desc := strings.HasPrefix(fieldName, "-")
+			fieldName = strings.TrimPrefix(fieldName, "-")
+			a, b := listOut[i][fieldName], listOut[j][fieldName]
+			// nulls are the greatest values, like in postgres
+			if a == nil || b == nil {
+				if a == nil && b == nil {
+					continue
+				}
+
+				return (a == nil) == desc
+			}
+
+			if cmp, _ := queryCompare(a, b); cmp != 0 {
+				return (cmp < 0) != desc
+			}
+		}
+
+		return false
+	})
+
+	if query.Offset > 0 {
+		if query.Offset >= len(listOut) {
+			listOut = listOut[:0]
+		} else {
+			listOut = listOut[query.Offset:]
+		}
+	}
+
+	if query.Limit > 0 && len(listOut) > query.Limit {
+		listOut = listOut[:query.Limit]
+	}
+
+	return listOut, total
+}
+
+// queryFieldsParse return the list of fields of the parameter fields ("name,menu.title"), checking the nested fields
+// against the properties of objects and of items of arrays (objects without properties accept any nested field).
+func queryFieldsParse(schema *Schema, value any) ([]string, error) {
+	list := []string{}
+
+	for _, path := range strings.Split(fmt.Sprint(value), ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+
+		tokens := strings.Split(path, ".")
+		field, ok := schema.Properties[tokens[0]]
+
+		for _, token := range tokens[1:] {
+			if !ok {
+				break
+			}
+
+			if field.Type == "array" && field.Items != nil {
+				field = field.Items
+			}
+
+			if len(field.Properties) == 0 {
+				break
+			}
+
+			field, ok = field.Properties[token]
+		}
+
+		if !ok || slices.Contains(tokens, "") {
+			return nil, fmt.Errorf("[queryFieldsParse] unknown field %s", path)
+		}
+
+		list = append(list, path)
+	}
+
+	if len(list) == 0 {
+		return nil, fmt.Errorf("[queryFieldsParse] empty list of fields")
+	}
+
+	return list, nil
+}
+
+// queryColumns return the first level of fields, the ones that the entity managers read.
+func queryColumns(fields []string) []string {
+	list := []string{}
+
+	for _, path := range fields {
+		if fieldName := strings.Split(path, ".")[0]; !slices.Contains(list, fieldName) {
+			list = append(list, fieldName)
+		}
+	}
+
+	return list
+}
+
+// queryProject return one copy of value with only the paths (nested in objects and in the objects of arrays).
+func queryProject(value any, paths [][]string) any {
+	switch node := value.(type) {
+	case map[string]any:
+		children := map[string][][]string{}
+
+		for _, tokens := range paths {
+			if list, ok := children[tokens[0]]; !ok || list != nil {
+				if len(tokens) == 1 {
+					// the whole field
+					children[tokens[0]] = nil
+				} else {
+					children[tokens[0]] = append(list, tokens[1:])
+				}
+			}
+		}
+
+		ret := map[string]any{}
+
+		for name, list := range children {
+			if child, ok := node[name]; ok {
+				if list == nil {
+					ret[name] = child
+				} else {
+					ret[name] = queryProject(child, list)
+				}
+			}
+		}
+
+		return ret
+	case []any:
+		ret := make([]any, len(node))
+
+		for i, item := range node {
+			ret[i] = queryProject(item, paths)
+		}
+
+		return ret
+	}
+
+	return value
+}
+
+// queryProjectFields return one copy of item with only the fields (in the form "<field>.<field>").
+func queryProjectFields(item map[string]any, fields []string) map[string]any {
+	if item == nil || fields == nil {
+		return item
+	}
+
+	paths := [][]string{}
+
+	for _, path := range fields {
+		paths = append(paths, strings.Split(path, "."))
+	}
+
+	ret, _ := queryProject(item, paths).(map[string]any)
+	return ret
+}
+
+// queryValue convert the value of query string (or of cursor) to the type of field.
+func queryValue(field *Schema, value any) (any, error) {
+	switch v := value.(type) {
+	case string:
+		switch field.Type {
+		case "integer":
+			return strconv.Atoi(v)
+		case "number":
+			return strconv.ParseFloat(v, 64)
+		case "boolean":
+			return strconv.ParseBool(v)
+		}
+	case float64:
+		if field.Type == "integer" {
+			return int(v), nil
+		}
+	}
+
+	return value, nil
+}
+
+func queryCursorEncode(item map[string]any, sortFields []string) string {
+	values := []any{}
+
+	for _, fieldName := range sortFields {
+		values = append(values, item[strings.TrimPrefix(fieldName, "-")])
+	}
+
+	data, _ := json.Marshal(values)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// queryCursorDecode return the conditions of the rows after the cursor : for each field of sort, the previous fields
+// equal and the field greater (or less for descending). The nulls are the greatest values (like in postgres), then the
+// rows with null are after any value in ascending sort, and before any value in descending sort.
+func queryCursorDecode(schema *Schema, cursor string, sortFields []string) ([][]*RufsQueryCondition, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	values := []any{}
+
+	if err == nil {
+		err = json.Unmarshal(data, &values)
+	}
+
+	if err != nil || len(values) != len(sortFields) {
+		return nil, fmt.Errorf("[queryCursorDecode] invalid cursor %s", cursor)
+	}
+
+	list := [][]*RufsQueryCondition{}
+	equals := []*RufsQueryCondition{}
+
+	for i, fieldName := range sortFields {
+		desc := strings.HasPrefix(fieldName, "-")
+		fieldName = strings.TrimPrefix(fieldName, "-")
+		field, ok := schema.Properties[fieldName]
+
+		if !ok {
+			return nil, fmt.Errorf("[queryCursorDecode] invalid cursor %s", cursor)
+		}
+
+		value, err := queryValue(field, values[i])
+
+		if err != nil {
+			return nil, fmt.Errorf("[queryCursorDecode] invalid cursor %s", cursor)
+		}
+
+		afters := []*RufsQueryCondition{}
+		equal := &RufsQueryCondition{fieldName, "eq", value}
+
+		if value == nil {
+			equal = &RufsQueryCondition{fieldName, "isnull", true}
+
+			if desc {
+				afters = append(afters, &RufsQueryCondition{fieldName, "isnull", false})
+			}
+		} else if desc {
+			afters = append(afters, &RufsQueryCondition{fieldName, "lt", value})
+		} else {
+			afters = append(afters, &RufsQueryCondition{fieldName, "gt", value}, &RufsQueryCondition{fieldName, "isnull", true})
+		}
+
+		for _, after := range afters {
+			list = append(list, append(append([]*RufsQueryCondition{}, equals...), after))
+		}
+
+		equals = append(equals, equal)
+	}
+
+	return list, nil
+}
+
+// tenantConditions return the conditions of tenantScope.
+func (rf *RequestFilter) tenantConditions() []*RufsQueryCondition {
+	conditions := []*RufsQueryCondition{}
+
+	for fieldName, value := range rf.tenantScope() {
+		if list, ok := filterList(value); ok {
+			conditions = append(conditions, &RufsQueryCondition{fieldName, "in", list})
+		} else {
+			conditions = append(conditions, &RufsQueryCondition{fieldName, "eq", value})
+		}
+	}
+
+	return conditions
+}
+
+// parseQuery return the query of the parameters of request, restricted to the tenant of user.
+func (rf *RequestFilter) parseQuery() (*RufsQuery, error) {
+	schema, ok := rf.microService.openapi.getSchemaFromSchemas(rf.schemaName)
+
+	if !ok {
+		return nil, fmt.Errorf("[RequestFilter.parseQuery] missing schema %s", rf.schemaName)
+	}
+
+	query := &RufsQuery{Conditions: []*RufsQueryCondition{}, Sort: []string{}}
+
+	addCondition := func(fieldName string, operator string, value any) error {
+		field, ok := schema.Properties[fieldName]
+
+		if !ok {
+			return fmt.Errorf("[RequestFilter.parseQuery] unknown field %s", fieldName)
+		}
+		// conditions on fields that the user can't read reveal their values (ex. password[like]=$2a%)
+		if !fieldAllowed(rf.tokenPayload, rf.path, field, false) {
+			return fmt.Errorf("[RequestFilter.parseQuery] unauthorized condition on field %s", fieldName)
+		}
+
+		if slices.Index(queryOperators, operator) < 0 {
+			return fmt.Errorf("[RequestFilter.parseQuery] unknown operator %s of field %s", operator, fieldName)
+		}
+
+		var err error
+
+		switch operator {
+		case "isnull":
+			value, err = strconv.ParseBool(fmt.Sprint(value))
+		case "like", "ilike":
+			value = fmt.Sprint(value)
+		case "in":
+			list, ok := value.([]any)
+
+			if !ok {
+				list = []any{}
+
+				for _, item := range strings.Split(fmt.Sprint(value), ",") {
+					list = append(list, item)
+				}
+			}
+
+			for i, item := range list {
+				if list[i], err = queryValue(field, item); err != nil {
+					break
+				}
+			}
+
+			value = list
+		default:
+			value, err = queryValue(field, value)
+		}
+
+		if err != nil {
+			return fmt.Errorf("[RequestFilter.parseQuery] invalid value of %s[%s] : %s", fieldName, operator, err)
+		}
+
+		query.Conditions = append(query.Conditions, &RufsQueryCondition{fieldName, operator, value})
+		return nil
+	}
+
+	for name, value := range rf.parameters {
+		var err error
+
+		switch name {
+		case "sort":
+			for _, fieldName := range strings.Split(fmt.Sprint(value), ",") {
+				if fieldName = strings.TrimSpace(fieldName); fieldName == "" {
+					continue
+				}
+
+				field, ok := schema.Properties[strings.TrimPrefix(fieldName, "-")]
+
+				if !ok {
+					return nil, fmt.Errorf("[RequestFilter.parseQuery] unknown sort field %s", fieldName)
+				}
+				// the cursor has the values of the sort fields
+				if !fieldAllowed(rf.tokenPayload, rf.path, field, false) {
+					return nil, fmt.Errorf("[RequestFilter.parseQuery] unauthorized sort field %s", fieldName)
+				}
+
+				query.Sort = append(query.Sort, fieldName)
+			}
+		case "limit":
+			if query.Limit, err = strconv.Atoi(fmt.Sprint(value)); err != nil || query.Limit < 0 {
+				return nil, fmt.Errorf("[RequestFilter.parseQuery] invalid limit %v", value)
+			}
+		case "offset":
+			if query.Offset, err = strconv.Atoi(fmt.Sprint(value)); err != nil || query.Offset < 0 {
+				return nil, fmt.Errorf("[RequestFilter.parseQuery] invalid offset %v", value)
+			}
+		case "cursor", "fields", "expand":
+		case "filter", "filterRangeMin", "filterRangeMax":
+			fields, ok := value.(map[string]any)
+
+			if !ok {
+				return nil, fmt.Errorf("[RequestFilter.parseQuery] invalid %s", name)
+			}
+
+			operator := map[string]string{"filter": "eq", "filterRangeMin": "gt", "filterRangeMax": "lt"}[name]
+
+			for fieldName, value := range fields {
+				if err = addCondition(fieldName, operator, value); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			if operators, ok := value.(map[string]any); ok {
+				for operator, value := range operators {
+					if err = addCondition(name, operator, value); err != nil {
+						return nil, err
+					}
+				}
+			} else if err = addCondition(name, "eq", value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// se não for admin, limita os resultados para as rufsGroup vinculadas a empresa do usuário
+	query.Conditions = append(query.Conditions, rf.tenantConditions()...)
+	query.Conditions = append(query.Conditions, rf.softDeleteConditions()...)
+	// the primary key make the order unique, needed by cursor
+	if len(query.Sort) == 0 {
+		for _, fieldName := range schema.PrimaryKeys {
+			query.Sort = append(query.Sort, "-"+fieldName)
+		}
+	} else {
+		for _, fieldName := range schema.PrimaryKeys {
+			if !slices.Contains(query.Sort, fieldName) && !slices.Contains(query.Sort, "-"+fieldName) {
+				query.Sort = append(query.Sort, fieldName)
+			}
+		}
+	}
+
+	if cursor, ok := rf.parameters["cursor"]; ok {
+		var err error
+
+		if !rf.querySortReadable(schema, query.Sort) {
+			return nil, fmt.Errorf("[RequestFilter.parseQuery] unauthorized cursor of fields %s", strings.Join(query.Sort, ","))
+		}
+
+		if query.Cursor, err = queryCursorDecode(schema, fmt.Sprint(cursor), query.Sort); err != nil {
+			return nil, err
+		}
+	}
+	expand, err := rf.parseExpand()
+
+	if err != nil {
+		return nil, err
+	}
+	// the primary key, the sort fields and the expanded references are also read, needed by cursor, ETag and documents
+	if fields, err := rf.parseFields(); err != nil {
+		return nil, err
+	} else if fields != nil {
+		query.Fields = queryColumns(fields)
+
+		for _, fieldName := range append(append(append([]string{}, schema.PrimaryKeys...), query.Sort...), expandColumns(schema, expand)...) {
+			if fieldName = strings.TrimPrefix(fieldName, "-"); !slices.Contains(query.Fields, fieldName) {
+				query.Fields = append(query.Fields, fieldName)
+			}
+		}
+	}
+
+	return query, nil
+}
+
+// querySortReadable is false when the user can't read one of sortFields, the fields with values in the cursor.
+func (rf *RequestFilter) querySortReadable(schema *Schema, sortFields []string) bool {
+	for _, fieldName := range sortFields {
+		if field, ok := schema.Properties[strings.TrimPrefix(fieldName, "-")]; ok && !fieldAllowed(rf.tokenPayload, rf.path, field, false) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseFields return the list of the parameter fields, nil when missing.
+func (rf *RequestFilter) parseFields() ([]string, error) {
+	value, ok := rf.parameters["fields"]
+
+	if !ok {
+		return nil, nil
+	}
+
+	schema, ok := rf.microService.openapi.getSchemaFromSchemas(rf.schemaName)
+
+	if !ok {
+		return nil, fmt.Errorf("[RequestFilter.parseFields] missing schema %s", rf.schemaName)
+	}
+
+	return queryFieldsParse(schema, value)
+}
+
+// queryLinks add the headers X-Total-Count and Link of the page of list to resp.
+func (rf *RequestFilter) queryLinks(resp Response, query *RufsQuery, list []map[string]any, total int) Response {
+	if resp.StatusCode != http.StatusOK || rf.requestUrl == nil {
+		return resp
+	}
+
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+
+	resp.Header.Set("X-Total-Count", strconv.Itoa(total))
+
+	link := func(set map[string]string, rel string) string {
+		values := rf.requestUrl.Query()
+		values.Del("cursor")
+		values.Del("offset")
+
+		for name, value := range set {
+			values.Set(name, value)
+		}
+
+		url := *rf.requestUrl
+		url.RawQuery = values.Encode()
+		return fmt.Sprintf(`<%s>; rel="%s"`, url.RequestURI(), rel)
+	}
+
+	links := []string{link(nil, "first")}
+	_, isCursor := rf.parameters["cursor"]
+
+	if len(list) > 0 && ((isCursor && len(list) == query.Limit) || (!isCursor && query.Offset+len(list) < total)) {
+		schema, _ := rf.microService.openapi.getSchemaFromSchemas(rf.schemaName)
+		// the cursor can't expose values that the user can't read
+		if _, isOffset := rf.parameters["offset"]; isOffset || schema == nil || !rf.querySortReadable(schema, query.Sort) {
+			links = append(links, link(map[string]string{"offset": strconv.Itoa(query.Offset + len(list))}, "next"))
+		} else {
+			links = append(links, link(map[string]string{"cursor": queryCursorEncode(list[len(list)-1], query.Sort)}, "next"))
+		}
+	}
+
+	resp.Header.Set("Link", strings.Join(links, ", "))
+	return resp
+}
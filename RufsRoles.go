@@ -0,0 +1,160 @@
+package rufsBase
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/exp/slices"
+)
+
+// RolesInherited are the roles of one user by origin, the effective roles are the merge of them :
+// the path declared in rufsUser override the groups, the groups (joined by bitwise or) override the rufsGroupOwner.
+type RolesInherited struct {
+	RufsUser       []Role `json:"rufsUser"`
+	RufsGroup      []Role `json:"rufsGroup"`
+	RufsGroupOwner []Role `json:"rufsGroupOwner"`
+	Roles          []Role `json:"roles"`
+}
+
+func rolesFromMap(obj map[string]any) ([]Role, error) {
+	roles := []Role{}
+
+	if obj == nil || obj["roles"] == nil {
+		return roles, nil
+	}
+
+	data, _ := json.Marshal(obj["roles"])
+
+	if err := json.Unmarshal(data, &roles); err != nil {
+		UtilsShowJsonUnmarshalError(string(data), err)
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// rolesJoin add the masks of list in roles, joining the masks of the same path.
+func rolesJoin(roles []Role, list []Role) []Role {
+	for _, role := range list {
+		if idx := slices.IndexFunc(roles, func(e Role) bool { return e.Path == role.Path }); idx >= 0 {
+			roles[idx].Mask |= role.Mask
+		} else {
+			roles = append(roles, role)
+		}
+	}
+
+	return roles
+}
+
+// rolesOverride return roles with the paths of list replaced by the ones of list.
+func rolesOverride(roles []Role, list []Role) []Role {
+	for _, role := range list {
+		if idx := slices.IndexFunc(roles, func(e Role) bool { return e.Path == role.Path }); idx >= 0 {
+			roles[idx] = role
+		} else {
+			roles = append(roles, role)
+		}
+	}
+
+	return roles
+}
+
+func (rms *RufsMicroService) rolesInherited(user *RufsUser, groups []int) (*RolesInherited, error) {
+	rolesInherited := &RolesInherited{RufsUser: user.Roles, RufsGroup: []Role{}}
+
+	if rolesInherited.RufsUser == nil {
+		rolesInherited.RufsUser = []Role{}
+	}
+
+	groupOwner, err := rms.getEntityManager("rufsGroupOwner").FindOne("rufsGroupOwner", map[string]any{"id": user.RufsGroupOwner})
+
+	if err != nil {
+		return nil, fmt.Errorf("[RufsMicroService.rolesInherited] : %s", err)
+	}
+
+	if rolesInherited.RufsGroupOwner, err = rolesFromMap(groupOwner); err != nil {
+		return nil, err
+	}
+
+	for _, id := range groups {
+		group, err := rms.getEntityManager("rufsGroup").FindOne("rufsGroup", map[string]any{"id": id})
+
+		if err != nil {
+			return nil, fmt.Errorf("[RufsMicroService.rolesInherited] : %s", err)
+		}
+
+		roles, err := rolesFromMap(group)
+
+		if err != nil {
+			return nil, err
+		}
+
+		rolesInherited.RufsGroup = rolesJoin(rolesInherited.RufsGroup, roles)
+	}
+
+	rolesInherited.Roles = rolesOverride(rolesOverride(rolesOverride([]Role{}, rolesInherited.RufsGroupOwner), rolesInherited.RufsGroup), rolesInherited.RufsUser)
+	return rolesInherited, nil
+}
+
+func (rms *RufsMicroService) userGroups(userId int) ([]int, error) {
+	groups := []int{}
+	list, err := rms.getEntityManager("rufsGroupUser").Find("rufsGroupUser", map[string]any{"rufsUser": userId}, []string{})
+
+	if err != nil {
+		return nil, fmt.Errorf("[RufsMicroService.userGroups] : %s", err)
+	}
+
+	for _, item := range list {
+		groups = append(groups, UtilsToInt(item["rufsGroup"]))
+	}
+
+	return groups, nil
+}
+
+// onRequestEffectiveRoles show to administrators the roles of one user by origin.
+func (rms *RufsMicroService) onRequestEffectiveRoles(req *http.Request) Response {
+	claims, err := rms.authorizationClaims(req)
+
+	if err != nil {
+		return ResponseUnauthorized(fmt.Sprint(err))
+	}
+
+	if !claims.TokenPayload.isAdmin() {
+		return ResponseUnauthorized("[RufsMicroService.onRequestEffectiveRoles] only administrators can see roles of other users")
+	}
+
+	userId, _ := strconv.Atoi(req.URL.Query().Get("rufsUser"))
+	userMap, err := rms.getEntityManager("rufsUser").FindOne("rufsUser", map[string]any{"id": userId})
+
+	if err != nil {
+		return ResponseInternalServerError(fmt.Sprint(err))
+	}
+
+	if userMap == nil {
+		return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestEffectiveRoles] missing rufsUser %d", userId))
+	}
+
+	user := &RufsUser{}
+	data, _ := json.Marshal(userMap)
+
+	if err := json.Unmarshal(data, user); err != nil {
+		UtilsShowJsonUnmarshalError(string(data), err)
+		return ResponseInternalServerError(fmt.Sprint(err))
+	}
+
+	groups, err := rms.userGroups(user.Id)
+
+	if err != nil {
+		return ResponseInternalServerError(fmt.Sprint(err))
+	}
+
+	rolesInherited, err := rms.rolesInherited(user, groups)
+
+	if err != nil {
+		return ResponseInternalServerError(fmt.Sprint(err))
+	}
+
+	return ResponseOk(rolesInherited)
+}
@@ -0,0 +1,231 @@
+package rufsBase
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// RufsSeed are initial rows of one schema, inserted only when missing. The existence of each row is checked by Keys,
+// by default the primary key (when present in the row) or the first unique key present in the row. The optional check
+// can refuse the insertion of one row.
+type RufsSeed struct {
+	SchemaName string           `json:"schemaName"`
+	Keys       []string         `json:"keys"`
+	Rows       []map[string]any `json:"rows"`
+	check      func(row map[string]any) error
+}
+
+func seedIsProduction() bool {
+	return strings.ToLower(os.Getenv("RUFS_ENV")) == "production"
+}
+
+// seedDefault return the rufsGroupOwner and the user with administration roles, with the credentials of
+// RUFS_ADMIN_USER and RUFS_ADMIN_PASSWORD (the typed password). The insertion of the default admin/admin (or of other
+// weak credentials) is refused in production, the user already existent keep its password.
+func seedDefault() ([]*RufsSeed, error) {
+	groupOwner := map[string]any{}
+	user := map[string]any{}
+
+	if err := json.Unmarshal([]byte(defaultGroupOwnerAdminStr), &groupOwner); err != nil {
+		UtilsShowJsonUnmarshalError(defaultGroupOwnerAdminStr, err)
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(defaultUserAdminStr), &user); err != nil {
+		UtilsShowJsonUnmarshalError(defaultUserAdminStr, err)
+		return nil, err
+	}
+
+	if name := os.Getenv("RUFS_ADMIN_USER"); name != "" {
+		user["name"] = name
+	}
+
+	// the minimum length is checked in the typed password, before the md5
+	policyErr := passwordPolicyCheck(user["name"].(string), user["password"].(string))
+
+	if password := os.Getenv("RUFS_ADMIN_PASSWORD"); password != "" {
+		policyErr = passwordPolicyCheck(user["name"].(string), password)
+		sum := md5.Sum([]byte(password))
+		user["password"] = hex.EncodeToString(sum[:])
+	}
+
+	check := func(row map[string]any) error {
+		if err := policyErr; err != nil {
+			if seedIsProduction() {
+				return fmt.Errorf("[seedDefault] refused default credentials of administrator in production, set RUFS_ADMIN_USER and RUFS_ADMIN_PASSWORD : %s", err)
+			}
+
+			log.Printf("[seedDefault] using weak credentials of administrator, set RUFS_ADMIN_USER and RUFS_ADMIN_PASSWORD : %s", err)
+		}
+
+		return nil
+	}
+
+	return []*RufsSeed{{SchemaName: "rufsGroupOwner", Keys: []string{"name"}, Rows: []map[string]any{groupOwner}}, {SchemaName: "rufsUser", Keys: []string{"name"}, Rows: []map[string]any{user}, check: check}}, nil
+}
+
+// seedLoad read the fixture files (*.json, in name order) of folder, each one with one RufsSeed or a list of them.
+func seedLoad(folder string) ([]*RufsSeed, error) {
+	seeds := []*RufsSeed{}
+	fileNames, err := filepath.Glob(filepath.Join(folder, "*.json"))
+
+	if err != nil {
+		return nil, fmt.Errorf("[seedLoad] : %s", err)
+	}
+
+	sort.Strings(fileNames)
+
+	for _, fileName := range fileNames {
+		data, err := os.ReadFile(fileName)
+
+		if err != nil {
+			return nil, fmt.Errorf("[seedLoad] : %s", err)
+		}
+
+		list := []*RufsSeed{}
+
+		if strings.HasPrefix(strings.TrimSpace(string(data)), "[") {
+			err = json.Unmarshal(data, &list)
+		} else {
+			seed := &RufsSeed{}
+			err = json.Unmarshal(data, seed)
+			list = append(list, seed)
+		}
+
+		if err != nil {
+			UtilsShowJsonUnmarshalError(string(data), err)
+			return nil, fmt.Errorf("[seedLoad] invalid file %s : %s", fileName, err)
+		}
+
+		seeds = append(seeds, list...)
+	}
+
+	return seeds, nil
+}
+
+// seedKey return the fields of row that identify it.
+func (rms *RufsMicroService) seedKey(seed *RufsSeed, schema *Schema, row map[string]any) (map[string]any, error) {
+	candidates := [][]string{}
+
+	if len(seed.Keys) > 0 {
+		candidates = append(candidates, seed.Keys)
+	} else {
+		candidates = append(candidates, schema.PrimaryKeys)
+		names := []string{}
+
+		for name := range schema.UniqueKeys {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			candidates = append(candidates, schema.UniqueKeys[name])
+		}
+	}
+
+	for _, fields := range candidates {
+		key := map[string]any{}
+
+		for _, fieldName := range fields {
+			if value, ok := row[fieldName]; ok {
+				key[fieldName] = value
+			}
+		}
+
+		if len(fields) > 0 && len(key) == len(fields) {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("[RufsMicroService.seedKey] missing keys to identify row %v of %s", row, seed.SchemaName)
+}
+
+// seedApply insert the rows of seeds that don't exist yet, then it can run at each start.
+func (rms *RufsMicroService) seedApply(seeds []*RufsSeed) error {
+	for _, seed := range seeds {
+		schema, ok := rms.openapi.getSchemaFromSchemas(seed.SchemaName)
+
+		if !ok {
+			return fmt.Errorf("[RufsMicroService.seedApply] missing schema %s", seed.SchemaName)
+		}
+
+		entityManager := rms.getEntityManager(seed.SchemaName)
+
+		for _, row := range seed.Rows {
+			key, err := rms.seedKey(seed, schema, row)
+
+			if err != nil {
+				return err
+			}
+
+			if obj, err := entityManager.FindOne(seed.SchemaName, key); err != nil {
+				return fmt.Errorf("[RufsMicroService.seedApply] : %s", err)
+			} else if obj != nil {
+				continue
+			}
+
+			if seed.check != nil {
+				if err := seed.check(row); err != nil {
+					return err
+				}
+			}
+
+			for fieldName, field := range schema.Properties {
+				if password, ok := row[fieldName].(string); ok && field.Format == "password" && !passwordIsHash(password) {
+					if row[fieldName], err = PasswordHash(password); err != nil {
+						return err
+					}
+				}
+			}
+
+			if _, err := entityManager.Insert(seed.SchemaName, row); err != nil {
+				return fmt.Errorf("[RufsMicroService.seedApply] fail to insert %v in %s : %s", key, seed.SchemaName, err)
+			}
+
+			log.Printf("[RufsMicroService.seedApply] inserted %v in %s", key, seed.SchemaName)
+		}
+	}
+
+	return nil
+}
+
+// seed apply the default rows of rufs tables and the fixtures of seedPath (RUFS_SEED_PATH, default ./rufs-<appName>-es6/seed).
+func (rms *RufsMicroService) seed() error {
+	seeds, err := seedDefault()
+
+	if err != nil {
+		return err
+	}
+
+	if rms.seedPath == "" {
+		rms.seedPath = os.Getenv("RUFS_SEED_PATH")
+	}
+
+	if rms.seedPath == "" {
+		rms.seedPath = fmt.Sprintf(`./rufs-%s-es6/seed`, rms.appName)
+	}
+
+	if _, err := os.Stat(rms.seedPath); err == nil {
+		list, err := seedLoad(rms.seedPath)
+
+		if err != nil {
+			return err
+		}
+
+		seeds = append(seeds, list...)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("[RufsMicroService.seed] : %s", err)
+	}
+
+	return rms.seedApply(seeds)
+}
@@ -0,0 +1,421 @@
+package rufsBase
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// RufsSession is the server side state of one login, shared by every access token issued from it.
+// The refresh token is never stored, only its sha256, and is rotated at each use.
+type RufsSession struct {
+	Id           int       `json:"id"`
+	Token        string    `json:"token"`
+	RufsUser     int       `json:"rufsUser"`
+	RefreshToken string    `json:"refreshToken"`
+	Ip           string    `json:"ip"`
+	CreatedAt    time.Time `json:"createdAt"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+	Revoked      bool      `json:"revoked"`
+}
+
+// SessionCache keep for ttl (default 30 seconds) the sessions found not revoked, then the authenticated requests don't
+// read rufsSession each time. The revocations of this instance remove the session at once, the ones of other instances
+// sharing the database are seen after the ttl.
+type SessionCache struct {
+	ttl     time.Duration
+	checked map[string]time.Time
+	mutex   sync.Mutex
+}
+
+func (sc *SessionCache) isValid(sessionToken string) bool {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	checkedAt, ok := sc.checked[sessionToken]
+	return ok && time.Since(checkedAt) < sc.ttl
+}
+
+func (sc *SessionCache) register(sessionToken string) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	if sc.checked == nil {
+		sc.checked = map[string]time.Time{}
+	}
+
+	if sc.ttl == 0 {
+		sc.ttl = 30 * time.Second
+	}
+	// forget the old checks, of sessions without requests in the ttl
+	if len(sc.checked) > 1000 {
+		for token, checkedAt := range sc.checked {
+			if time.Since(checkedAt) >= sc.ttl {
+				delete(sc.checked, token)
+			}
+		}
+	}
+
+	sc.checked[sessionToken] = time.Now()
+}
+
+func (sc *SessionCache) remove(sessionToken string) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	delete(sc.checked, sessionToken)
+}
+
+func rufsSessionRandomString(size int) string {
+	buffer := make([]byte, size)
+
+	if _, err := rand.Read(buffer); err != nil {
+		log.Panicf("[rufsSessionRandomString] : %s", err)
+	}
+
+	return hex.EncodeToString(buffer)
+}
+
+func rufsSessionHash(str string) string {
+	sum := sha256.Sum256([]byte(str))
+	return hex.EncodeToString(sum[:])
+}
+
+func rufsJwtSecret() []byte {
+	jwtSecret := os.Getenv("RUFS_JWT_SECRET")
+
+	if jwtSecret == "" {
+		jwtSecret = "123456"
+	}
+
+	return []byte(jwtSecret)
+}
+
+func (rms *RufsMicroService) sessionFind(fields map[string]any) ([]*RufsSession, error) {
+	list, err := rms.getEntityManager("rufsSession").Find("rufsSession", fields, []string{})
+
+	if err != nil {
+		return nil, fmt.Errorf("[RufsMicroService.sessionFind] : %s", err)
+	}
+
+	sessions := []*RufsSession{}
+
+	for _, item := range list {
+		session := &RufsSession{}
+		data, _ := json.Marshal(item)
+
+		if err := json.Unmarshal(data, session); err != nil {
+			UtilsShowJsonUnmarshalError(string(data), err)
+			return nil, err
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+func (rms *RufsMicroService) sessionUpdate(session *RufsSession) error {
+	obj := map[string]any{"id": session.Id, "token": session.Token, "rufsUser": session.RufsUser, "refreshToken": session.RefreshToken, "ip": session.Ip, "createdAt": session.CreatedAt, "expiresAt": session.ExpiresAt, "revoked": session.Revoked}
+	_, err := rms.getEntityManager("rufsSession").Update("rufsSession", map[string]any{"id": session.Id}, obj)
+	return err
+}
+
+// sessionCreate register a new session for loginResponse and fill JwtHeader and RefreshToken.
+func (rms *RufsMicroService) sessionCreate(loginResponse *LoginResponse) error {
+	now := time.Now()
+	session := &RufsSession{Token: rufsSessionRandomString(16), RufsUser: loginResponse.Id, Ip: loginResponse.Ip, CreatedAt: now, ExpiresAt: now.Add(rms.refreshTokenExpiration)}
+	refreshToken := session.Token + "." + rufsSessionRandomString(32)
+	session.RefreshToken = rufsSessionHash(refreshToken)
+	obj := map[string]any{"token": session.Token, "rufsUser": session.RufsUser, "refreshToken": session.RefreshToken, "ip": session.Ip, "createdAt": session.CreatedAt, "expiresAt": session.ExpiresAt, "revoked": false}
+
+	if _, err := rms.getEntityManager("rufsSession").Insert("rufsSession", obj); err != nil {
+		return fmt.Errorf("[RufsMicroService.sessionCreate] : %s", err)
+	}
+
+	loginResponse.RefreshToken = refreshToken
+	return rms.sessionSignToken(loginResponse, session)
+}
+
+func (rms *RufsMicroService) sessionSignToken(loginResponse *LoginResponse, session *RufsSession) (err error) {
+	token := jwt.New(jwt.SigningMethodHS256)
+	token.Claims = &RufsClaims{&jwt.StandardClaims{ExpiresAt: time.Now().Add(rms.tokenExpiration).Unix()}, loginResponse.TokenPayload, session.Token}
+	loginResponse.JwtHeader, err = token.SignedString(rufsJwtSecret())
+	return err
+}
+
+// sessionRefresh exchange a refresh token for a new access token and a new refresh token.
+// A refresh token used twice means that it leaked, then the whole session is revoked.
+func (rms *RufsMicroService) sessionRefresh(refreshToken string, remoteAddr string) (*LoginResponse, error) {
+	pos := strings.Index(refreshToken, ".")
+
+	if pos < 0 {
+		return nil, fmt.Errorf("[RufsMicroService.sessionRefresh] invalid refresh token")
+	}
+
+	sessions, err := rms.sessionFind(map[string]any{"token": refreshToken[:pos]})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sessions) != 1 {
+		return nil, fmt.Errorf("[RufsMicroService.sessionRefresh] missing session")
+	}
+
+	session := sessions[0]
+
+	if session.Revoked || time.Now().After(session.ExpiresAt) {
+		return nil, fmt.Errorf("[RufsMicroService.sessionRefresh] session expired or revoked")
+	}
+
+	if session.RefreshToken != rufsSessionHash(refreshToken) {
+		log.Printf("[RufsMicroService.sessionRefresh] reuse of refresh token detected, revoking session of user %d", session.RufsUser)
+		rms.sessionRevoke(session.Token)
+		return nil, fmt.Errorf("[RufsMicroService.sessionRefresh] refresh token already used")
+	}
+
+	userMap, err := rms.getEntityManager("rufsUser").FindOne("rufsUser", map[string]any{"id": session.RufsUser})
+
+	if err != nil {
+		return nil, fmt.Errorf("[RufsMicroService.sessionRefresh] internal error : %s", err)
+	}
+
+	if userMap == nil {
+		return nil, fmt.Errorf("[RufsMicroService.sessionRefresh] missing user")
+	}
+
+	user := &RufsUser{}
+	data, _ := json.Marshal(userMap)
+
+	if err := json.Unmarshal(data, user); err != nil {
+		UtilsShowJsonUnmarshalError(string(data), err)
+		return nil, err
+	}
+
+	loginResponse, err := rms.buildLoginResponse(user, remoteAddr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken = session.Token + "." + rufsSessionRandomString(32)
+	// the conditional update on the old hash rotate the refresh token only once between concurrent requests
+	key := map[string]any{"id": session.Id, "refreshToken": session.RefreshToken, "revoked": false}
+	session.RefreshToken = rufsSessionHash(refreshToken)
+	session.Ip = remoteAddr
+
+	if _, err := rms.getEntityManager("rufsSession").Update("rufsSession", key, map[string]any{"refreshToken": session.RefreshToken, "ip": session.Ip}); err != nil {
+		log.Printf("[RufsMicroService.sessionRefresh] concurrent use of refresh token detected, revoking session of user %d : %s", session.RufsUser, err)
+		rms.sessionRevoke(session.Token)
+		return nil, fmt.Errorf("[RufsMicroService.sessionRefresh] refresh token already used")
+	}
+
+	loginResponse.RefreshToken = refreshToken
+
+	if err := rms.sessionSignToken(loginResponse, session); err != nil {
+		return nil, err
+	}
+
+	return loginResponse, nil
+}
+
+// sessionPurge remove the sessions expired before now less the expiration of access tokens, that can't be used anymore.
+func (rms *RufsMicroService) sessionPurge(now time.Time) error {
+	limit := now.Add(-rms.tokenExpiration)
+	entityManager := rms.getEntityManager("rufsSession")
+	list, _, err := entityManager.Query("rufsSession", &RufsQuery{Conditions: []*RufsQueryCondition{{"expiresAt", "lt", limit}}})
+
+	if err != nil {
+		return fmt.Errorf("[RufsMicroService.sessionPurge] fail to find the expired sessions : %s", err)
+	}
+
+	for _, item := range list {
+		if err := entityManager.DeleteOne("rufsSession", map[string]any{"id": item["id"]}); err != nil {
+			return fmt.Errorf("[RufsMicroService.sessionPurge] fail to remove session %v : %s", item["id"], err)
+		}
+	}
+
+	if len(list) > 0 {
+		log.Printf("[RufsMicroService.sessionPurge] removed %d sessions expired before %s", len(list), limit.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// sessionPurgeStart run sessionPurge at start and after each hour.
+func (rms *RufsMicroService) sessionPurgeStart() {
+	go func() {
+		for {
+			if err := rms.sessionPurge(time.Now()); err != nil {
+				log.Print(err)
+			}
+
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func (rms *RufsMicroService) sessionIsRevoked(sessionToken string) bool {
+	if sessionToken == "" {
+		return true
+	}
+
+	if rms.sessionCache.isValid(sessionToken) {
+		return false
+	}
+
+	sessions, err := rms.sessionFind(map[string]any{"token": sessionToken})
+
+	if err != nil {
+		log.Printf("[RufsMicroService.sessionIsRevoked] : %s", err)
+		return true
+	}
+
+	if len(sessions) != 1 || sessions[0].Revoked {
+		return true
+	}
+
+	rms.sessionCache.register(sessionToken)
+	return false
+}
+
+func (rms *RufsMicroService) sessionRevokeList(sessions []*RufsSession) error {
+	for _, session := range sessions {
+		if !session.Revoked {
+			session.Revoked = true
+
+			if err := rms.sessionUpdate(session); err != nil {
+				return fmt.Errorf("[RufsMicroService.sessionRevokeList] : %s", err)
+			}
+		}
+
+		rms.sessionCache.remove(session.Token)
+		rms.wsDisconnectSession(session.Token)
+	}
+
+	return nil
+}
+
+func (rms *RufsMicroService) sessionRevoke(sessionToken string) error {
+	sessions, err := rms.sessionFind(map[string]any{"token": sessionToken})
+
+	if err != nil {
+		return err
+	}
+
+	return rms.sessionRevokeList(sessions)
+}
+
+func (rms *RufsMicroService) sessionRevokeUser(userId int) error {
+	sessions, err := rms.sessionFind(map[string]any{"rufsUser": userId})
+
+	if err != nil {
+		return err
+	}
+
+	return rms.sessionRevokeList(sessions)
+}
+
+func (rms *RufsMicroService) wsDisconnectSession(sessionToken string) {
+	for _, client := range rms.wsSelect(sessionToken, 0) {
+		rms.wsDisconnect(client.tokenString)
+	}
+}
+
+// authorizationClaims decode the bearer token of req, rejecting tokens of revoked sessions.
+func (rms *RufsMicroService) authorizationClaims(req *http.Request) (*RufsClaims, error) {
+	authorizationHeaderPrefix := "Bearer "
+	tokenRaw := req.Header.Get("Authorization")
+
+	if !strings.HasPrefix(tokenRaw, authorizationHeaderPrefix) {
+		return nil, fmt.Errorf("[RufsMicroService.authorizationClaims] missing bearer token")
+	}
+
+	claims, err := RufsDecryptToken(tokenRaw[len(authorizationHeaderPrefix):])
+
+	if err != nil {
+		return nil, fmt.Errorf("[RufsMicroService.authorizationClaims] Authorization token header invalid : %s", err)
+	}
+
+	if rms.sessionIsRevoked(claims.Session) {
+		return nil, fmt.Errorf("[RufsMicroService.authorizationClaims] session revoked")
+	}
+
+	return claims, nil
+}
+
+func (rms *RufsMicroService) onRequestRefresh(req *http.Request) Response {
+	refreshRequest := map[string]string{}
+
+	if err := json.NewDecoder(req.Body).Decode(&refreshRequest); err != nil {
+		return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestRefresh] : %s", err))
+	}
+
+	refreshToken, ok := refreshRequest["refreshToken"]
+
+	if !ok {
+		return ResponseBadRequest("[RufsMicroService.onRequestRefresh] missing field 'refreshToken'")
+	}
+
+	loginResponse, err := rms.sessionRefresh(refreshToken, req.RemoteAddr)
+
+	if err != nil {
+		return ResponseUnauthorized(fmt.Sprint(err))
+	}
+
+	rms.loginResponseFillOpenApi(loginResponse)
+	return ResponseOk(loginResponse)
+}
+
+func (rms *RufsMicroService) onRequestLogout(req *http.Request) Response {
+	claims, err := rms.authorizationClaims(req)
+
+	if err != nil {
+		return ResponseUnauthorized(fmt.Sprint(err))
+	}
+
+	if err := rms.sessionRevoke(claims.Session); err != nil {
+		return ResponseInternalServerError(fmt.Sprintf("[RufsMicroService.onRequestLogout] : %s", err))
+	}
+
+	return ResponseOk(map[string]any{})
+}
+
+func (rms *RufsMicroService) onRequestRevokeSessions(req *http.Request) Response {
+	claims, err := rms.authorizationClaims(req)
+
+	if err != nil {
+		return ResponseUnauthorized(fmt.Sprint(err))
+	}
+
+	if !claims.TokenPayload.isAdmin() {
+		return ResponseUnauthorized("[RufsMicroService.onRequestRevokeSessions] only administrators can revoke sessions")
+	}
+
+	revokeRequest := map[string]int{}
+
+	if err := json.NewDecoder(req.Body).Decode(&revokeRequest); err != nil {
+		return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestRevokeSessions] : %s", err))
+	}
+
+	userId, ok := revokeRequest["rufsUser"]
+
+	if !ok {
+		return ResponseBadRequest("[RufsMicroService.onRequestRevokeSessions] missing field 'rufsUser'")
+	}
+
+	if err := rms.sessionRevokeUser(userId); err != nil {
+		return ResponseInternalServerError(fmt.Sprintf("[RufsMicroService.onRequestRevokeSessions] : %s", err))
+	}
+
+	return ResponseOk(map[string]any{})
+}
@@ -0,0 +1,78 @@
+package rufsBase
+
+import (
+	"fmt"
+
+	"golang.org/x/exp/slices"
+)
+
+// tenantScope return the conditions that restrict the rows of rf.schemaName to the rufsGroupOwner and to the rufsGroup of the user.
+// Users of the rufsGroupOwner 1 (the owner of the service) see the rows of all rufsGroupOwner.
+func (rf *RequestFilter) tenantScope() map[string]any {
+	scope := map[string]any{}
+
+	if rf.tokenPayload == nil || rf.tokenPayload.RufsGroupOwner <= 1 {
+		return scope
+	}
+
+	if rf.schemaName == "rufsGroupOwner" {
+		scope["id"] = rf.tokenPayload.RufsGroupOwner
+	}
+
+	rufsGroupOwnerEntries, _ := rf.microService.openapi.getPropertiesWithRef(rf.schemaName, "#/components/schemas/rufsGroupOwner")
+
+	for _, entry := range rufsGroupOwnerEntries {
+		scope[entry["fieldName"].(string)] = rf.tokenPayload.RufsGroupOwner
+	}
+
+	rufsGroupEntries, _ := rf.microService.openapi.getPropertiesWithRef(rf.schemaName, "#/components/schemas/rufsGroup")
+
+	for _, entry := range rufsGroupEntries {
+		groups := rf.tokenPayload.Groups
+
+		if groups == nil {
+			groups = []int{}
+		}
+
+		scope[entry["fieldName"].(string)] = groups
+	}
+
+	return scope
+}
+
+// tenantApply add the tenant scope to the conditions of fields (used by Find, FindOne, Update and DeleteOne),
+// keeping the conditions of the client that are inside the scope.
+func (rf *RequestFilter) tenantApply(fields map[string]any) {
+	for fieldName, value := range rf.tenantScope() {
+		if groups, ok := value.([]int); ok && fields[fieldName] != nil && slices.Contains(groups, UtilsToInt(fields[fieldName])) {
+			continue
+		}
+
+		fields[fieldName] = value
+	}
+}
+
+// tenantCheck fill the missing rufsGroupOwner of obj with the one of the user, and refuse objects of other rufsGroupOwner or rufsGroup.
+// The missing rufsGroup receive the group of the user when it has only one, otherwise it is refused, because the rows without group
+// would be out of the scope of the user (and of the policies of row level security) after the write.
+func (rf *RequestFilter) tenantCheck(obj map[string]any) error {
+	for fieldName, value := range rf.tenantScope() {
+		if groups, ok := value.([]int); ok {
+			if obj[fieldName] == nil {
+				if len(groups) != 1 {
+					return fmt.Errorf("[RequestFilter.tenantCheck] missing rufsGroup in field %s", fieldName)
+				}
+
+				obj[fieldName] = groups[0]
+			} else if !slices.Contains(groups, UtilsToInt(obj[fieldName])) {
+				return fmt.Errorf("[RequestFilter.tenantCheck] unauthorized object rufsGroup")
+			}
+		} else if obj[fieldName] == nil {
+			obj[fieldName] = value
+		} else if UtilsToInt(obj[fieldName]) != value {
+			return fmt.Errorf("[RequestFilter.tenantCheck] unauthorized object rufsGroupOwner")
+		}
+	}
+
+	return nil
+}
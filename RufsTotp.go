@@ -0,0 +1,302 @@
+package rufsBase
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"golang.org/x/exp/slices"
+)
+
+// RufsTotp is the second factor of one rufsUser (RFC 6238 : HMAC-SHA1, 6 digits, 30 seconds).
+// The login is only completed when Enabled, after the user confirm the first code.
+type RufsTotp struct {
+	Id            int       `json:"id"`
+	RufsUser      int       `json:"rufsUser"`
+	Secret        string    `json:"secret"`
+	Enabled       bool      `json:"enabled"`
+	RecoveryCodes []string  `json:"recoveryCodes"`
+	LastUsedStep  int       `json:"lastUsedStep"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(secret)
+
+	if err != nil {
+		return "", fmt.Errorf("[totpCode] invalid secret : %s", err)
+	}
+
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000), nil
+}
+
+func totpToMap(totp *RufsTotp) map[string]any {
+	obj := map[string]any{}
+	data, _ := json.Marshal(totp)
+	json.Unmarshal(data, &obj)
+
+	if totp.Id == 0 {
+		delete(obj, "id")
+	}
+
+	return obj
+}
+
+func (rms *RufsMicroService) totpFind(userId int) (*RufsTotp, error) {
+	obj, err := rms.getEntityManager("rufsTotp").FindOne("rufsTotp", map[string]any{"rufsUser": userId})
+
+	if err != nil || obj == nil {
+		return nil, err
+	}
+
+	totp := &RufsTotp{}
+	data, _ := json.Marshal(obj)
+
+	if err := json.Unmarshal(data, totp); err != nil {
+		UtilsShowJsonUnmarshalError(string(data), err)
+		return nil, err
+	}
+
+	return totp, nil
+}
+
+// totpEnabled return true when the user must inform the second factor to login, failures count as enabled.
+func (rms *RufsMicroService) totpEnabled(userId int) bool {
+	totp, err := rms.totpFind(userId)
+	return err != nil || (totp != nil && totp.Enabled)
+}
+
+// totpVerify accept one code of the current, previous or next time step, never twice, or one unused recovery code.
+func (rms *RufsMicroService) totpVerify(totp *RufsTotp, code string) (bool, error) {
+	step := time.Now().Unix() / 30
+
+	for _, delta := range []int64{-1, 0, 1} {
+		if int(step+delta) <= totp.LastUsedStep {
+			continue
+		}
+
+		if expected, err := totpCode(totp.Secret, step+delta); err != nil {
+			return false, err
+		} else if hmac.Equal([]byte(expected), []byte(code)) {
+			totp.LastUsedStep = int(step + delta)
+			_, err := rms.getEntityManager("rufsTotp").Update("rufsTotp", map[string]any{"id": totp.Id}, totpToMap(totp))
+			return true, err
+		}
+	}
+
+	if idx := slices.Index(totp.RecoveryCodes, rufsSessionHash(code)); idx >= 0 {
+		totp.RecoveryCodes = slices.Delete(totp.RecoveryCodes, idx, idx+1)
+		_, err := rms.getEntityManager("rufsTotp").Update("rufsTotp", map[string]any{"id": totp.Id}, totpToMap(totp))
+		return true, err
+	}
+
+	return false, nil
+}
+
+// totpChallenge return the token that identify the user, already authenticated by password, in the second step of login.
+func totpChallenge(userId int) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &jwt.StandardClaims{Subject: strconv.Itoa(userId), Audience: "rufs-totp", ExpiresAt: time.Now().Add(5 * time.Minute).Unix()})
+	return token.SignedString(rufsJwtSecret())
+}
+
+func totpChallengeUser(tokenString string) (int, error) {
+	claims := &jwt.StandardClaims{}
+
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (any, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		return rufsJwtSecret(), nil
+	})
+
+	if err != nil || !claims.VerifyAudience("rufs-totp", true) {
+		return 0, fmt.Errorf("[totpChallengeUser] invalid or expired totpToken : %v", err)
+	}
+
+	return strconv.Atoi(claims.Subject)
+}
+
+// onRequestLoginTotp is the second step of login, that exchange the totpToken and one code for the login response.
+func (rms *RufsMicroService) onRequestLoginTotp(req *http.Request) Response {
+	loginRequest := map[string]string{}
+
+	if err := json.NewDecoder(req.Body).Decode(&loginRequest); err != nil {
+		return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestLoginTotp] : %s", err))
+	}
+
+	userId, err := totpChallengeUser(loginRequest["totpToken"])
+
+	if err != nil {
+		return ResponseUnauthorized(fmt.Sprint(err))
+	}
+
+	totp, err := rms.totpFind(userId)
+
+	if err != nil || totp == nil || !totp.Enabled {
+		return ResponseUnauthorized(fmt.Sprintf("[RufsMicroService.onRequestLoginTotp] two-factor authentication is not enabled : %v", err))
+	}
+
+	userMap, err := rms.getEntityManager("rufsUser").FindOne("rufsUser", map[string]any{"id": userId})
+
+	if err != nil || userMap == nil {
+		return ResponseUnauthorized(fmt.Sprintf("[RufsMicroService.onRequestLoginTotp] missing rufsUser %d : %v", userId, err))
+	}
+
+	user := &RufsUser{}
+	data, _ := json.Marshal(userMap)
+
+	if err := json.Unmarshal(data, user); err != nil {
+		UtilsShowJsonUnmarshalError(string(data), err)
+		return ResponseInternalServerError(fmt.Sprint(err))
+	}
+
+	if rms.loginLockout.isLocked(user.Name) {
+		return ResponseUnauthorized("User temporarily locked by excess of wrong passwords.")
+	}
+
+	if ok, err := rms.totpVerify(totp, loginRequest["code"]); err != nil {
+		return ResponseInternalServerError(fmt.Sprint(err))
+	} else if !ok {
+		rms.loginLockout.registerFailure(user.Name)
+		return ResponseUnauthorized("[RufsMicroService.onRequestLoginTotp] invalid code")
+	}
+
+	loginResponse, err := rms.buildLoginResponse(user, req.RemoteAddr)
+
+	if err != nil {
+		return ResponseInternalServerError(fmt.Sprint(err))
+	}
+
+	rms.loginResponseFillOpenApi(loginResponse)
+
+	if err := rms.sessionCreate(loginResponse); err != nil {
+		return ResponseInternalServerError(fmt.Sprint(err))
+	}
+
+	return ResponseOk(loginResponse)
+}
+
+// onRequestTotp manage the second factor of the logged user :
+// "enroll" generate the secret, the otpauth uri and the recovery codes (showed only once),
+// "activate" enable it with the first code and "disable" remove it with one code (administrators can disable by rufsUser).
+func (rms *RufsMicroService) onRequestTotp(req *http.Request, action string) Response {
+	claims, err := rms.authorizationClaims(req)
+
+	if err != nil {
+		return ResponseUnauthorized(fmt.Sprint(err))
+	}
+
+	totpRequest := map[string]any{}
+
+	if err := json.NewDecoder(req.Body).Decode(&totpRequest); err != nil && action != "enroll" {
+		return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestTotp] : %s", err))
+	}
+
+	entityManager := rms.getEntityManager("rufsTotp")
+	userId := claims.TokenPayload.Id
+	code, _ := totpRequest["code"].(string)
+
+	if action == "disable" && totpRequest["rufsUser"] != nil && claims.TokenPayload.isAdmin() {
+		userId = UtilsToInt(totpRequest["rufsUser"])
+	}
+
+	totp, err := rms.totpFind(userId)
+
+	if err != nil {
+		return ResponseInternalServerError(fmt.Sprint(err))
+	}
+
+	switch action {
+	case "enroll":
+		if totp != nil && totp.Enabled {
+			return ResponseBadRequest("[RufsMicroService.onRequestTotp] two-factor authentication already enabled, disable it before a new enroll")
+		}
+
+		secret := make([]byte, 20)
+
+		if _, err := rand.Read(secret); err != nil {
+			return ResponseInternalServerError(fmt.Sprint(err))
+		}
+
+		recoveryCodes := []string{}
+		newTotp := &RufsTotp{RufsUser: userId, Secret: totpEncoding.EncodeToString(secret), RecoveryCodes: []string{}, CreatedAt: time.Now()}
+
+		for i := 0; i < 10; i++ {
+			recoveryCode := rufsSessionRandomString(5)
+			recoveryCodes = append(recoveryCodes, recoveryCode)
+			newTotp.RecoveryCodes = append(newTotp.RecoveryCodes, rufsSessionHash(recoveryCode))
+		}
+
+		if totp != nil {
+			newTotp.Id = totp.Id
+			_, err = entityManager.Update("rufsTotp", map[string]any{"id": totp.Id}, totpToMap(newTotp))
+		} else {
+			_, err = entityManager.Insert("rufsTotp", totpToMap(newTotp))
+		}
+
+		if err != nil {
+			return ResponseInternalServerError(fmt.Sprintf("[RufsMicroService.onRequestTotp] : %s", err))
+		}
+
+		issuer := rms.appName
+
+		if issuer == "" {
+			issuer = "rufs"
+		}
+
+		query := url.Values{}
+		query.Set("secret", newTotp.Secret)
+		query.Set("issuer", issuer)
+		query.Set("algorithm", "SHA1")
+		query.Set("digits", "6")
+		query.Set("period", "30")
+		uri := fmt.Sprintf("otpauth://totp/%s:%s?%s", url.PathEscape(issuer), url.PathEscape(claims.TokenPayload.Name), query.Encode())
+		return ResponseOk(map[string]any{"secret": newTotp.Secret, "uri": uri, "recoveryCodes": recoveryCodes})
+	case "activate", "disable":
+		if totp == nil {
+			return ResponseBadRequest("[RufsMicroService.onRequestTotp] missing enroll of two-factor authentication")
+		}
+
+		if userId == claims.TokenPayload.Id {
+			if ok, err := rms.totpVerify(totp, code); err != nil {
+				return ResponseInternalServerError(fmt.Sprint(err))
+			} else if !ok {
+				return ResponseUnauthorized("[RufsMicroService.onRequestTotp] invalid code")
+			}
+		}
+
+		if action == "activate" {
+			totp.Enabled = true
+			_, err = entityManager.Update("rufsTotp", map[string]any{"id": totp.Id}, totpToMap(totp))
+		} else {
+			err = entityManager.DeleteOne("rufsTotp", map[string]any{"id": totp.Id})
+		}
+
+		if err != nil {
+			return ResponseInternalServerError(fmt.Sprintf("[RufsMicroService.onRequestTotp] : %s", err))
+		}
+
+		return ResponseOk(map[string]any{})
+	}
+
+	return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestTotp] unknown action %s", action))
+}
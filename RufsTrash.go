@@ -0,0 +1,203 @@
+package rufsBase
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/derekstavis/go-qs"
+	"golang.org/x/exp/slices"
+)
+
+// Schemas with the field deletedAt (and optionally deletedBy, the id of the user) have soft delete : DELETE only mark
+// the row, the queries and reads ignore the marked rows, the administrators list and restore them in /rest/trash and
+// the rows marked before RUFS_TRASH_RETENTION (default 720h) are removed by trashPurge.
+var softDeleteFields = []string{"deletedAt", "deletedBy"}
+
+func (schema *Schema) softDelete() bool {
+	_, ok := schema.Properties["deletedAt"]
+	return ok
+}
+
+func trashRetention() time.Duration {
+	if duration, err := time.ParseDuration(os.Getenv("RUFS_TRASH_RETENTION")); err == nil && duration > 0 {
+		return duration
+	}
+
+	return 30 * 24 * time.Hour
+}
+
+// softDeleteConditions return the condition that exclude the marked rows, empty for schemas without soft delete.
+func (rf *RequestFilter) softDeleteConditions() []*RufsQueryCondition {
+	if schema, ok := rf.microService.openapi.getSchemaFromSchemas(rf.schemaName); ok && schema.softDelete() {
+		return []*RufsQueryCondition{{"deletedAt", "isnull", true}}
+	}
+
+	return []*RufsQueryCondition{}
+}
+
+func (rf *RequestFilter) inTrash(obj map[string]any) bool {
+	return obj != nil && obj["deletedAt"] != nil && len(rf.softDeleteConditions()) > 0
+}
+
+// softDeleteWritable is false for the fields of soft delete, written only by DELETE and /trash.
+func (rf *RequestFilter) softDeleteWritable(fieldName string) bool {
+	return !slices.Contains(softDeleteFields, fieldName) || len(rf.softDeleteConditions()) == 0
+}
+
+// softDeleteMark mark (or unmark to restore) the row of primaryKey as deleted by the user.
+func (rf *RequestFilter) softDeleteMark(primaryKey map[string]any, mark bool) (map[string]any, error) {
+	schema, ok := rf.microService.openapi.getSchemaFromSchemas(rf.schemaName)
+
+	if !ok {
+		return nil, fmt.Errorf("[RequestFilter.softDeleteMark] missing schema %s", rf.schemaName)
+	}
+
+	obj := map[string]any{"deletedAt": nil}
+
+	if mark {
+		obj["deletedAt"] = time.Now().UTC()
+	}
+
+	if _, ok := schema.Properties["deletedBy"]; ok {
+		obj["deletedBy"] = nil
+
+		if mark && rf.tokenPayload != nil {
+			obj["deletedBy"] = rf.tokenPayload.Id
+		}
+	}
+
+	return rf.entityManager.Update(rf.schemaName, primaryKey, obj)
+}
+
+// onRequestTrash list (GET /rest/trash?schemaName=<schema>) and restore (POST /rest/trash?schemaName=<schema>&<primary key>)
+// the rows marked by soft delete, only for administrators.
+func (rms *RufsMicroService) onRequestTrash(req *http.Request) Response {
+	claims, err := rms.authorizationClaims(req)
+
+	if err != nil {
+		return ResponseUnauthorized(fmt.Sprint(err))
+	}
+
+	if !claims.TokenPayload.isAdmin() {
+		return ResponseUnauthorized("[RufsMicroService.onRequestTrash] only administrators can see the trash")
+	}
+
+	query := map[string]any{}
+
+	if req.URL.RawQuery != "" {
+		if query, err = qs.Unmarshal(req.URL.RawQuery); err != nil {
+			return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestTrash] fail to parse url query parameters : %s", err))
+		}
+	}
+
+	schemaName, _ := query["schemaName"].(string)
+	schema, ok := rms.openapi.getSchemaFromSchemas(schemaName)
+
+	if !ok || !schema.softDelete() {
+		return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestTrash] schema %s don't have soft delete", schemaName))
+	}
+
+	rf := &RequestFilter{microService: rms, tokenPayload: &claims.TokenPayload, schemaName: schemaName, parameters: query, entityManager: rms.getEntityManager(schemaName)}
+	rf.path = "/" + CamelToUnderscore(schemaName)
+
+	if dbClientSql, ok := rf.entityManager.(*DbClientSql); ok && dbClientSql.dbConfig.rowLevelSecurity {
+		rf.entityManager = dbClientSql.withTenant(rf.tokenPayload)
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		rf.method = "get"
+		sortFields := []string{"-deletedAt"}
+
+		for _, fieldName := range schema.PrimaryKeys {
+			sortFields = append(sortFields, "-"+fieldName)
+		}
+
+		list, _, err := rf.entityManager.Query(schemaName, &RufsQuery{Conditions: []*RufsQueryCondition{{"deletedAt", "isnull", false}}, Sort: sortFields})
+
+		if err != nil {
+			return ResponseInternalServerError(fmt.Sprintf("[RufsMicroService.onRequestTrash] : %s", err))
+		}
+
+		listOut := make([]map[string]any, 0, len(list))
+
+		for _, item := range list {
+			listOut = append(listOut, rf.filterReadable(rf.tokenPayload, item))
+		}
+
+		return ResponseOk(listOut)
+	case http.MethodPost:
+		rf.method = "put"
+		primaryKey, err := rms.openapi.copyFields(schema, query, false, false, true)
+
+		if err != nil || len(primaryKey) != len(schema.PrimaryKeys) {
+			return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestTrash] missing primary key of %s", schemaName))
+		}
+
+		obj, err := rf.entityManager.FindOne(schemaName, primaryKey)
+
+		if err != nil || obj == nil || obj["deletedAt"] == nil {
+			return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestTrash] don't find %v in trash of %s", primaryKey, schemaName))
+		}
+
+		newObj, err := rf.softDeleteMark(primaryKey, false)
+
+		if err != nil {
+			return ResponseInternalServerError(fmt.Sprintf("[RufsMicroService.onRequestTrash] : %s", err))
+		}
+
+		rf.audit("restore", obj, newObj)
+		rf.notify(newObj, false)
+		return rf.responseWithETag(newObj, http.StatusOK)
+	}
+
+	return ResponseBadRequest(fmt.Sprintf("[RufsMicroService.onRequestTrash] unsupported method %s", req.Method))
+}
+
+// trashPurge remove the rows marked by soft delete before now less the retention.
+func (rms *RufsMicroService) trashPurge(now time.Time) error {
+	limit := now.Add(-trashRetention())
+
+	for schemaName, schema := range rms.openapi.Components.Schemas {
+		if !schema.softDelete() {
+			continue
+		}
+
+		entityManager := rms.getEntityManager(schemaName)
+		list, _, err := entityManager.Query(schemaName, &RufsQuery{Conditions: []*RufsQueryCondition{{"deletedAt", "lt", limit}}})
+
+		if err != nil {
+			return fmt.Errorf("[RufsMicroService.trashPurge] fail to find the expired rows of %s : %s", schemaName, err)
+		}
+
+		for _, item := range list {
+			primaryKey, _ := rms.openapi.copyFields(schema, item, false, false, true)
+
+			if err := entityManager.DeleteOne(schemaName, primaryKey); err != nil {
+				return fmt.Errorf("[RufsMicroService.trashPurge] fail to remove %v of %s : %s", primaryKey, schemaName, err)
+			}
+		}
+
+		if len(list) > 0 {
+			log.Printf("[RufsMicroService.trashPurge] removed %d rows of %s deleted before %s", len(list), schemaName, limit.Format(time.RFC3339))
+		}
+	}
+
+	return nil
+}
+
+// trashPurgeStart run trashPurge at start and after each hour.
+func (rms *RufsMicroService) trashPurgeStart() {
+	go func() {
+		for {
+			if err := rms.trashPurge(time.Now()); err != nil {
+				log.Print(err)
+			}
+
+			time.Sleep(time.Hour)
+		}
+	}()
+}
@@ -190,6 +190,7 @@ type ServerConnection struct {
 	loginResponse LoginResponse
 	webSocket     *websocket.Conn
 	lastMessage   NotifyMessage
+	authPath      string
 }
 
 /*
@@ -313,13 +314,40 @@ func (sc *ServerConnection) Login(server string, path string, loginPath string,
 	}
 
 	sc.httpRest.Init(server)
+	sc.authPath = strings.TrimSuffix(loginPath, "/login")
 	loginRequestData := map[string]string{"user": user, "password": password}
+	sc.loginResponse = LoginResponse{}
 	resp, err = RufsRestRequest(&sc.httpRest, loginPath, http.MethodPost, nil, &loginRequestData, &sc.loginResponse)
 
 	if err != nil || resp.StatusCode != http.StatusOK {
 		return resp, err
 	}
 
+	if sc.loginResponse.TotpToken != "" {
+		return resp, fmt.Errorf("[ServerConnection.Login] two-factor code required, use LoginTotp")
+	}
+
+	sc.loginCompleted(path)
+	return resp, err
+}
+
+// LoginTotp complete the login of users with two-factor authentication enabled.
+func (sc *ServerConnection) LoginTotp(path string, code string) (resp *http.Response, err error) {
+	path = strings.Trim(path, "/")
+	loginRequestData := map[string]string{"totpToken": sc.loginResponse.TotpToken, "code": code}
+	resp, err = RufsRestRequest(&sc.httpRest, sc.authPath+"/login_totp", http.MethodPost, nil, &loginRequestData, &sc.loginResponse)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+
+	sc.loginResponse.TotpToken = ""
+
+	sc.loginCompleted(path)
+	return resp, err
+}
+
+func (sc *ServerConnection) loginCompleted(path string) {
 	sc.httpRest.Token = sc.loginResponse.JwtHeader
 	/*
 		const schemas = [];
@@ -385,16 +413,36 @@ func (sc *ServerConnection) Login(server string, path string, loginPath string,
 		});
 	*/
 	sc.webSocketConnect(path)
+}
+
+func (sc *ServerConnection) Refresh() (resp *http.Response, err error) {
+	refreshRequestData := map[string]string{"refreshToken": sc.loginResponse.RefreshToken}
+	resp, err = RufsRestRequest(&sc.httpRest, sc.authPath+"/refresh", http.MethodPost, nil, &refreshRequestData, &sc.loginResponse)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+
+	sc.httpRest.Token = sc.loginResponse.JwtHeader
 	return resp, err
 }
 
-func (sc *ServerConnection) logout() {
-	//	sc.webSocket.close()
+func (sc *ServerConnection) logout() (resp *http.Response, err error) {
+	if sc.httpRest.Token != "" {
+		resp, err = RufsRestRequest[any, any](&sc.httpRest, sc.authPath+"/logout", http.MethodPost, nil, nil, nil)
+	}
+
+	if sc.webSocket != nil {
+		sc.webSocket.Close()
+	}
+
 	sc.httpRest.Token = ""
+	sc.loginResponse.RefreshToken = ""
 	/*
 		// limpa todos os dados da sessão anterior
 		for (let serviceName in sc.services) {
 			delete sc.services[serviceName];
 		}
 	*/
+	return resp, err
 }
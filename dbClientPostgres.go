@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -25,6 +26,7 @@ type DbConfig struct {
 	limitQuery             int
 	limitQueryExceptions   []string
 	requestBodyContentType string
+	rowLevelSecurity       bool
 }
 
 type DbClientSql struct {
@@ -37,6 +39,9 @@ type DbClientSql struct {
 	client                     *sql.DB
 	sqlTypes                   []string
 	rufsTypes                  []string
+	tenantRufsGroupOwner       int
+	tenantGroups               []int
+	tx                         *sql.Tx
 }
 
 /*
@@ -81,6 +86,10 @@ func (dbSql *DbClientSql) Connect() (err error) {
 	}
 
 	dataSourceName := fmt.Sprintf("postgres://%s:%s@localhost:5432/%s", dbSql.dbConfig.user, dbSql.dbConfig.password, dbSql.dbConfig.database)
+	if os.Getenv("RUFS_ROW_LEVEL_SECURITY") == "true" {
+		dbSql.dbConfig.rowLevelSecurity = true
+	}
+
 	dbSql.dbConfig.driverName = "pgx"
 	dbSql.client, err = sql.Open(dbSql.dbConfig.driverName, dataSourceName)
 
@@ -95,83 +104,158 @@ func (dbSql *DbClientSql) Disconnect() error {
 	return dbSql.client.Close()
 }
 
-func (dbSql *DbClientSql) buildQuery(queryParams map[string]any, params *[]any, orderBy []string) string {
-	buildConditions := func(queryParams map[string]any, params *[]any, operator string, conditions *[]string) {
-		count := 1
+// buildConditions return the sql of conditions, with the same result of queryMatchCondition.
+func (dbSql *DbClientSql) buildConditions(conditions []*RufsQueryCondition, params *[]any) []string {
+	operators := map[string]string{"eq": "=", "ne": "<>", "lt": "<", "lte": "<=", "gt": ">", "gte": ">=", "like": "LIKE", "ilike": "ILIKE"}
+	list := []string{}
 
-		for fieldName, field := range queryParams {
-			/*
-				if value, ok := dbSql.options.aliasMapExternalToInternal[fieldName]; ok {
-					fieldName = value
+	for _, condition := range conditions {
+		/*
+			if value, ok := dbSql.options.aliasMapExternalToInternal[fieldName]; ok {
+				fieldName = value
+			}
+		*/
+		columnName := CamelToUnderscore(condition.Field)
+		value := condition.Value
+		// the nested fields of json columns (ex. primaryKey.id) are compared as text
+		if tokens := strings.Split(condition.Field, "."); len(tokens) > 1 {
+			columnName = CamelToUnderscore(tokens[0])
+
+			for i, token := range tokens[1:] {
+				operator := "->"
+
+				if i == len(tokens)-2 {
+					operator = "->>"
 				}
-			*/
-			paramId := fmt.Sprintf("$%d", count)
-			count++
-			var condition string
 
-			switch value := field.(type) {
-			case []any:
-				condition = CamelToUnderscore(fieldName) + operator + " ANY (" + paramId + ")"
-			case []string:
-				fmt.Printf("Unexpected case condition of %s", value)
-				condition = CamelToUnderscore(fieldName) + operator + paramId
-			default:
-				condition = CamelToUnderscore(fieldName) + operator + paramId
+				*params = append(*params, token)
+				columnName += fmt.Sprintf(" %s $%d", operator, len(*params))
 			}
 
-			*conditions = append(*conditions, condition)
-			*params = append(*params, field)
+			columnName = "(" + columnName + ")"
+
+			if list, ok := filterList(value); ok {
+				texts := []string{}
+
+				for _, item := range list {
+					texts = append(texts, fmt.Sprint(item))
+				}
+
+				value = texts
+			} else if value != nil {
+				value = fmt.Sprint(value)
+			}
 		}
-	}
+		// params may already have values from the SET clause of UPDATE
+		paramId := fmt.Sprintf("$%d", len(*params)+1)
 
-	conditions := []string{}
-	filter, okFilter := queryParams["filter"]
-	filterRangeMin, okFilterRangeMin := queryParams["filterRangeMin"]
-	filterRangeMax, okFilterRangeMax := queryParams["filterRangeMax"]
+		switch condition.Operator {
+		case "isnull":
+			if condition.Value == true {
+				list = append(list, columnName+" IS NULL")
+			} else {
+				list = append(list, columnName+" IS NOT NULL")
+			}
 
-	if okFilter || okFilterRangeMin || okFilterRangeMax {
-		if okFilter {
-			buildConditions(filter.(map[string]any), params, "=", &conditions)
+			continue
+		case "in":
+			list = append(list, columnName+" = ANY ("+paramId+")")
+			*params = append(*params, queryArray(value))
+			continue
+		case "like", "ilike":
+			columnName = "CAST(" + columnName + " AS TEXT)"
 		}
-		if okFilterRangeMin {
-			buildConditions(filterRangeMin.(map[string]any), params, ">", &conditions)
+
+		list = append(list, columnName+" "+operators[condition.Operator]+" "+paramId)
+		*params = append(*params, value)
+	}
+
+	return list
+}
+
+// buildWhere return the WHERE clause of conditions and of the alternatives of cursor.
+func (dbSql *DbClientSql) buildWhere(conditions []*RufsQueryCondition, cursor [][]*RufsQueryCondition, params *[]any) string {
+	list := dbSql.buildConditions(conditions, params)
+
+	if len(cursor) > 0 {
+		alternatives := []string{}
+
+		for _, item := range cursor {
+			alternatives = append(alternatives, "("+strings.Join(dbSql.buildConditions(item, params), " AND ")+")")
 		}
-		if okFilterRangeMax {
-			buildConditions(filterRangeMax.(map[string]any), params, "<", &conditions)
+
+		list = append(list, "("+strings.Join(alternatives, " OR ")+")")
+	}
+
+	if len(list) == 0 {
+		return ""
+	}
+
+	return " WHERE " + strings.Join(list, " AND ")
+}
+
+func (dbSql *DbClientSql) buildOrderBy(sortFields []string) string {
+	if len(sortFields) == 0 {
+		return ""
+	}
+
+	orderByInternal := []string{}
+
+	for _, fieldName := range sortFields {
+		/*
+			if dbSql.options.aliasMapExternalToInternal[fieldName] != null {
+				fieldName = dbSql.options.aliasMapExternalToInternal[fieldName]
+			}
+		*/
+		if strings.HasPrefix(fieldName, "-") {
+			orderByInternal = append(orderByInternal, CamelToUnderscore(fieldName[1:])+" DESC")
+		} else {
+			orderByInternal = append(orderByInternal, CamelToUnderscore(fieldName))
 		}
-	} else if len(queryParams) > 0 {
-		buildConditions(queryParams, params, "=", &conditions)
 	}
 
-	str := ""
+	return " ORDER BY " + strings.Join(orderByInternal, ",")
+}
+
+func (dbSql *DbClientSql) buildQuery(queryParams map[string]any, params *[]any, orderBy []string) string {
+	return dbSql.buildWhere(queryConditionsFromFields(queryParams), nil, params) + dbSql.buildOrderBy(queryOrderBy(orderBy))
+}
 
-	if len(conditions) > 0 {
-		str = " WHERE " + strings.Join(conditions, " AND ")
+// queryArray return the list of values of operator "in" with one type accepted by the driver.
+func queryArray(value any) any {
+	list, ok := filterList(value)
+
+	if !ok || len(list) == 0 {
+		return value
 	}
 
-	if len(orderBy) > 0 {
-		orderByInternal := []string{}
+	switch list[0].(type) {
+	case int, int32, int64:
+		ret := []int64{}
 
-		for _, fieldName := range orderBy {
-			pos := strings.Index(fieldName, " ")
-			extra := ""
+		for _, item := range list {
+			ret = append(ret, int64(UtilsToInt(item)))
+		}
 
-			if pos >= 0 {
-				extra = fieldName[pos:]
-				fieldName = fieldName[0:pos]
-			}
-			/*
-				if dbSql.options.aliasMapExternalToInternal[fieldName] != null {
-					fieldName = dbSql.options.aliasMapExternalToInternal[fieldName]
-				}
-			*/
-			orderByInternal = append(orderByInternal, CamelToUnderscore(fieldName)+extra)
+		return ret
+	case float64:
+		ret := []float64{}
+
+		for _, item := range list {
+			number, _ := filterNormalizeNumber(item).(float64)
+			ret = append(ret, number)
 		}
 
-		str = str + " ORDER BY " + strings.Join(orderByInternal, ",")
+		return ret
+	}
+
+	ret := []string{}
+
+	for _, item := range list {
+		ret = append(ret, fmt.Sprint(item))
 	}
 
-	return str
+	return ret
 }
 
 func (dbSql *DbClientSql) Insert(schemaName string, obj map[string]any) (map[string]any, error) {
@@ -237,17 +321,24 @@ func (dbSql *DbClientSql) Insert(schemaName string, obj map[string]any) (map[str
 	params := []any{}
 	sql := buildInsertSql(schemaName, schema, obj, &params)
 	fmt.Println(sql)
-	rows, err := dbSql.client.Query(sql, params...)
+	var item map[string]any
 
-	if err != nil {
-		return nil, err
-	}
+	err := dbSql.withSession(func(queryer dbSqlQueryer) error {
+		rows, err := queryer.Query(sql, params...)
 
-	if rows.Next() == false {
-		return nil, fmt.Errorf(`Failt to insert : %s : %s`, sql, rows.Err())
-	}
+		if err != nil {
+			return err
+		}
 
-	item, err := dbSql.getMapFromRow(rows, schema)
+		defer rows.Close()
+
+		if rows.Next() == false {
+			return fmt.Errorf(`Failt to insert : %s : %s`, sql, rows.Err())
+		}
+
+		item, err = dbSql.getMapFromRow(rows, schema)
+		return err
+	})
 
 	if err != nil {
 		return nil, err
@@ -256,26 +347,29 @@ func (dbSql *DbClientSql) Insert(schemaName string, obj map[string]any) (map[str
 	return item, nil
 }
 
-func (dbSql *DbClientSql) Find(schemaName string, queryParams map[string]any, orderBy []string) ([]map[string]any, error) {
+// buildSelect return the SELECT of schemaName with the fields, conditions and order of query, limited by limitQuery.
+func (dbSql *DbClientSql) buildSelect(schemaName string, query *RufsQuery, params *[]any) (string, *Schema, error) {
 	tableName := CamelToUnderscore(schemaName)
-	params := []any{}
-	sqlQuery := dbSql.buildQuery(queryParams, &params, orderBy)
 	fieldsOut := "*"
 
 	if dbSql.openapi == nil {
-		return nil, fmt.Errorf(`Missing openapi`)
+		return "", nil, fmt.Errorf(`Missing openapi`)
 	}
 
 	schema, ok := dbSql.openapi.getSchemaFromSchemas(schemaName)
 
 	if !ok {
-		return nil, fmt.Errorf(`[dbClientSql.Find] : Missing schema %s`, schemaName)
+		return "", nil, fmt.Errorf(`[dbClientSql.Find] : Missing schema %s`, schemaName)
 	}
 
 	count := 0
 	names := []string{}
 
 	for fieldName, property := range schema.Properties {
+		if query.Fields != nil && !slices.Contains(query.Fields, fieldName) {
+			continue
+		}
+
 		if property.InternalName != "" {
 			count++
 			names = append(names, CamelToUnderscore(property.InternalName)+" as "+CamelToUnderscore(fieldName))
@@ -284,26 +378,75 @@ func (dbSql *DbClientSql) Find(schemaName string, queryParams map[string]any, or
 		}
 	}
 
-	if count > 0 {
+	if count > 0 || (query.Fields != nil && len(names) > 0) {
 		fieldsOut = strings.Join(names, ",")
 	}
 
+	if slices.Contains(dbSql.dbConfig.limitQueryExceptions, tableName) == false && (query.Limit <= 0 || query.Limit > dbSql.dbConfig.limitQuery) {
+		query.Limit = dbSql.dbConfig.limitQuery
+	}
+
 	sqlFirst := ""
 	sqlLimit := ""
 
-	if slices.Contains(dbSql.dbConfig.limitQueryExceptions, tableName) == false {
+	if query.Limit > 0 {
+		if dbSql.dbConfig.driverName == "firebird" {
+			sqlFirst = fmt.Sprintf(`FIRST %d SKIP %d`, query.Limit, query.Offset)
+		} else {
+			sqlLimit = fmt.Sprintf(`LIMIT %d OFFSET %d`, query.Limit, query.Offset)
+		}
+	} else if query.Offset > 0 {
 		if dbSql.dbConfig.driverName == "firebird" {
-			sqlFirst = fmt.Sprintf(`FIRST %d`, dbSql.dbConfig.limitQuery)
+			sqlFirst = fmt.Sprintf(`SKIP %d`, query.Offset)
 		} else {
-			sqlLimit = fmt.Sprintf(`LIMIT %d`, dbSql.dbConfig.limitQuery)
+			sqlLimit = fmt.Sprintf(`OFFSET %d`, query.Offset)
 		}
 	}
 
+	sqlQuery := dbSql.buildWhere(query.Conditions, query.Cursor, params) + dbSql.buildOrderBy(query.Sort)
 	sql := fmt.Sprintf(`SELECT %s %s FROM %s %s %s`, sqlFirst, fieldsOut, tableName, sqlQuery, sqlLimit)
+	return sql, schema, nil
+}
+
+func (dbSql *DbClientSql) Find(schemaName string, queryParams map[string]any, orderBy []string) ([]map[string]any, error) {
+	params := []any{}
+	query := &RufsQuery{Conditions: queryConditionsFromFields(queryParams), Sort: queryOrderBy(orderBy)}
+	sql, schema, err := dbSql.buildSelect(schemaName, query, &params)
+
+	if err != nil {
+		return nil, err
+	}
+
 	fmt.Println(sql)
 	return dbSql.getArrayMap(sql, params, schema)
 }
 
+// Query return one page of rows of query and the count of rows of its conditions.
+func (dbSql *DbClientSql) Query(schemaName string, query *RufsQuery) ([]map[string]any, int, error) {
+	params := []any{}
+	sql, schema, err := dbSql.buildSelect(schemaName, query, &params)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	list, err := dbSql.getArrayMap(sql, params, schema)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	paramsCount := []any{}
+	sqlCount := fmt.Sprintf(`SELECT COUNT(*) AS total FROM %s %s`, CamelToUnderscore(schemaName), dbSql.buildWhere(query.Conditions, nil, &paramsCount))
+	result, err := dbSql.getArrayMap(sqlCount, paramsCount, nil)
+
+	if err != nil || len(result) == 0 {
+		return nil, 0, fmt.Errorf("[DbClientSql.Query] fail to count rows : %s", err)
+	}
+
+	return list, UtilsToInt(result[0]["total"]), nil
+}
+
 func (dbSql *DbClientSql) FindOne(tableName string, queryParams map[string]any) (map[string]any, error) {
 	list, err := dbSql.Find(tableName, queryParams, []string{})
 
@@ -341,7 +484,6 @@ func (dbSql *DbClientSql) Update(schemaName string, key map[string]any, obj map[
 
 	tableName := CamelToUnderscore(schemaName)
 	params := []any{}
-	sqlQuery := dbSql.buildQuery(key, &params, []string{})
 	list := []string{}
 	idx := 1
 
@@ -376,19 +518,27 @@ func (dbSql *DbClientSql) Update(schemaName string, key map[string]any, obj map[
 		}
 	}
 
+	sqlQuery := dbSql.buildQuery(key, &params, []string{})
 	sql := fmt.Sprintf(`UPDATE %s SET %s %s RETURNING *`, tableName, strings.Join(list, ","), sqlQuery)
 	fmt.Println(sql)
-	rows, err := dbSql.client.Query(sql, params...)
+	var item map[string]any
 
-	if err != nil {
-		return nil, err
-	}
+	err := dbSql.withSession(func(queryer dbSqlQueryer) error {
+		rows, err := queryer.Query(sql, params...)
 
-	if rows.Next() == false {
-		return nil, fmt.Errorf(`Failt to update : %s : %s`, sql, rows.Err())
-	}
+		if err != nil {
+			return err
+		}
+
+		defer rows.Close()
 
-	item, err := dbSql.getMapFromRow(rows, schema)
+		if rows.Next() == false {
+			return fmt.Errorf(`Failt to update : %s : %s`, sql, rows.Err())
+		}
+
+		item, err = dbSql.getMapFromRow(rows, schema)
+		return err
+	})
 
 	if err != nil {
 		return nil, err
@@ -403,17 +553,24 @@ func (dbSql *DbClientSql) DeleteOne(schemaName string, key map[string]any) error
 	sqlQuery := dbSql.buildQuery(key, &params, []string{})
 	sql := fmt.Sprintf(`DELETE FROM %s %s`, tableName, sqlQuery)
 	fmt.Println(sql)
-	result, err := dbSql.client.Exec(sql, params...)
+	var numRows int64
 
-	if err != nil {
+	err := dbSql.withSession(func(queryer dbSqlQueryer) error {
+		result, err := queryer.Exec(sql, params...)
+
+		if err != nil {
+			return err
+		}
+
+		numRows, err = result.RowsAffected()
 		return err
-	}
+	})
 
-	if numRows, err := result.RowsAffected(); err != nil || numRows != 1 {
-		return fmt.Errorf(`[dbClientSql.DeleteOne] : wrong delete numRows = %d, err = %s`, numRows, err)
+	if err != nil || numRows != 1 {
+		return fmt.Errorf(`[dbClientSql.DeleteOne] : wrong delete numRows = %d, err = %v`, numRows, err)
 	}
 
-	return err
+	return nil
 }
 
 func (dbSql *DbClientSql) getMapFromRow(rows *sql.Rows, schema *Schema) (map[string]any, error) {
@@ -479,20 +636,30 @@ func (dbSql *DbClientSql) getMapFromRow(rows *sql.Rows, schema *Schema) (map[str
 }
 
 func (dbSql *DbClientSql) getArrayMap(sql string, params []any, schema *Schema) ([]map[string]any, error) {
-	rows, err := dbSql.client.Query(sql, params...)
-
-	if err != nil {
-		return nil, err
-	}
-
 	result := []map[string]any{}
 
-	for rows.Next() {
-		item, err := dbSql.getMapFromRow(rows, schema)
+	err := dbSql.withSession(func(queryer dbSqlQueryer) error {
+		rows, err := queryer.Query(sql, params...)
+
 		if err != nil {
-			return nil, err
+			return err
 		}
-		result = append(result, item)
+
+		defer rows.Close()
+
+		for rows.Next() {
+			item, err := dbSql.getMapFromRow(rows, schema)
+			if err != nil {
+				return err
+			}
+			result = append(result, item)
+		}
+
+		return rows.Err()
+	})
+
+	if err != nil {
+		return nil, err
 	}
 
 	return result, nil
@@ -819,6 +986,11 @@ func (dbSql *DbClientSql) UpdateOpenApi(openapi *OpenApi, options FillOpenApiOpt
 
 	schemas, _ := processColumns()
 	processConstraints(schemas)
+	// the permissions of fields are declared only in openapi
+	for schemaName, schema := range schemas {
+		schemaKeepPermissions(openapi.Components.Schemas[schemaName], schema)
+	}
+
 	options.schemas = schemas
 	dbSql.openapi = openapi
 	openapi.FillOpenApi(options)
@@ -835,7 +1007,13 @@ func (dbSql *DbClientSql) CreateTable(name string, schema *Schema) (sql.Result,
 			}
 		}
 
-		pos := slices.Index(dbSql.rufsTypes, field.Type)
+		rufsType := field.Type
+
+		if field.Format == "date-time" {
+			rufsType = field.Format
+		}
+
+		pos := slices.Index(dbSql.rufsTypes, rufsType)
 
 		if pos < 0 {
 			return "", fmt.Errorf(`[CreateTable(%s).genSqlColumnDescription(%s)] Missing rufsType equivalent of %s`, name, fieldName, field.Type)
@@ -843,12 +1021,12 @@ func (dbSql *DbClientSql) CreateTable(name string, schema *Schema) (sql.Result,
 
 		sqlType := dbSql.sqlTypes[pos]
 
-		if field.Type == "string" && field.MaxLength > 0 && field.MaxLength < 32 {
+		if rufsType == "string" && field.MaxLength > 0 && field.MaxLength < 32 {
 			sqlType = "character"
 		}
 
 		if field.MaxLength == 0 {
-			if field.Type == "string" {
+			if rufsType == "string" {
 				field.MaxLength = 255
 			}
 			if field.Type == "number" {
@@ -0,0 +1,241 @@
+package rufsBase
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// With dbConfig.rowLevelSecurity (or RUFS_ROW_LEVEL_SECURITY=true) the tables with fields that reference rufsGroupOwner or rufsGroup
+// receive two policies. The policy "rufs_tenant", only for the database role of the service, allow the rows of the rufsGroupOwner
+// and of the groups informed in the session variables "rufs.group_owner" and "rufs.groups" (comma separated), or every row when
+// rufs.group_owner is "1". The policy "rufs_tenant_report", for the other roles (reports and tools connected directly in the
+// database), allow only the reading of the rows of the tenant fixed to the role in the table rufs.tenant_role, ex. :
+// INSERT INTO rufs.tenant_role (role_name, rufs_group_owner, groups) VALUES ('report', 2, '{3,4}');
+// The session variables are ignored for these roles, then they can't select other tenants.
+
+type dbSqlQueryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// withTenant return one copy of dbSql that run the statements with the session variables of tokenPayload.
+func (dbSql *DbClientSql) withTenant(tokenPayload *TokenPayload) *DbClientSql {
+	ret := *dbSql
+	ret.tenantRufsGroupOwner = tokenPayload.RufsGroupOwner
+	ret.tenantGroups = tokenPayload.Groups
+	return &ret
+}
+
+// withSession run fn in the transaction of batch, in the connection pool or, with row level security, in one transaction
+// with the session variables of tenant. The statements of the service itself (without tenant) see all rows.
+func (dbSql *DbClientSql) withSession(fn func(queryer dbSqlQueryer) error) error {
+	if dbSql.tx != nil {
+		return fn(dbSql.tx)
+	}
+
+	if !dbSql.dbConfig.rowLevelSecurity {
+		return fn(dbSql.client)
+	}
+
+	tx, err := dbSql.beginSession()
+
+	if err != nil {
+		return err
+	}
+
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// beginSession start one transaction, with the session variables of tenant when using row level security.
+func (dbSql *DbClientSql) beginSession() (*sql.Tx, error) {
+	tx, err := dbSql.client.Begin()
+
+	if err != nil || !dbSql.dbConfig.rowLevelSecurity {
+		return tx, err
+	}
+
+	rufsGroupOwner := dbSql.tenantRufsGroupOwner
+
+	if rufsGroupOwner == 0 {
+		rufsGroupOwner = 1
+	}
+
+	groups := []string{}
+
+	for _, group := range dbSql.tenantGroups {
+		groups = append(groups, strconv.Itoa(group))
+	}
+
+	if _, err = tx.Exec(`SELECT set_config('rufs.group_owner', $1, true), set_config('rufs.groups', $2, true)`, strconv.Itoa(rufsGroupOwner), strings.Join(groups, ",")); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// transaction return one copy of dbSql that run all statements in the same transaction, finished by Commit or Rollback of tx.
+func (dbSql *DbClientSql) transaction(tokenPayload *TokenPayload) (*DbClientSql, error) {
+	ret := dbSql.withTenant(tokenPayload)
+	tx, err := ret.beginSession()
+
+	if err != nil {
+		return nil, fmt.Errorf("[DbClientSql.transaction] : %s", err)
+	}
+
+	ret.tx = tx
+	return ret, nil
+}
+
+// rowLevelSecurityExpression return the condition of policy for schema, or "" when it don't reference rufsGroupOwner or rufsGroup.
+// The condition of the service use the session variables, the one of reports (report true) use the tenant of rufs.tenant_role.
+func rowLevelSecurityExpression(openapi *OpenApi, schemaName string, schema *Schema, report bool) string {
+	columnName := func(fieldName string) string {
+		if field, ok := schema.Properties[fieldName]; ok && field.InternalName != "" {
+			fieldName = field.InternalName
+		}
+
+		return CamelToUnderscore(fieldName)
+	}
+
+	owner := "nullif(current_setting('rufs.group_owner', true), '')::integer"
+	groups := "string_to_array(nullif(current_setting('rufs.groups', true), ''), ',')::integer[]"
+
+	if report {
+		owner = "(SELECT rufs_group_owner FROM rufs.tenant_role WHERE role_name = current_user)"
+		groups = "(SELECT groups FROM rufs.tenant_role WHERE role_name = current_user)"
+	}
+
+	conditions := []string{}
+
+	if schemaName == "rufsGroupOwner" {
+		conditions = append(conditions, "id = "+owner)
+	}
+
+	rufsGroupOwnerEntries, _ := openapi.getPropertiesWithRef(schemaName, "#/components/schemas/rufsGroupOwner")
+
+	for _, entry := range rufsGroupOwnerEntries {
+		conditions = append(conditions, fmt.Sprintf("%s = %s", columnName(entry["fieldName"].(string)), owner))
+	}
+
+	rufsGroupEntries, _ := openapi.getPropertiesWithRef(schemaName, "#/components/schemas/rufsGroup")
+
+	for _, entry := range rufsGroupEntries {
+		conditions = append(conditions, fmt.Sprintf("%s = ANY (%s)", columnName(entry["fieldName"].(string)), groups))
+	}
+
+	if len(conditions) == 0 {
+		return ""
+	}
+
+	if report {
+		return strings.Join(conditions, " AND ")
+	}
+
+	return fmt.Sprintf("current_setting('rufs.group_owner', true) = '1' OR (%s)", strings.Join(conditions, " AND "))
+}
+
+// rowLevelSecurityUpdate create or replace the policies of the tables of openapi, it is called at each start to follow the changes
+// of schemas. The policies of previous starts are removed from the tables without tenant, or from all tables when the row level
+// security is disabled, otherwise the statements without the session variables would not see any row.
+func (dbSql *DbClientSql) rowLevelSecurityUpdate(openapi *OpenApi) error {
+	list, err := dbSql.getArrayMap(`SELECT DISTINCT tablename FROM pg_policies WHERE schemaname = 'public' AND policyname IN ('rufs_tenant', 'rufs_tenant_report')`, []any{}, nil)
+
+	if err != nil {
+		return fmt.Errorf("[DbClientSql.rowLevelSecurityUpdate] : %s", err)
+	}
+
+	withPolicy := map[string]bool{}
+
+	for _, item := range list {
+		if tableName, ok := item["tablename"].(string); ok {
+			withPolicy[tableName] = true
+		}
+	}
+
+	if list, err = dbSql.getArrayMap(`SELECT table_name FROM information_schema.tables WHERE table_schema = 'public'`, []any{}, nil); err != nil {
+		return fmt.Errorf("[DbClientSql.rowLevelSecurityUpdate] : %s", err)
+	}
+
+	tables := map[string]bool{}
+
+	for _, item := range list {
+		if tableName, ok := item["tableName"].(string); ok {
+			tables[tableName] = true
+		}
+	}
+
+	exec := func(queryer dbSqlQueryer, statements []string) error {
+		for _, statement := range statements {
+			if _, err := queryer.Exec(statement); err != nil {
+				return fmt.Errorf("[DbClientSql.rowLevelSecurityUpdate] %s : %s", statement, err)
+			}
+		}
+
+		return nil
+	}
+
+	return dbSql.withSession(func(queryer dbSqlQueryer) error {
+		expressions := map[string][]string{}
+
+		if dbSql.dbConfig.rowLevelSecurity {
+			for schemaName, schema := range openapi.Components.Schemas {
+				if tableName := CamelToUnderscore(schemaName); tables[tableName] {
+					if expression := rowLevelSecurityExpression(openapi, schemaName, schema, false); expression != "" {
+						expressions[tableName] = []string{expression, rowLevelSecurityExpression(openapi, schemaName, schema, true)}
+					}
+				}
+			}
+		}
+
+		for tableName := range withPolicy {
+			if _, ok := expressions[tableName]; ok {
+				continue
+			}
+
+			if err := exec(queryer, []string{
+				fmt.Sprintf(`DROP POLICY IF EXISTS rufs_tenant ON %s`, tableName),
+				fmt.Sprintf(`DROP POLICY IF EXISTS rufs_tenant_report ON %s`, tableName),
+				fmt.Sprintf(`ALTER TABLE %s NO FORCE ROW LEVEL SECURITY`, tableName),
+				fmt.Sprintf(`ALTER TABLE %s DISABLE ROW LEVEL SECURITY`, tableName),
+			}); err != nil {
+				return err
+			}
+
+			log.Printf("[DbClientSql.rowLevelSecurityUpdate] removed policies of %s", tableName)
+		}
+
+		if len(expressions) == 0 {
+			return nil
+		}
+
+		if err := exec(queryer, []string{`CREATE SCHEMA IF NOT EXISTS rufs`, `CREATE TABLE IF NOT EXISTS rufs.tenant_role (role_name name PRIMARY KEY, rufs_group_owner integer NOT NULL, groups integer[])`}); err != nil {
+			return err
+		}
+
+		for tableName, expression := range expressions {
+			if err := exec(queryer, []string{
+				fmt.Sprintf(`ALTER TABLE %s ENABLE ROW LEVEL SECURITY`, tableName),
+				fmt.Sprintf(`ALTER TABLE %s FORCE ROW LEVEL SECURITY`, tableName),
+				fmt.Sprintf(`DROP POLICY IF EXISTS rufs_tenant ON %s`, tableName),
+				fmt.Sprintf(`DROP POLICY IF EXISTS rufs_tenant_report ON %s`, tableName),
+				fmt.Sprintf(`CREATE POLICY rufs_tenant ON %s TO CURRENT_USER USING (%s) WITH CHECK (%s)`, tableName, expression[0], expression[0]),
+				fmt.Sprintf(`CREATE POLICY rufs_tenant_report ON %s FOR SELECT USING (%s)`, tableName, expression[1]),
+			}); err != nil {
+				return err
+			}
+
+			log.Printf("[DbClientSql.rowLevelSecurityUpdate] policy rufs_tenant of %s : %s", tableName, expression[0])
+		}
+
+		return nil
+	})
+}